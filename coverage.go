@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/toddlucas/terracotta/pre"
+)
+
+// runCoverage renders the source directory, optionally for every
+// combination of a set of symbols, and reports the conditional arms that
+// were never or always taken.
+func runCoverage(args []string) {
+	flags := flag.NewFlagSet("coverage", flag.ExitOnError)
+
+	var o options
+	o.register(flags)
+
+	list := flags.String("symbols", "", "Comma separated symbols to combine, as with the matrix command")
+	matrix := flags.Bool("matrix", false, "Combine the symbols in the config matrix")
+	format := flags.String("format", "text", "The report format: text, json or lcov")
+	output := flags.String("output", "", "Write the report to a file rather than standard output")
+
+	flags.Parse(args)
+
+	symbols := splitList(*list)
+	if len(symbols) == 0 && *matrix {
+		config, err := pre.ReadProjectConfig(*o.source)
+		if err != nil {
+			log.Fatal(err)
+		}
+		symbols = config.Matrix
+	}
+
+	coverage := pre.NewCoverage()
+
+	p := o.preprocessor()
+	p.SetCoverage(coverage)
+
+	if len(symbols) > 0 {
+		combinations, err := p.RenderMatrix(*o.source, symbols, o.defines, o.undefs)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for i := range combinations {
+			if combinations[i].Err != nil {
+				log.Printf("%s: %s", combinations[i].Name(), combinations[i].Err.Error())
+			}
+		}
+	} else {
+		_, err := p.RenderDirectory(*o.source, o.defines, o.undefs)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	w := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var err error
+	switch *format {
+	case "text":
+		err = coverage.WriteText(w)
+	case "json":
+		err = coverage.WriteJSON(w)
+	case "lcov":
+		err = coverage.WriteLCOV(w)
+	default:
+		log.Fatalf("Unknown format '%s'", *format)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
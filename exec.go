@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/toddlucas/terracotta/pre"
+)
+
+// runExec renders the source directory and then runs a command, given after
+// the options, in the output directory. The command's exit status is passed
+// on.
+func runExec(args []string) {
+	flags := flag.NewFlagSet("exec", flag.ExitOnError)
+
+	var o options
+	o.register(flags)
+
+	output := flags.String("output", ".", "The output directory, in which the command runs")
+	sourceMap := flags.String("source-map", "", "Map generated lines to templates: none, file or comments")
+	mapErrors := flags.Bool("map-errors", false, "Translate generated file locations in the command's standard error to templates")
+
+	flags.Parse(args)
+
+	command := flags.Args()
+	if len(command) == 0 {
+		log.Fatal("Usage: terracotta exec [options] -- COMMAND [ARGS...]")
+	}
+
+	// Locations can only be translated with a source map.
+	if *mapErrors && *sourceMap == "" {
+		*sourceMap = "file"
+	}
+
+	mode, err := pre.ParseSourceMapMode(*sourceMap)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p := o.preprocessor()
+
+	// Stop before rendering if the templates have errors.
+	diagnostics, err := p.Lint(*o.source, o.defines, o.undefs, pre.DefaultMaxDepth)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := false
+	for _, d := range diagnostics {
+		fmt.Fprintln(os.Stderr, d)
+		if d.Severity == pre.SeverityError {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+
+	p.SetSourceMap(mode)
+	p.ProcessDirectory(*o.source, *output, o.defines, o.undefs)
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = *output
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+
+	var stderr io.ReadCloser
+	if *mapErrors {
+		stderr, err = cmd.StderrPipe()
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		cmd.Stderr = os.Stderr
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if stderr != nil {
+		reader := bufio.NewReader(stderr)
+		for {
+			line, err := reader.ReadString('\n')
+			fmt.Fprint(os.Stderr, pre.MapLocations(line, *output))
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
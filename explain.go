@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/toddlucas/terracotta/pre"
+)
+
+// runExplain explains why a line of a template, given as FILE:LINE, is
+// included in or excluded from the generated file.
+func runExplain(args []string) {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+
+	var o options
+	o.register(flags)
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		log.Fatal("Usage: terracotta explain [options] FILE:LINE")
+	}
+
+	filename, line, err := splitLocation(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p := o.preprocessor()
+	explanation, err := p.Explain(*o.source, filename, line, o.defines, o.undefs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("%s:%d: %s\n", filename, line, explanation.Text)
+
+	for depth, block := range explanation.Blocks {
+		indent := strings.Repeat("  ", depth+1)
+		for _, arm := range block.Arms {
+			directive := "!" + arm.Directive
+			if arm.Condition != "" {
+				directive += " " + arm.Condition
+			}
+			fmt.Printf("%s%s (line %d): %s\n", indent, directive, arm.Line, armState(arm))
+
+			for _, symbol := range arm.Symbols {
+				fmt.Printf("%s    %s\n", indent, symbol)
+			}
+		}
+
+		if !block.Reached {
+			fmt.Printf("%sThe block isn't reached because an enclosing arm wasn't taken\n", indent)
+		}
+	}
+
+	switch {
+	case explanation.Directive:
+		fmt.Println("The line is a directive, which is never included")
+	case explanation.Active:
+		fmt.Println("The line is included")
+	default:
+		fmt.Println("The line is excluded")
+	}
+}
+
+// armState describes whether an arm of a conditional block was taken.
+func armState(arm pre.ExplainArm) string {
+	switch {
+	case !arm.Evaluated:
+		return "skipped, an earlier arm was taken"
+	case arm.Directive == pre.DirectiveElse, arm.Directive == pre.DirectiveDefault:
+		return "taken"
+	case arm.Taken:
+		return "true, taken"
+	}
+	return "false"
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/toddlucas/terracotta/pre"
+)
+
+// runFormat rewrites the directive lines of templates and definitions files
+// into canonical form. Any arguments are the files to format; otherwise the
+// source directory is formatted.
+func runFormat(args []string) {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+
+	var o options
+	o.register(flags)
+
+	check := flags.Bool("check", false, "List the files that aren't formatted and exit with a non-zero status")
+	write := flags.Bool("w", false, "Write the result to each file rather than standard output")
+	indent := flags.Int("indent", 0, "Indent directives by this many spaces for each enclosing conditional block")
+
+	flags.Parse(args)
+
+	files := flags.Args()
+	if len(files) == 0 {
+		templates, defs, err := o.preprocessor().Files(*o.source)
+		if err != nil {
+			log.Fatal(err)
+		}
+		files = append(defs, templates...)
+	}
+
+	failed := false
+	for _, filename := range files {
+		changed, err := formatFile(filename, *indent, *check, *write)
+		if err != nil {
+			log.Print(err)
+			failed = true
+		} else if changed && *check {
+			fmt.Println(filename)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// formatFile formats a single file. Unless checking or writing, the result
+// is printed. It returns true if the file wasn't already formatted.
+func formatFile(filename string, indent int, check bool, write bool) (bool, error) {
+	input, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+
+	output, err := pre.FormatText(string(input), indent)
+	if err != nil {
+		return false, fmt.Errorf("%s%w", filename, err)
+	}
+
+	changed := output != string(input)
+
+	switch {
+	case check:
+		// The caller reports the file.
+	case write:
+		if changed {
+			info, err := os.Stat(filename)
+			if err != nil {
+				return changed, err
+			}
+			err = ioutil.WriteFile(filename, []byte(output), info.Mode())
+			if err != nil {
+				return changed, err
+			}
+		}
+	default:
+		fmt.Print(output)
+	}
+
+	return changed, nil
+}
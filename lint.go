@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/toddlucas/terracotta/pre"
+)
+
+// runLint checks the templates in the source directory and reports any
+// diagnostics.
+func runLint(args []string) {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+
+	var o options
+	o.register(flags)
+
+	maxDepth := flags.Int("max-depth", pre.DefaultMaxDepth, "The deepest nesting of conditional blocks allowed")
+	rules := flags.Bool("rules", false, "List the lint rules")
+
+	flags.Parse(args)
+
+	if *rules {
+		for _, rule := range pre.LintRules {
+			fmt.Printf("%s  %-8s %s\n", rule.ID, rule.Severity, rule.Description)
+		}
+		return
+	}
+
+	p := o.preprocessor()
+	diagnostics, err := p.Lint(*o.source, o.defines, o.undefs, *maxDepth)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := false
+	for _, d := range diagnostics {
+		fmt.Println(d)
+		if d.Severity != pre.SeverityInfo {
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
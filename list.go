@@ -0,0 +1,19 @@
+package main
+
+import "fmt"
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+//
+// flag.Value interface
+//
+
+func (i *stringList) String() string {
+	return fmt.Sprintf("%s", *i)
+}
+
+func (i *stringList) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/toddlucas/terracotta/pre"
+)
+
+// The directives offered for completion.
+var lspDirectives = []string{
+	pre.DirectiveDefine,
+	pre.DirectiveUndef,
+	pre.DirectiveIf,
+	pre.DirectiveIfdef,
+	pre.DirectiveIfndef,
+	pre.DirectiveElif,
+	pre.DirectiveElse,
+	pre.DirectiveEndif,
+	pre.DirectiveError,
+	pre.DirectiveSwitch,
+	pre.DirectiveCase,
+	pre.DirectiveDefault,
+	pre.DirectiveEndswitch,
+	pre.DirectiveFor,
+	pre.DirectiveEndfor,
+	pre.DirectiveRaw,
+	pre.DirectiveEndraw,
+	pre.DirectiveHeredoc,
+}
+
+// The semantic token types, in the order of the legend.
+const (
+	lspTokenKeyword = iota
+	lspTokenVariable
+	lspTokenComment
+)
+
+var lspTokenTypes = []string{"keyword", "variable", "comment"}
+
+// LSP diagnostic severities and completion item kinds.
+const (
+	lspSeverityError       = 1
+	lspSeverityWarning     = 2
+	lspSeverityInformation = 3
+	lspCompletionKeyword   = 14
+	lspCompletionVariable  = 6
+)
+
+// runLSP runs a Language Server Protocol server over standard input and
+// output. The definitions given as options select the profile used to
+// evaluate templates.
+func runLSP(args []string) {
+	flags := flag.NewFlagSet("lsp", flag.ExitOnError)
+
+	var o options
+	o.register(flags)
+
+	flags.Parse(args)
+
+	// Standard output carries the protocol, so log to standard error.
+	log.SetOutput(os.Stderr)
+
+	s := lspServer{
+		options:   o,
+		documents: make(map[string]*lspDocument),
+		writer:    os.Stdout,
+	}
+
+	err := s.serve(bufio.NewReader(os.Stdin))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+type lspMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextDocument struct {
+	URI  string `json:"uri"`
+	Text string `json:"text"`
+}
+
+type lspDocumentParams struct {
+	TextDocument   lspTextDocument `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+	Position lspPosition `json:"position"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Code     string   `json:"code,omitempty"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// lspDocument is an open template and its most recent analysis.
+type lspDocument struct {
+	filename string
+	lines    []string
+	analysis *pre.Analysis
+}
+
+type lspServer struct {
+	options   options
+	documents map[string]*lspDocument
+	writer    io.Writer
+	shutdown  bool
+}
+
+// serve reads and handles messages until the client exits.
+func (s *lspServer) serve(reader *bufio.Reader) error {
+	for {
+		body, err := readLSPMessage(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var message lspMessage
+		if err := json.Unmarshal(body, &message); err != nil {
+			log.Print(err)
+			continue
+		}
+
+		if message.Method == "exit" {
+			if !s.shutdown {
+				os.Exit(1)
+			}
+			return nil
+		}
+
+		result, err := s.handle(message.Method, message.Params)
+
+		// Notifications have no ID and get no response.
+		if message.ID == nil {
+			if err != nil {
+				log.Print(err)
+			}
+			continue
+		}
+
+		response := lspMessage{JSONRPC: "2.0", ID: message.ID, Result: result}
+		if err != nil {
+			response.Result = nil
+			response.Error = &lspError{-32603, err.Error()}
+		} else if result == nil {
+			response.Result = json.RawMessage("null")
+		}
+		if err := s.send(response); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *lspServer) handle(method string, raw json.RawMessage) (interface{}, error) {
+	var params lspDocumentParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+	}
+
+	uri := params.TextDocument.URI
+
+	switch method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   1, // Full
+				"hoverProvider":      true,
+				"definitionProvider": true,
+				"completionProvider": map[string]interface{}{
+					"triggerCharacters": []string{"!"},
+				},
+				"semanticTokensProvider": map[string]interface{}{
+					"legend": map[string]interface{}{
+						"tokenTypes":     lspTokenTypes,
+						"tokenModifiers": []string{},
+					},
+					"full": true,
+				},
+			},
+			"serverInfo": map[string]string{
+				"name":    "terracotta",
+				"version": pre.GetVersion(),
+			},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		return nil, s.update(uri, params.TextDocument.Text)
+	case "textDocument/didChange":
+		if n := len(params.ContentChanges); n > 0 {
+			return nil, s.update(uri, params.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		delete(s.documents, uri)
+		return nil, s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+			"uri":         uri,
+			"diagnostics": []lspDiagnostic{},
+		})
+	case "textDocument/hover":
+		return s.hover(uri, params.Position), nil
+	case "textDocument/definition":
+		return s.definition(uri, params.Position), nil
+	case "textDocument/completion":
+		return s.completion(uri, params.Position), nil
+	case "textDocument/semanticTokens/full":
+		return s.semanticTokens(uri), nil
+	}
+
+	return nil, nil
+}
+
+// update analyzes a document's text and publishes its diagnostics.
+func (s *lspServer) update(uri string, text string) error {
+	filename, err := uriFilename(uri)
+	if err != nil {
+		return err
+	}
+
+	// Templates are evaluated from their project root, as when processing
+	// the whole project.
+	root, err := pre.FindProjectRoot(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+
+	p := s.options.preprocessor()
+	analysis, err := p.Analyze(root, filename, text, s.options.defines, s.options.undefs)
+	if err != nil {
+		log.Print(err)
+	}
+
+	s.documents[uri] = &lspDocument{filename, strings.Split(text, "\n"), analysis}
+
+	diagnostics := []lspDiagnostic{}
+	for _, d := range analysis.Diagnostics {
+		line := d.Line - 1
+		if line < 0 {
+			line = 0
+		}
+
+		severity := lspSeverityError
+		switch d.Severity {
+		case pre.SeverityWarning:
+			severity = lspSeverityWarning
+		case pre.SeverityInfo:
+			severity = lspSeverityInformation
+		}
+
+		diagnostics = append(diagnostics, lspDiagnostic{
+			Range:    lspRange{lspPosition{line, 0}, lspPosition{line, lspLength(lineAt(s.documents[uri].lines, line))}},
+			Severity: severity,
+			Code:     d.Rule,
+			Source:   "terracotta",
+			Message:  d.Message,
+		})
+	}
+
+	return s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+		"uri":         uri,
+		"diagnostics": diagnostics,
+	})
+}
+
+// hover describes the symbol at a position.
+func (s *lspServer) hover(uri string, position lspPosition) interface{} {
+	symbol, r, ok := s.symbolAt(uri, position)
+	if !ok {
+		return nil
+	}
+
+	return map[string]interface{}{
+		"contents": map[string]string{
+			"kind":  "plaintext",
+			"value": symbol.String(),
+		},
+		"range": r,
+	}
+}
+
+// definition returns where the symbol at a position was defined.
+func (s *lspServer) definition(uri string, position lspPosition) interface{} {
+	symbol, _, ok := s.symbolAt(uri, position)
+	if !ok {
+		return nil
+	}
+
+	filename, line := splitOrigin(symbol.Origin)
+	if filename == "" {
+		return nil
+	}
+
+	absolute, err := filepath.Abs(filename)
+	if err != nil {
+		return nil
+	}
+
+	start := lspPosition{line - 1, 0}
+	return lspLocation{filenameURI(absolute), lspRange{start, start}}
+}
+
+// completion offers directive names after a '!' that starts a line, and
+// known symbols within a directive.
+func (s *lspServer) completion(uri string, position lspPosition) interface{} {
+	items := []lspCompletionItem{}
+
+	document, ok := s.documents[uri]
+	if !ok {
+		return items
+	}
+
+	line := lineAt(document.lines, position.Line)
+	prefix := strings.TrimLeft(string(utf16Prefix(line, position.Character)), " \t")
+	if !strings.HasPrefix(prefix, "!") {
+		return items
+	}
+
+	// Still typing the directive name.
+	if strings.TrimLeftFunc(prefix[1:], isSymbolRune) == "" {
+		for _, directive := range lspDirectives {
+			items = append(items, lspCompletionItem{Label: directive, Kind: lspCompletionKeyword})
+		}
+		return items
+	}
+
+	symbols := document.analysis.SymbolsAt(position.Line + 1)
+
+	var names []string
+	for name := range symbols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		items = append(items, lspCompletionItem{Label: name, Kind: lspCompletionVariable, Detail: symbols[name].String()})
+	}
+	items = append(items,
+		lspCompletionItem{Label: "true", Kind: lspCompletionKeyword},
+		lspCompletionItem{Label: "false", Kind: lspCompletionKeyword})
+	for _, name := range pre.FunctionNames() {
+		items = append(items, lspCompletionItem{Label: name, Kind: lspCompletionKeyword})
+	}
+
+	return items
+}
+
+// semanticTokens marks directive names and symbols, and marks the lines
+// excluded for the current definitions as comments so that editors dim
+// them.
+func (s *lspServer) semanticTokens(uri string) interface{} {
+	data := []int{}
+
+	document, ok := s.documents[uri]
+	if !ok {
+		return map[string]interface{}{"data": data}
+	}
+
+	inactive := make(map[int]bool)
+	verbatim := make(map[int]bool)
+	if document.analysis != nil {
+		for _, line := range document.analysis.Inactive {
+			inactive[line-1] = true
+		}
+		for _, line := range document.analysis.Verbatim {
+			verbatim[line-1] = true
+		}
+	}
+
+	previousLine, previousStart := 0, 0
+	add := func(line int, start int, length int, tokenType int) {
+		if length == 0 {
+			return
+		}
+		deltaStart := start
+		if line == previousLine {
+			deltaStart = start - previousStart
+		}
+		data = append(data, line-previousLine, deltaStart, length, tokenType, 0)
+		previousLine, previousStart = line, start
+	}
+
+	for i, line := range document.lines {
+		line = strings.TrimSuffix(line, "\r")
+		if inactive[i] {
+			add(i, 0, lspLength(line), lspTokenComment)
+			continue
+		}
+
+		if verbatim[i] || !isDirectiveLine(line) {
+			continue
+		}
+
+		for _, word := range directiveWords(line) {
+			tokenType := lspTokenVariable
+			if word.first {
+				tokenType = lspTokenKeyword
+			}
+			add(i, word.start, word.length, tokenType)
+		}
+	}
+
+	return map[string]interface{}{"data": data}
+}
+
+// symbolAt returns the symbol named at a position in a directive line.
+func (s *lspServer) symbolAt(uri string, position lspPosition) (pre.ExplainSymbol, lspRange, bool) {
+	document, ok := s.documents[uri]
+	if !ok || document.analysis == nil {
+		return pre.ExplainSymbol{}, lspRange{}, false
+	}
+
+	line := strings.TrimSuffix(lineAt(document.lines, position.Line), "\r")
+	if !isDirectiveLine(line) {
+		return pre.ExplainSymbol{}, lspRange{}, false
+	}
+	for _, verbatim := range document.analysis.Verbatim {
+		if verbatim-1 == position.Line {
+			return pre.ExplainSymbol{}, lspRange{}, false
+		}
+	}
+
+	// The symbols in effect at the line, rather than those at the end.
+	symbols := document.analysis.SymbolsAt(position.Line + 1)
+	for _, word := range directiveWords(line) {
+		if word.first || position.Character < word.start || position.Character > word.start+word.length {
+			continue
+		}
+
+		symbol, ok := symbols[word.text]
+		if !ok {
+			symbol = pre.ExplainSymbol{Name: word.text}
+		}
+
+		r := lspRange{lspPosition{position.Line, word.start}, lspPosition{position.Line, word.start + word.length}}
+		return symbol, r, true
+	}
+
+	return pre.ExplainSymbol{}, lspRange{}, false
+}
+
+// directiveWord is an identifier in a directive line. Offsets are in UTF-16
+// code units, as LSP requires.
+type directiveWord struct {
+	text   string
+	start  int
+	length int
+	first  bool // The directive name, including its '!'.
+}
+
+// isDirectiveLine returns true if a line begins with a directive, rather
+// than text such as a substitution.
+func isDirectiveLine(line string) bool {
+	trimmed := strings.TrimLeft(line, " \t")
+	return strings.HasPrefix(trimmed, "!") && !strings.HasPrefix(trimmed, "!{") && !strings.HasPrefix(trimmed, "!!{")
+}
+
+// directiveWords returns the directive name and the identifiers that
+// follow it, ignoring strings and comments.
+func directiveWords(line string) []directiveWord {
+	var words []directiveWord
+
+	runes := []rune(line)
+	offset := 0 // In UTF-16 code units
+	quoted := false
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case quoted && r == '\\':
+			offset += utf16.RuneLen(r)
+			i++
+			if i < len(runes) {
+				offset += utf16.RuneLen(runes[i])
+				i++
+			}
+			continue
+		case r == '"':
+			quoted = !quoted
+		case quoted:
+			// Strings contain no identifiers.
+		case r == '#' || (r == '/' && i+1 < len(runes) && runes[i+1] == '*'):
+			return words
+		case r == '!' && len(words) == 0:
+			// The directive name may be separated from its '!'.
+			start := offset
+			j := i + 1
+			for j < len(runes) && (runes[j] == ' ' || runes[j] == '\t') {
+				j++
+			}
+			k := j
+			for k < len(runes) && isSymbolRune(runes[k]) {
+				k++
+			}
+			length := lspLength(string(runes[i:k]))
+			words = append(words, directiveWord{string(runes[j:k]), start, length, true})
+			if string(runes[j:k]) == pre.DirectiveError {
+				// The message is free-form.
+				return words
+			}
+			offset += length
+			i = k
+			continue
+		case isSymbolRune(r) && len(words) > 0:
+			j := i
+			for j < len(runes) && isSymbolRune(runes[j]) {
+				j++
+			}
+			text := string(runes[i:j])
+			length := lspLength(text)
+			if text != "true" && text != "false" && (j >= len(runes) || runes[j] != '(') {
+				words = append(words, directiveWord{text, offset, length, false})
+			}
+			offset += length
+			i = j
+			continue
+		}
+
+		offset += utf16.RuneLen(r)
+		i++
+	}
+
+	return words
+}
+
+func isSymbolRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+// splitOrigin returns the file and line of an origin such as
+// "terraform.tfdefs:2". Origins without a file, such as the command line,
+// return an empty filename.
+func splitOrigin(origin string) (string, int) {
+	if origin == "" || !strings.ContainsAny(origin, `/\.`) {
+		return "", 0
+	}
+
+	if separator := strings.LastIndex(origin, ":"); separator >= 0 {
+		if line, err := strconv.Atoi(origin[separator+1:]); err == nil {
+			return origin[:separator], line
+		}
+	}
+
+	// A config file has no line.
+	return origin, 1
+}
+
+func lineAt(lines []string, line int) string {
+	if line < 0 || line >= len(lines) {
+		return ""
+	}
+	return lines[line]
+}
+
+// lspLength returns the length of text in UTF-16 code units.
+func lspLength(text string) int {
+	return len(utf16.Encode([]rune(text)))
+}
+
+// utf16Prefix returns the runes of line before a UTF-16 offset.
+func utf16Prefix(line string, character int) []rune {
+	var prefix []rune
+	offset := 0
+	for _, r := range line {
+		offset += utf16.RuneLen(r)
+		if offset > character {
+			break
+		}
+		prefix = append(prefix, r)
+	}
+	return prefix
+}
+
+func uriFilename(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("Unsupported URI '%s'", uri)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+func filenameURI(filename string) string {
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(filename)}
+	return u.String()
+}
+
+// readLSPMessage reads the body of a message, which is preceded by headers
+// that give its length.
+func readLSPMessage(reader *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		header = strings.TrimSpace(header)
+		if header == "" {
+			break
+		}
+
+		if value := strings.TrimPrefix(header, "Content-Length:"); value != header {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if length < 0 {
+		return nil, fmt.Errorf("Message has no Content-Length")
+	}
+
+	body := make([]byte, length)
+	_, err := io.ReadFull(reader, body)
+	return body, err
+}
+
+func (s *lspServer) notify(method string, params interface{}) error {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return s.send(lspMessage{JSONRPC: "2.0", Method: method, Params: raw})
+}
+
+func (s *lspServer) send(message lspMessage) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(s.writer, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
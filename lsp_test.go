@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lspSession queues requests and notifications for the server, which are
+// handled when the session runs.
+type lspSession struct {
+	t     *testing.T
+	input bytes.Buffer
+	id    int
+}
+
+// message queues a message and returns its ID, which is zero for a
+// notification.
+func (l *lspSession) message(method string, params interface{}, request bool) int {
+	l.t.Helper()
+
+	message := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+	id := 0
+	if request {
+		l.id++
+		id = l.id
+		message["id"] = id
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	fmt.Fprintf(&l.input, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return id
+}
+
+func (l *lspSession) request(method string, params interface{}) int {
+	return l.message(method, params, true)
+}
+
+func (l *lspSession) notify(method string, params interface{}) {
+	l.message(method, params, false)
+}
+
+// run serves the messages and returns the results of the requests by ID.
+func (l *lspSession) run() map[int]json.RawMessage {
+	l.t.Helper()
+
+	var o options
+	o.register(flag.NewFlagSet("lsp", flag.ContinueOnError))
+
+	var output bytes.Buffer
+	s := lspServer{options: o, documents: make(map[string]*lspDocument), writer: &output}
+	if err := s.serve(bufio.NewReader(&l.input)); err != nil {
+		l.t.Fatal(err)
+	}
+
+	results := make(map[int]json.RawMessage)
+	reader := bufio.NewReader(&output)
+	for {
+		body, err := readLSPMessage(reader)
+		if err != nil {
+			break
+		}
+
+		var response struct {
+			ID     *int            `json:"id"`
+			Result json.RawMessage `json:"result"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			l.t.Fatal(err)
+		}
+		if response.ID != nil {
+			results[*response.ID] = response.Result
+		}
+	}
+	return results
+}
+
+func TestLSPRequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terracotta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "terracotta.json"), []byte("{}"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, "main.tft")
+	uri := filenameURI(filename)
+	text := strings.Join([]string{
+		"!define X",
+		"!if X",
+		"!endif",
+		"!undef X",
+		"!for REGION in \"a\", \"b\"",
+		"!if REGION",
+		"!endif",
+		"!endfor",
+		"!if X",
+		"!endif",
+	}, "\n")
+
+	position := func(line int, character int) map[string]interface{} {
+		return map[string]interface{}{
+			"textDocument": map[string]string{"uri": uri},
+			"position":     map[string]int{"line": line, "character": character},
+		}
+	}
+
+	l := lspSession{t: t}
+	l.request("initialize", map[string]interface{}{})
+	l.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri, "text": text},
+	})
+	before := l.request("textDocument/hover", position(1, 4))
+	after := l.request("textDocument/hover", position(8, 4))
+	loop := l.request("textDocument/definition", position(5, 5))
+	completion := l.request("textDocument/completion", position(5, 4))
+	l.request("shutdown", nil)
+	l.notify("exit", nil)
+
+	results := l.run()
+
+	// Hover shows the symbol as of its line, not the end of the file.
+	hoverExpect := func(id int, expected string) {
+		t.Helper()
+
+		var hover struct {
+			Contents struct {
+				Value string `json:"value"`
+			} `json:"contents"`
+		}
+		if err := json.Unmarshal(results[id], &hover); err != nil {
+			t.Fatal(err)
+		}
+		if hover.Contents.Value != expected {
+			t.Errorf("Expected hover %q but received %q", expected, hover.Contents.Value)
+		}
+	}
+	hoverExpect(before, "X: defined ("+filename+":1)")
+	hoverExpect(after, "X: undefined ("+filename+":4)")
+
+	// A loop variable is defined by its !for.
+	var location lspLocation
+	if err := json.Unmarshal(results[loop], &location); err != nil {
+		t.Fatal(err)
+	}
+	if location.URI != uri || location.Range.Start.Line != 4 {
+		t.Errorf("Expected REGION to be defined on line 4 of %s but received %v", uri, location)
+	}
+
+	var items []lspCompletionItem
+	if err := json.Unmarshal(results[completion], &items); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, item := range items {
+		found = found || item.Label == "REGION"
+	}
+	if !found {
+		t.Errorf("Expected REGION to be completed within the loop but received %v", items)
+	}
+}
@@ -3,19 +3,41 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
+	"os"
 
 	"github.com/toddlucas/terracotta/pre"
 )
 
+// commands maps a command name, given as the first argument, to the
+// function that runs it with the remaining arguments.
+var commands = map[string]func(args []string){
+	"coverage": runCoverage,
+	"exec":     runExec,
+	"explain":  runExplain,
+	"fmt":      runFormat,
+	"lint":     runLint,
+	"lsp":      runLSP,
+	"map":      runMap,
+	"matrix":   runMatrix,
+	"simplify": runSimplify,
+	"symbols":  runSymbols,
+	"sync":     runSync,
+}
+
 func main() {
-	var defines symbols
-	var undefs symbols
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
 
-	flag.Var(&defines, "define", "Define one or more preprocessor symbols")
-	flag.Var(&undefs, "undef", "Undefine one or more preprocessor symbols")
+	var o options
+	o.register(flag.CommandLine)
 
-	source := flag.String("source", ".", "The source directory")
 	output := flag.String("output", ".", "The output directory")
+	sourceMap := flag.String("source-map", "", "Map generated lines to templates: none, file or comments")
 	version := flag.Bool("version", false, "The version")
 
 	flag.Parse()
@@ -25,7 +47,19 @@ func main() {
 		return
 	}
 
-	p := pre.Preprocessor{}
+	mode, err := pre.ParseSourceMapMode(*sourceMap)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p := o.preprocessor()
+	p.SetSourceMap(mode)
+
+	// Any remaining arguments are individual templates to process.
+	if files := flag.Args(); len(files) > 0 {
+		p.ProcessFiles(*o.source, *output, files, o.defines, o.undefs)
+		return
+	}
 
-	p.ProcessDirectory(*source, *output, defines, undefs)
+	p.ProcessDirectory(*o.source, *output, o.defines, o.undefs)
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/toddlucas/terracotta/pre"
+)
+
+// runMap translates locations in generated files, given as FILE:LINE, to
+// the template lines that produced them.
+func runMap(args []string) {
+	flags := flag.NewFlagSet("map", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		log.Fatal("Usage: terracotta map FILE:LINE...")
+	}
+
+	for _, arg := range flags.Args() {
+		filename, line, err := splitLocation(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		location, err := pre.MapLocation(filename, line)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println(location)
+	}
+}
+
+// splitLocation splits a location given as FILE:LINE.
+func splitLocation(location string) (string, int, error) {
+	separator := strings.LastIndex(location, ":")
+	if separator < 0 {
+		return "", 0, fmt.Errorf("Expected FILE:LINE but received '%s'", location)
+	}
+
+	line, err := strconv.Atoi(location[separator+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid line in '%s'", location)
+	}
+
+	return location[:separator], line, nil
+}
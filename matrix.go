@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/toddlucas/terracotta/pre"
+)
+
+// runMatrix renders the source directory for every combination of a set of
+// symbols and reports failures and differences.
+func runMatrix(args []string) {
+	flags := flag.NewFlagSet("matrix", flag.ExitOnError)
+
+	var o options
+	o.register(flags)
+
+	list := flags.String("symbols", "", "Comma separated symbols to combine (defaults to the config matrix)")
+	output := flags.String("output", "", "Write each combination to a subdirectory of this directory")
+
+	flags.Parse(args)
+
+	symbols := splitList(*list)
+
+	if len(symbols) == 0 {
+		config, err := pre.ReadProjectConfig(*o.source)
+		if err != nil {
+			log.Fatal(err)
+		}
+		symbols = config.Matrix
+	}
+
+	if len(symbols) == 0 {
+		log.Fatal("No matrix symbols given")
+	}
+
+	p := o.preprocessor()
+	combinations, err := p.RenderMatrix(*o.source, symbols, o.defines, o.undefs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for i := range combinations {
+		c := &combinations[i]
+		if c.Err != nil {
+			fmt.Printf("%-24s error: %s\n", c.Name(), c.Err.Error())
+			continue
+		}
+
+		fmt.Printf("%-24s ok\n", c.Name())
+
+		if *output != "" {
+			err = writeFiles(filepath.Join(*output, c.Name()), c.Files)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	summary := pre.SummarizeMatrix(symbols, combinations)
+
+	fmt.Println()
+	fmt.Printf("%d of %d combinations failed\n", len(summary.Failed), len(combinations))
+
+	for _, file := range summary.Files {
+		if len(file.Variants) == 1 {
+			fmt.Printf("%s: identical\n", file.Filename)
+			continue
+		}
+
+		fmt.Printf("%s: %d variants\n", file.Filename, len(file.Variants))
+		for _, variant := range file.Variants {
+			fmt.Printf("  %s\n", strings.Join(variant, ", "))
+		}
+	}
+
+	for _, symbol := range summary.Unused {
+		fmt.Printf("%s has no effect\n", symbol)
+	}
+
+	if len(summary.Failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+// writeFiles writes rendered files, keyed by slash separated relative path,
+// below the output directory.
+func writeFiles(output string, files map[string]string) error {
+	var filenames []string
+	for filename := range files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		name := filepath.Join(output, filepath.FromSlash(filename))
+		err := os.MkdirAll(filepath.Dir(name), 0777)
+		if err != nil {
+			return err
+		}
+
+		err = ioutil.WriteFile(name, []byte(files[filename]), 0666)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
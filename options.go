@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/toddlucas/terracotta/pre"
+)
+
+// options are the flags shared by the commands that process templates.
+type options struct {
+	defines   symbols
+	undefs    symbols
+	includes  stringList
+	excludes  stringList
+	defsFiles stringList
+	source    *string
+	envPrefix *string
+	recursive *bool
+	strict    *bool
+	maxIter   *int
+}
+
+func (o *options) register(flags *flag.FlagSet) {
+	flags.Var(&o.defines, "define", "Define one or more preprocessor symbols")
+	flags.Var(&o.undefs, "undef", "Undefine one or more preprocessor symbols")
+	flags.Var(&o.includes, "include", "Only process templates matching one or more glob patterns")
+	flags.Var(&o.excludes, "exclude", "Skip files and directories matching one or more glob patterns")
+	flags.Var(&o.defsFiles, "defs-file", "Load definitions from one or more JSON, YAML, tfvars or tfdefs files")
+
+	o.source = flags.String("source", ".", "The source directory")
+	o.envPrefix = flags.String("env-prefix", pre.DefaultEnvironmentPrefix, "Define symbols from environment variables with this prefix")
+	o.recursive = flags.Bool("recursive", true, "Process subdirectories")
+	o.strict = flags.Bool("strict", false, "Reject symbols with non-Boolean values used as conditions")
+	o.maxIter = flags.Int("max-iterations", pre.DefaultMaxIterations, "The most iterations of !for loops allowed in each template")
+}
+
+// preprocessor returns a preprocessor configured by the options.
+func (o *options) preprocessor() *pre.Preprocessor {
+	p := &pre.Preprocessor{}
+	p.SetInclude(o.includes)
+	p.SetExclude(o.excludes)
+	p.SetRecursive(*o.recursive)
+	p.SetEnvironmentPrefix(*o.envPrefix)
+	p.SetStrict(*o.strict)
+	p.SetMaxIterations(*o.maxIter)
+
+	err := p.SetDefinitionsFiles(o.defsFiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return p
+}
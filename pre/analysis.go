@@ -0,0 +1,132 @@
+package pre
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Analysis describes a template as it's being edited, for editor tooling.
+type Analysis struct {
+	Diagnostics []Diagnostic
+	Symbols     map[string]ExplainSymbol         // The symbols in effect at the end, by name.
+	LineSymbols map[int]map[string]ExplainSymbol // The symbols in effect at each directive line.
+	Inactive    []int                            // The text lines that are excluded.
+	Verbatim    []int                            // The lines of !raw blocks and heredocs, which are never directives.
+}
+
+// SymbolsAt returns the symbols in effect when a directive line is
+// processed, before the directive itself. A line within a !for loop has
+// those of the loop's first iteration. Lines that weren't processed, such as
+// those following an error, have the symbols in effect at the end.
+func (a *Analysis) SymbolsAt(line int) map[string]ExplainSymbol {
+	if symbols, ok := a.LineSymbols[line]; ok {
+		return symbols
+	}
+	return a.Symbols
+}
+
+// Analyze checks the text of the template at filename, within the source
+// directory, and processes it with the definitions that apply to it. The
+// text may differ from the file on disk. The symbols are those in effect at
+// the end of the template, or where processing stopped due to an error,
+// and those at each directive line.
+func (p *Preprocessor) Analyze(source string, filename string, text string, defines []string, undefs []string) (*Analysis, error) {
+	analysis := &Analysis{
+		Diagnostics: LintText(filename, text, DefaultMaxDepth),
+		Symbols:     make(map[string]ExplainSymbol),
+		LineSymbols: make(map[int]map[string]ExplainSymbol),
+		Verbatim:    verbatimLines(text),
+	}
+
+	rel, err := relativePath(source, filename)
+	if err != nil {
+		return analysis, err
+	}
+
+	if !strings.HasSuffix(rel, templateExtension) {
+		return analysis, fmt.Errorf("'%s' is not a template", filename)
+	}
+
+	p.defines = defines
+	p.undefs = undefs
+
+	levels, err := p.enterAncestors(source)
+	if err != nil {
+		return analysis, err
+	}
+	defer p.leave(levels)
+
+	_, err = p.withTemplate(source, rel, func(input string) error {
+		p.analyzeText(filename, text, analysis)
+		return nil
+	})
+
+	return analysis, err
+}
+
+// analyzeText records the inactive lines and the symbols in effect at each
+// directive line and at the end. Syntax
+// errors are reported by the lint diagnostics, so they only stop the
+// analysis.
+func (p *Preprocessor) analyzeText(filename string, text string, analysis *Analysis) {
+	p.parser.SetText(text)
+	p.parser.filename = filename
+
+	p.parser.Enter()
+	defer p.parser.Leave()
+
+	for {
+		symbols := p.parser.context.symbols()
+
+		item, err := p.parser.ParseLine()
+		if err != nil {
+			if e, ok := err.(ProcessingError); ok && e.kind == ProcessingErrorDirective {
+				analysis.Diagnostics = append(analysis.Diagnostics, Diagnostic{filename, e.Line(), "", SeverityError, e.String()})
+				analysis.recordLineSymbols(e.Line(), symbols)
+				continue
+			}
+			break
+		}
+
+		if item.kind == ParseItemEnd {
+			break
+		}
+
+		if item.kind == ParseItemDirective {
+			analysis.recordLineSymbols(item.line, symbols)
+		}
+
+		if item.kind == ParseItemText && !item.active {
+			analysis.Inactive = append(analysis.Inactive, item.line)
+		}
+	}
+
+	for name, symbol := range p.parser.context.symbols() {
+		analysis.Symbols[name] = symbol
+	}
+
+	sort.SliceStable(analysis.Diagnostics, func(i, j int) bool {
+		return analysis.Diagnostics[i].Line < analysis.Diagnostics[j].Line
+	})
+}
+
+// recordLineSymbols records the symbols in effect at a directive line,
+// unless the line has been processed before in an earlier loop iteration.
+func (a *Analysis) recordLineSymbols(line int, symbols map[string]ExplainSymbol) {
+	if _, ok := a.LineSymbols[line]; !ok {
+		a.LineSymbols[line] = symbols
+	}
+}
+
+// symbols returns every symbol that's defined or undefined in an open
+// namespace, with its value and origin.
+func (c *parserContext) symbols() map[string]ExplainSymbol {
+	symbols := make(map[string]ExplainSymbol)
+	for i := range c.nameStack {
+		for name, entry := range c.nameStack[i].names {
+			symbols[name] = ExplainSymbol{name, entry.defined, entry.value.String(), entry.origin}
+		}
+	}
+	return symbols
+}
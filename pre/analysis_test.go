@@ -0,0 +1,92 @@
+package pre
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terracotta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, configFilename), []byte(`{"define": ["SSL"]}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// The text is analyzed as edited, so the file needn't exist.
+	filename := filepath.Join(dir, "main.tft")
+	text := "!if SSL\na\n!else\nb\n!endif\n!if RDS\n!error \"No RDS\"\n!endif\n!if\n"
+
+	p := Preprocessor{}
+	analysis, err := p.Analyze(dir, filename, text, []string{"RDS"}, nil)
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+
+	if len(analysis.Inactive) != 1 || analysis.Inactive[0] != 4 {
+		t.Errorf("Expected line 4 to be inactive but received %v", analysis.Inactive)
+	}
+
+	if symbol := analysis.Symbols["SSL"]; !symbol.Defined || symbol.Origin != filepath.Join(dir, configFilename) {
+		t.Errorf("Expected SSL to be defined in the config: %v", symbol)
+	}
+	if symbol := analysis.Symbols["RDS"]; !symbol.Defined || symbol.Origin != originCommandLine {
+		t.Errorf("Expected RDS to be defined on the command line: %v", symbol)
+	}
+
+	if len(analysis.Diagnostics) != 2 {
+		t.Fatalf("Expected 2 diagnostics but received %v", analysis.Diagnostics)
+	}
+	if d := analysis.Diagnostics[0]; d.Line != 7 || d.Message != "No RDS" {
+		t.Errorf("Expected the !error on line 7 but received %v", d)
+	}
+	if d := analysis.Diagnostics[1]; d.Line != 9 || d.Rule != RuleSyntax {
+		t.Errorf("Expected a syntax error on line 9 but received %v", d)
+	}
+}
+
+func TestAnalyzeLineSymbols(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terracotta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "main.tft")
+	text := "!define X\n!if X\n!endif\n!undef X\n!for R in \"a\", \"b\"\n!if R\n!endif\n!endfor\n!if X\n!endif\n"
+
+	p := Preprocessor{}
+	analysis, err := p.Analyze(dir, filename, text, nil, nil)
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+
+	// Each directive line has the symbols in effect before it.
+	if symbol := analysis.SymbolsAt(2)["X"]; !symbol.Defined || symbol.Origin != filename+":1" {
+		t.Errorf("Expected X to be defined on line 1 at line 2: %v", symbol)
+	}
+	if symbol := analysis.SymbolsAt(9)["X"]; symbol.Defined || symbol.Origin != filename+":4" {
+		t.Errorf("Expected X to be undefined on line 4 at line 9: %v", symbol)
+	}
+
+	// A loop variable is bound within the loop, to its first element.
+	if _, ok := analysis.SymbolsAt(5)["R"]; ok {
+		t.Error("Expected R not to be bound at its !for")
+	}
+	if symbol := analysis.SymbolsAt(6)["R"]; !symbol.Defined || symbol.Value != "a" || symbol.Origin != filename+":5" {
+		t.Errorf("Expected R to be bound to a by the !for on line 5 at line 6: %v", symbol)
+	}
+	if _, ok := analysis.SymbolsAt(9)["R"]; ok {
+		t.Error("Expected R not to be bound after the loop")
+	}
+
+	// Other lines have the symbols at the end.
+	if symbol := analysis.SymbolsAt(100)["X"]; symbol.Defined {
+		t.Errorf("Expected X to be undefined at the end: %v", symbol)
+	}
+}
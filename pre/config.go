@@ -0,0 +1,96 @@
+package pre
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const configFilename = "terracotta.json"
+
+// vcsDirectories mark the root of a version control repository.
+var vcsDirectories = []string{".git", ".hg"}
+
+// Config holds project settings. It is read from a 'terracotta.json' file,
+// which also marks the project root.
+type Config struct {
+	// Define lists symbols defined for the whole project.
+	Define []string `json:"define"`
+	// Undef lists symbols undefined for the whole project.
+	Undef []string `json:"undef"`
+	// Matrix lists the symbols whose combinations are rendered by the
+	// matrix command.
+	Matrix []string `json:"matrix"`
+}
+
+// ReadConfig loads a config file.
+func ReadConfig(filename string) (*Config, error) {
+	buffer, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	if len(buffer) > 0 {
+		err = json.Unmarshal(buffer, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+// ReadProjectConfig loads the config file at the project root for dir. If
+// there is no config file, an empty config is returned.
+func ReadProjectConfig(dir string) (*Config, error) {
+	root, err := FindProjectRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	filename := filepath.Join(root, configFilename)
+	if _, err := os.Stat(filename); err != nil {
+		return &Config{}, nil
+	}
+
+	return ReadConfig(filename)
+}
+
+// FindProjectRoot returns the project root for a directory. This is the
+// nearest of dir and its ancestors that contains a config file or is the
+// root of a version control repository. If there is no such directory, dir
+// is the project root. The result is an absolute path.
+func FindProjectRoot(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for current := dir; ; {
+		if isProjectRoot(current) {
+			return current, nil
+		}
+
+		parent := filepath.Dir(current)
+		if parent == current {
+			return dir, nil
+		}
+		current = parent
+	}
+}
+
+func isProjectRoot(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, configFilename)); err == nil {
+		return true
+	}
+
+	for _, vcs := range vcsDirectories {
+		if _, err := os.Stat(filepath.Join(dir, vcs)); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,133 @@
+package pre
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// projectTree returns a temporary directory holding the given files, keyed
+// by their slash separated paths, which the caller removes.
+func projectTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "terracotta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, text := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(filename), 0777)
+		if err := ioutil.WriteFile(filename, []byte(text), 0666); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func projectRootExpect(t *testing.T, files map[string]string, dir string, expected string) {
+	t.Helper()
+
+	root := projectTree(t, files)
+	defer os.RemoveAll(root)
+
+	// Compare absolute paths, since the temporary directory may be a symlink.
+	root, err := filepath.Abs(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := FindProjectRoot(filepath.Join(root, filepath.FromSlash(dir)))
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+	if actual != filepath.Join(root, filepath.FromSlash(expected)) {
+		t.Errorf("Expected the project root of %s to be %q but received %q", dir, expected, actual)
+	}
+}
+
+func TestFindProjectRoot(t *testing.T) {
+	// A config file marks the root.
+	projectRootExpect(t, map[string]string{
+		configFilename:         "{}",
+		"modules/vpc/main.tft": "",
+	}, "modules/vpc", ".")
+
+	// So does a version control directory, and the nearest marker wins.
+	projectRootExpect(t, map[string]string{
+		configFilename:         "{}",
+		"modules/.git/HEAD":    "",
+		"modules/vpc/main.tft": "",
+	}, "modules/vpc", "modules")
+	projectRootExpect(t, map[string]string{
+		"modules/.hg/requires": "",
+		"modules/vpc/main.tft": "",
+	}, "modules/vpc", "modules")
+
+	// Without a marker, the directory itself is the root.
+	projectRootExpect(t, map[string]string{
+		"modules/vpc/main.tft": "",
+	}, "modules/vpc", "modules/vpc")
+}
+
+func TestProjectAncestors(t *testing.T) {
+	root := projectTree(t, map[string]string{
+		".git/HEAD":            "",
+		"modules/vpc/main.tft": "",
+	})
+	defer os.RemoveAll(root)
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The ancestors run from the root down to the directory's parent.
+	actualRoot, ancestors, err := projectAncestors(filepath.Join(root, "modules", "vpc"))
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+	expected := []string{root, filepath.Join(root, "modules")}
+	if actualRoot != root || !reflect.DeepEqual(ancestors, expected) {
+		t.Errorf("Expected %q and %v but received %q and %v", root, expected, actualRoot, ancestors)
+	}
+
+	// The root has no ancestors.
+	if _, ancestors, err := projectAncestors(root); err != nil || len(ancestors) != 0 {
+		t.Errorf("Expected no ancestors for the root but received %v, %v", ancestors, err)
+	}
+}
+
+func TestAncestorDefinitions(t *testing.T) {
+	// Rendering a subdirectory applies the config and then each ancestor's
+	// definitions from the root down, so nearer definitions take precedence.
+	root := projectTree(t, map[string]string{
+		configFilename:                  `{"define": ["A", "B"]}`,
+		tfdefsFilename:                  "!undef A\n!define C\n",
+		"modules/" + tfdefsFilename:     "!define A\n!undef C\n",
+		"modules/vpc/" + tfdefsFilename: "!define D\n",
+		"modules/vpc/main.tft":          "!if A\na\n!endif\n!if B\nb\n!endif\n!if C\nc\n!endif\n!if D\nd\n!endif\n",
+	})
+	defer os.RemoveAll(root)
+
+	renderExpect := func(expected string) {
+		t.Helper()
+
+		p := Preprocessor{}
+		files, err := p.RenderDirectory(filepath.Join(root, "modules", "vpc"), nil, nil)
+		if err != nil {
+			t.Fatal("Unexpected error: " + err.Error())
+		}
+		if text := files["main.tf"]; text != expected {
+			t.Errorf("Expected %q but received %q", expected, text)
+		}
+	}
+	renderExpect("a\nb\nd\n")
+
+	// Without a marker, only the directory's own definitions apply.
+	os.Remove(filepath.Join(root, configFilename))
+	renderExpect("d\n")
+}
@@ -5,18 +5,27 @@ import "fmt"
 type parserScope struct {
 	active   bool
 	branched bool
+	block    *CoverageBlock // The block being covered, if any.
+	arm      int            // The index of the current arm in the block.
+	arms     []ExplainArm   // The arms so far, when explaining.
+	subject  *switchSubject // The value compared by !case, in a !switch block.
+	loop     *loopState     // The loop repeating a !for block.
 }
 
 type parserContext struct {
 	nameStack  []nameTable
 	scopeStack []parserScope
 	//	active     bool
-	verbose bool
+	resolver SymbolResolver // Consulted for symbols not in the name stack.
+	strict   bool           // Valued symbols must be Boolean to be used as conditions.
+	coverage *Coverage
+	explain  bool
+	verbose  bool
 }
 
 func (c *parserContext) enterNamespace() {
 	c.nameStack = append(c.nameStack, *newNameTable())
-	c.scopeStack = []parserScope{parserScope{true, false}}
+	c.scopeStack = []parserScope{parserScope{true, false, nil, 0, nil, nil, nil}}
 	//c.active = true
 }
 
@@ -25,23 +34,66 @@ func (c *parserContext) leaveNamespace() {
 	_, c.nameStack = c.nameStack[len(c.nameStack)-1], c.nameStack[:len(c.nameStack)-1]
 }
 
-func (c *parserContext) define(name string) {
-	c.nameStack[len(c.nameStack)-1].define(name)
+func (c *parserContext) define(name string, origin string) {
+	c.nameStack[len(c.nameStack)-1].define(name, origin)
 }
 
-func (c *parserContext) undef(name string) {
-	c.nameStack[len(c.nameStack)-1].undef(name)
+func (c *parserContext) defineValue(name string, value Value, origin string) {
+	c.nameStack[len(c.nameStack)-1].defineValue(name, value, origin)
+}
+
+func (c *parserContext) undef(name string, origin string) {
+	c.nameStack[len(c.nameStack)-1].undef(name, origin)
 	//	delete(t.names, name)
 }
 
 func (c *parserContext) isDefined(name string) bool {
+	_, defined := c.lookup(name)
+	return defined
+}
+
+// lookup returns the value of a symbol and whether it is defined. Symbols
+// that aren't in the name stack are looked up with the resolver.
+func (c *parserContext) lookup(name string) (Value, bool) {
+	if value, defined, exists := c.lookupName(name); exists {
+		return value, defined
+	}
+
+	if c.resolver != nil {
+		return c.resolver.Lookup(name)
+	}
+
+	return Value{}, false
+}
+
+// lookupName returns the value of a symbol in the name stack, whether it is
+// defined, and whether it's in the stack at all.
+func (c *parserContext) lookupName(name string) (Value, bool, bool) {
 	for i := len(c.nameStack) - 1; i >= 0; i-- {
 		if c.nameStack[i].exists(name) {
-			return c.nameStack[i].defined(name)
+			return c.nameStack[i].value(name), c.nameStack[i].defined(name), true
 		}
 	}
 
-	return false
+	return Value{}, false, false
+}
+
+// origin returns where a symbol was last defined or undefined, or an empty
+// string if it never was.
+func (c *parserContext) origin(name string) string {
+	for i := len(c.nameStack) - 1; i >= 0; i-- {
+		if c.nameStack[i].exists(name) {
+			return c.nameStack[i].origin(name)
+		}
+	}
+
+	if c.resolver != nil {
+		if _, defined := c.resolver.Lookup(name); defined {
+			return originResolver
+		}
+	}
+
+	return ""
 }
 
 func (c *parserContext) scope() *parserScope {
@@ -55,7 +107,7 @@ func (c *parserContext) parent() *parserScope {
 func (c *parserContext) enterBranch() {
 	active := c.scope().active
 	//c.active = active
-	c.scopeStack = append(c.scopeStack, parserScope{active, false})
+	c.scopeStack = append(c.scopeStack, parserScope{active, false, nil, 0, nil, nil, nil})
 }
 
 func (c *parserContext) leaveBranch() {
@@ -76,6 +128,53 @@ func (c *parserContext) takeBranch(taken bool) {
 	s.branched = taken
 }
 
+// coverBlock records that a conditional block was reached. It is called
+// after each !if and !switch directive has entered the block's scope. The
+// arms follow.
+func (c *parserContext) coverBlock(filename string, line int) {
+	if c.coverage == nil || len(c.scopeStack) < 2 {
+		return
+	}
+
+	s := c.scope()
+	s.block = c.coverage.block(filename, line)
+	s.arm = -1
+
+	if s.block != nil && c.parent().active {
+		s.block.Reached++
+	}
+}
+
+// coverBranch records whether the current arm of a conditional block was
+// taken. It is called after each !if, !elif, !else, !case and !default
+// directive has updated the scope. An arm is only counted when its block is
+// reached.
+func (c *parserContext) coverBranch(directive string, filename string, line int) {
+	if c.coverage == nil || len(c.scopeStack) < 2 {
+		return
+	}
+
+	if isIfDirective(directive) {
+		c.coverBlock(filename, line)
+	}
+
+	s := c.scope()
+	s.arm++
+
+	block := s.block
+	if block == nil {
+		return
+	}
+
+	for len(block.Arms) <= s.arm {
+		block.Arms = append(block.Arms, CoverageArm{Directive: directive, Line: line})
+	}
+
+	if c.parent().active && s.active {
+		block.Arms[s.arm].Taken++
+	}
+}
+
 func (c *parserContext) previousBranchTaken() bool {
 	return c.scope().branched
 }
@@ -87,7 +186,7 @@ func (c *parserContext) nextBranch() {
 	}
 }
 
-func (c *parserContext) evaluateExpression(e *Expression) bool {
+func (c *parserContext) evaluateExpression(e *Expression) (bool, error) {
 	if c.verbose {
 		fmt.Printf("evaluateExpression %d\n", e.kind)
 	}
@@ -100,72 +199,139 @@ func (c *parserContext) evaluateExpression(e *Expression) bool {
 		return c.evaluateGroupExpression(e)
 	case ExpressionIdentifier:
 		return c.evaluateIdentifierExpression(e)
+	case ExpressionCall:
+		return c.evaluateCallExpression(e)
+	case ExpressionIndex:
+		return c.evaluateIndexExpression(e)
 	}
-	fmt.Printf("ERROR: Unrecognized expression\n")
-	return false
+	return false, ProcessingError{"Unrecognized expression", 0, 0, ProcessingInvalidState}
 }
 
-func (c *parserContext) evaluateUnaryExpression(e *Expression) bool {
+func (c *parserContext) evaluateUnaryExpression(e *Expression) (bool, error) {
 	if c.verbose {
 		fmt.Printf("evaluateUnaryExpression\n")
 	}
-	expression := c.evaluateExpression(e.left)
+	expression, err := c.evaluateExpression(e.left)
+	if err != nil {
+		return false, err
+	}
 	switch e.operator {
 	case TokenNot:
-		return !expression
+		return !expression, nil
 	}
 
-	fmt.Print(tokenToString(e.operator))
-	fmt.Print(e)
-	// TODO: Error handling
-	fmt.Printf("ERROR: Unrecognized unary expression\n")
-	return false
+	return false, ProcessingError{"Unrecognized unary expression", 0, 0, ProcessingInvalidState}
 }
 
-func (c *parserContext) evaluateBinaryExpression(e *Expression) bool {
+func (c *parserContext) evaluateBinaryExpression(e *Expression) (bool, error) {
 	if c.verbose {
 		fmt.Printf("evaluateBinaryExpression\n")
 	}
 
-	left := c.evaluateExpression(e.left)
+	left, err := c.evaluateExpression(e.left)
+	if err != nil {
+		return false, err
+	}
 	switch e.operator {
 	case TokenAnd:
 		// left && right
 		if !left {
 			// Early out
-			return false
+			return false, nil
 		}
-		right := c.evaluateExpression(e.right)
-		return right
+		return c.evaluateExpression(e.right)
 	case TokenOr:
 		// left || right
 		if left {
 			// Early out
-			return true
+			return true, nil
 		}
-		right := c.evaluateExpression(e.right)
-		return right
+		return c.evaluateExpression(e.right)
 	}
 
-	// TODO: Error handling
-	if c.verbose {
-		fmt.Printf("ERROR: Unrecognized binary expression\n")
-	}
-	return false
+	return false, ProcessingError{"Unrecognized binary expression", 0, 0, ProcessingInvalidState}
 }
 
-func (c *parserContext) evaluateGroupExpression(e *Expression) bool {
+func (c *parserContext) evaluateGroupExpression(e *Expression) (bool, error) {
 	if c.verbose {
 		fmt.Printf("evaluateGroupExpression\n")
 	}
 	return c.evaluateExpression(e.left)
 }
 
-func (c *parserContext) evaluateIdentifierExpression(e *Expression) bool {
+// evaluateIdentifierExpression evaluates a symbol used as a condition. An
+// undefined symbol is false, and a defined symbol is true unless its value
+// is false by Value.Truth. In strict mode, a symbol whose value isn't
+// Boolean is a syntax error, since it's likely meant to be compared rather
+// than tested.
+func (c *parserContext) evaluateIdentifierExpression(e *Expression) (bool, error) {
+	// The predefined symbols can't be defined or undefined.
+	switch e.identifier {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+
+	value, defined := c.lookup(e.identifier)
+	if c.verbose {
+		fmt.Printf("evaluateIdentifierExpression: %s = %t\n", e.identifier, defined && value.Truth())
+	}
+	if !defined {
+		return false, nil
+	}
+
+	if c.strict && !value.isBoolean() {
+		message := fmt.Sprintf("%s has the value %s, which isn't Boolean; use defined(%s) to test whether it's defined", e.identifier, quoteString(value.String()), e.identifier)
+		return false, SyntaxError{message, 0, e.column, SyntaxErrorValuedSymbol}
+	}
+
+	return value.Truth(), nil
+}
+
+func (c *parserContext) evaluateCallExpression(e *Expression) (bool, error) {
 	if c.verbose {
-		fmt.Print("evaluateIdentifierExpression: ")
-		result := c.isDefined(e.identifier)
-		fmt.Printf("%s = %t\n", e.identifier, result)
+		fmt.Printf("evaluateCallExpression %s\n", e.identifier)
+	}
+
+	call := newExpr(e).(*Call)
+	value, err := call.value(FuncResolver(c.lookup))
+	if err != nil {
+		column := e.column
+		if ce, ok := err.(callError); ok {
+			column = ce.column
+		}
+		return false, ProcessingError{err.Error(), 0, column, ProcessingErrorFunction}
 	}
-	return c.isDefined(e.identifier)
+
+	return value.Bool(), nil
+}
+
+// evaluateIndexExpression evaluates an element of a list or map used as a
+// condition. An element that doesn't exist is false, and one that does is
+// true unless its value is false by Value.Truth. In strict mode, as for a
+// symbol, the value must be Boolean.
+func (c *parserContext) evaluateIndexExpression(e *Expression) (bool, error) {
+	if c.verbose {
+		fmt.Printf("evaluateIndexExpression %s\n", formatCondition(e))
+	}
+
+	value, found, err := newExpr(e).(*Index).value(FuncResolver(c.lookup))
+	if err != nil {
+		column := e.column
+		if ce, ok := err.(callError); ok {
+			column = ce.column
+		}
+		return false, ProcessingError{err.Error(), 0, column, ProcessingErrorIndex}
+	}
+	if !found {
+		return false, nil
+	}
+
+	if c.strict && !value.isBoolean() {
+		message := fmt.Sprintf("%s has the value %s, which isn't Boolean", formatCondition(e), quoteString(value.String()))
+		return false, SyntaxError{message, 0, e.column, SyntaxErrorValuedSymbol}
+	}
+
+	return value.Truth(), nil
 }
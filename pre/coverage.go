@@ -0,0 +1,155 @@
+package pre
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Coverage records, for each conditional block, how often each of its arms
+// was taken. It accumulates over any number of runs.
+type Coverage struct {
+	blocks map[coverageKey]*CoverageBlock
+}
+
+type coverageKey struct {
+	filename string
+	line     int
+}
+
+// CoverageBlock is a conditional block, from !if to !endif.
+type CoverageBlock struct {
+	Filename string `json:"filename"`
+	// Line is the line of the !if directive.
+	Line int `json:"line"`
+	// Reached counts the times the block was reached in an active branch.
+	Reached int           `json:"reached"`
+	Arms    []CoverageArm `json:"arms"`
+}
+
+// CoverageArm is one arm of a conditional block.
+type CoverageArm struct {
+	Directive string `json:"directive"`
+	Line      int    `json:"line"`
+	// Taken counts the times the arm's text was active.
+	Taken int `json:"taken"`
+}
+
+// NewCoverage returns an empty coverage record.
+func NewCoverage() *Coverage {
+	return &Coverage{make(map[coverageKey]*CoverageBlock)}
+}
+
+func (c *Coverage) block(filename string, line int) *CoverageBlock {
+	key := coverageKey{filename, line}
+	block, ok := c.blocks[key]
+	if !ok {
+		block = &CoverageBlock{Filename: filename, Line: line}
+		c.blocks[key] = block
+	}
+	return block
+}
+
+// Blocks returns the recorded blocks ordered by file and line.
+func (c *Coverage) Blocks() []*CoverageBlock {
+	var blocks []*CoverageBlock
+	for _, block := range c.blocks {
+		blocks = append(blocks, block)
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].Filename != blocks[j].Filename {
+			return blocks[i].Filename < blocks[j].Filename
+		}
+		return blocks[i].Line < blocks[j].Line
+	})
+
+	return blocks
+}
+
+// WriteText writes the arms that were never taken or always taken, followed
+// by a summary.
+func (c *Coverage) WriteText(w io.Writer) error {
+	arms, taken := 0, 0
+	for _, block := range c.Blocks() {
+		for _, arm := range block.Arms {
+			arms++
+			if arm.Taken > 0 {
+				taken++
+			}
+
+			var status string
+			switch {
+			case block.Reached == 0:
+				status = "never reached"
+			case arm.Taken == 0:
+				status = "never taken"
+			case arm.Taken == block.Reached:
+				status = "always taken"
+			default:
+				continue
+			}
+
+			_, err := fmt.Fprintf(w, "%s:%d: !%s %s\n", block.Filename, arm.Line, arm.Directive, status)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	percent := 100.0
+	if arms > 0 {
+		percent = float64(taken) * 100 / float64(arms)
+	}
+
+	_, err := fmt.Fprintf(w, "%d of %d arms taken (%.1f%%)\n", taken, arms, percent)
+	return err
+}
+
+// WriteJSON writes the blocks as a JSON array.
+func (c *Coverage) WriteJSON(w io.Writer) error {
+	blocks := c.Blocks()
+	if blocks == nil {
+		blocks = []*CoverageBlock{}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(blocks)
+}
+
+// WriteLCOV writes the blocks as LCOV branch records, one record per file.
+// Each block is identified by the line of its !if directive.
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	blocks := c.Blocks()
+	for i := 0; i < len(blocks); {
+		filename := blocks[i].Filename
+		found, hit := 0, 0
+
+		fmt.Fprintf(w, "SF:%s\n", filename)
+		for ; i < len(blocks) && blocks[i].Filename == filename; i++ {
+			block := blocks[i]
+			for arm, a := range block.Arms {
+				taken := "-"
+				if block.Reached > 0 {
+					taken = fmt.Sprint(a.Taken)
+				}
+
+				found++
+				if a.Taken > 0 {
+					hit++
+				}
+
+				fmt.Fprintf(w, "BRDA:%d,%d,%d,%s\n", block.Line, block.Line, arm, taken)
+			}
+		}
+
+		_, err := fmt.Fprintf(w, "BRF:%d\nBRH:%d\nend_of_record\n", found, hit)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
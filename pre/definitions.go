@@ -0,0 +1,364 @@
+package pre
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const tfvarsExtension = ".tfvars"
+
+// definition is a symbol definition loaded from a definitions file.
+type definition struct {
+	name    string
+	defined bool
+	value   Value
+}
+
+// definitionsFile is a definitions file given on the command line. Files in
+// the tfdefs format are parsed as directives each time they are applied,
+// while other formats are loaded once.
+type definitionsFile struct {
+	filename    string
+	directives  bool
+	definitions []definition
+}
+
+// readDefinitionsFile loads a definitions file. The format is determined by
+// the file extension: JSON (.json), YAML (.yaml, .yml), Terraform variables
+// (.tfvars) or, otherwise, directives as in 'terraform.tfdefs'.
+func readDefinitionsFile(filename string) (definitionsFile, error) {
+	file := definitionsFile{filename: filename}
+
+	extension := strings.ToLower(path.Ext(filename))
+	if extension != ".json" && extension != ".yaml" && extension != ".yml" && extension != tfvarsExtension {
+		file.directives = true
+		return file, nil
+	}
+
+	buffer, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return file, err
+	}
+
+	switch extension {
+	case ".json":
+		file.definitions, err = parseJSONDefinitions(buffer)
+	case ".yaml", ".yml":
+		file.definitions, err = parseYAMLDefinitions(buffer)
+	case tfvarsExtension:
+		file.definitions = parseTfvarsDefinitions(buffer)
+	}
+
+	if err != nil {
+		return file, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+
+	return file, nil
+}
+
+// parseJSONDefinitions reads a JSON object. A true value defines the
+// symbol, a false or null value undefines it, and a string or number value
+// defines the symbol with that value. An array or object defines the symbol
+// with a list or map value.
+func parseJSONDefinitions(buffer []byte) ([]definition, error) {
+	decoder := json.NewDecoder(bytes.NewReader(buffer))
+	decoder.UseNumber()
+
+	var values map[string]interface{}
+	err := decoder.Decode(&values)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var definitions []definition
+	for _, name := range names {
+		var d definition
+		switch value := values[name].(type) {
+		case nil:
+			d = definition{name, false, Value{}}
+		case bool:
+			d = definition{name, value, Value{}}
+		case string:
+			d = definition{name, true, StringValue(value)}
+		case json.Number:
+			d = definition{name, true, StringValue(value.String())}
+		case []interface{}, map[string]interface{}:
+			v, err := jsonValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err.Error())
+			}
+			d = definition{name, true, v}
+		default:
+			return nil, fmt.Errorf("%s must be a boolean, string, number, array or object", name)
+		}
+		definitions = append(definitions, d)
+	}
+
+	return definitions, nil
+}
+
+// jsonValue converts an element of a JSON array or object. Within them,
+// true and false are Boolean values.
+func jsonValue(value interface{}) (Value, error) {
+	switch v := value.(type) {
+	case bool:
+		return BoolValue(v), nil
+	case string:
+		return StringValue(v), nil
+	case json.Number:
+		return StringValue(v.String()), nil
+	case []interface{}:
+		elements := make([]Value, len(v))
+		for i, element := range v {
+			e, err := jsonValue(element)
+			if err != nil {
+				return Value{}, err
+			}
+			elements[i] = e
+		}
+		return ListValue(elements...), nil
+	case map[string]interface{}:
+		entries := make(map[string]Value)
+		for key, element := range v {
+			e, err := jsonValue(element)
+			if err != nil {
+				return Value{}, err
+			}
+			entries[key] = e
+		}
+		return MapValue(entries), nil
+	}
+	return Value{}, fmt.Errorf("null isn't allowed in an array or object")
+}
+
+// parseYAMLDefinitions reads a flat YAML mapping of symbols to scalar
+// values. Values are interpreted as in a JSON definitions file. Nested
+// mappings and sequences aren't supported.
+func parseYAMLDefinitions(buffer []byte) ([]definition, error) {
+	var definitions []definition
+
+	scanner := bufio.NewScanner(bytes.NewReader(buffer))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+
+		if text[0] == ' ' || text[0] == '\t' || strings.HasPrefix(trimmed, "- ") {
+			return nil, fmt.Errorf("(%d): nested values aren't supported", line)
+		}
+
+		i := strings.Index(text, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("(%d): expected name: value", line)
+		}
+
+		name, err := parseYAMLScalar(text[:i])
+		if err != nil {
+			return nil, fmt.Errorf("(%d): %s", line, err.Error())
+		}
+
+		raw := strings.TrimSpace(stripYAMLComment(text[i+1:]))
+		switch {
+		case raw == "" || raw == "~" || raw == "null" || raw == "Null" || raw == "NULL":
+			definitions = append(definitions, definition{name, false, Value{}})
+		case raw == "true" || raw == "True" || raw == "TRUE":
+			definitions = append(definitions, definition{name, true, Value{}})
+		case raw == "false" || raw == "False" || raw == "FALSE":
+			definitions = append(definitions, definition{name, false, Value{}})
+		case strings.HasPrefix(raw, "[") || strings.HasPrefix(raw, "{"):
+			return nil, fmt.Errorf("(%d): nested values aren't supported", line)
+		default:
+			value, err := parseYAMLScalar(raw)
+			if err != nil {
+				return nil, fmt.Errorf("(%d): %s", line, err.Error())
+			}
+			definitions = append(definitions, definition{name, true, StringValue(value)})
+		}
+	}
+
+	return definitions, scanner.Err()
+}
+
+// stripYAMLComment removes a trailing comment that isn't within quotes.
+func stripYAMLComment(text string) string {
+	var quote rune
+	for i, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// parseYAMLScalar unquotes a plain, single quoted or double quoted scalar.
+func parseYAMLScalar(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	switch {
+	case strings.HasPrefix(text, "\""):
+		return strconv.Unquote(text)
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return "", fmt.Errorf("unterminated string %s", text)
+		}
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	}
+	return text, nil
+}
+
+// parseTfvarsDefinitions reads the top-level scalar assignments in a
+// Terraform variables file. Strings and numbers define a symbol with that
+// value, while true and false define or undefine it. Lists, maps, heredocs
+// and expressions are skipped.
+func parseTfvarsDefinitions(buffer []byte) []definition {
+	var definitions []definition
+	var statement bytes.Buffer
+
+	finish := func() {
+		if d, ok := parseTfvarsAssignment(statement.String()); ok {
+			definitions = append(definitions, d)
+		}
+		statement.Reset()
+	}
+
+	runes := bytes.Runes(buffer)
+	depth := 0
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		next := rune(0)
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+
+		switch {
+		case r == '"':
+			// Copy the string literal, including any escapes.
+			j := i + 1
+			for ; j < len(runes) && runes[j] != '"' && runes[j] != '\n'; j++ {
+				if runes[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(runes) {
+				j = len(runes) - 1
+			}
+			statement.WriteString(string(runes[i : j+1]))
+			i = j
+		case r == '#' || (r == '/' && next == '/'):
+			for i+1 < len(runes) && runes[i+1] != '\n' {
+				i++
+			}
+		case r == '/' && next == '*':
+			i += 2
+			for i+1 < len(runes) && !(runes[i] == '*' && runes[i+1] == '/') {
+				i++
+			}
+			i++ // Skip the closing */
+		case r == '<' && next == '<':
+			// Skip a heredoc, which is never a scalar we can use.
+			i = skipHeredoc(runes, i+2)
+			statement.WriteString("<<")
+		case r == '{' || r == '[' || r == '(':
+			depth++
+			statement.WriteRune(r)
+		case r == '}' || r == ']' || r == ')':
+			depth--
+			statement.WriteRune(r)
+		case r == '\n' && depth <= 0:
+			finish()
+		default:
+			statement.WriteRune(r)
+		}
+	}
+	finish()
+
+	return definitions
+}
+
+// skipHeredoc returns the index of the last rune of the heredoc that begins
+// at start, just after the '<<'.
+func skipHeredoc(runes []rune, start int) int {
+	i := start
+	for i < len(runes) && runes[i] != '\n' {
+		i++
+	}
+
+	marker := strings.TrimSpace(strings.TrimPrefix(string(runes[start:i]), "-"))
+	for i < len(runes) {
+		end := i + 1
+		for end < len(runes) && runes[end] != '\n' {
+			end++
+		}
+
+		if strings.TrimSpace(string(runes[i+1:end])) == marker {
+			return end - 1
+		}
+		i = end
+	}
+
+	return len(runes) - 1
+}
+
+func parseTfvarsAssignment(statement string) (definition, bool) {
+	i := strings.Index(statement, "=")
+	if i < 0 {
+		return definition{}, false
+	}
+
+	name := strings.TrimSpace(statement[:i])
+	value := strings.TrimSpace(statement[i+1:])
+	if name == "" || !isIdentifier(name) {
+		return definition{}, false
+	}
+
+	switch {
+	case value == "true":
+		return definition{name, true, Value{}}, true
+	case value == "false":
+		return definition{name, false, Value{}}, true
+	case strings.HasPrefix(value, "\""):
+		text, err := strconv.Unquote(value)
+		if err != nil || strings.Contains(text, "${") {
+			return definition{}, false
+		}
+		return definition{name, true, StringValue(text)}, true
+	}
+
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return definition{name, true, StringValue(value)}, true
+	}
+
+	return definition{}, false
+}
+
+// isIdentifier reports whether text is a Terraform identifier.
+func isIdentifier(text string) bool {
+	for i, r := range text {
+		if !(r == '_' || unicode.IsLetter(r) || (i > 0 && (r == '-' || unicode.IsDigit(r)))) {
+			return false
+		}
+	}
+	return text != ""
+}
@@ -0,0 +1,108 @@
+package pre
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJSONDefinitions(t *testing.T) {
+	definitions, err := parseJSONDefinitions([]byte(`{"SSL": true, "RDS": false, "ENV": "prod", "COUNT": 3, "OLD": null}`))
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+
+	definitionsExpect(t, definitions, []definition{
+		{"COUNT", true, StringValue("3")},
+		{"ENV", true, StringValue("prod")},
+		{"OLD", false, Value{}},
+		{"RDS", false, Value{}},
+		{"SSL", true, Value{}},
+	})
+
+	definitions, err = parseJSONDefinitions([]byte(`{"AZS": ["a", 2], "SIZES": {"prod": "large", "ssl": true}}`))
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+
+	definitionsExpect(t, definitions, []definition{
+		{"AZS", true, ListValue(StringValue("a"), StringValue("2"))},
+		{"SIZES", true, MapValue(map[string]Value{"prod": StringValue("large"), "ssl": BoolValue(true)})},
+	})
+
+	if _, err := parseJSONDefinitions([]byte(`{"AZS": ["a", null]}`)); err == nil {
+		t.Error("Expected an error for null in an array")
+	}
+}
+
+func TestYAMLDefinitions(t *testing.T) {
+	definitions, err := parseYAMLDefinitions([]byte(`---
+# Features
+SSL: true
+RDS: false # Not yet
+ENV: prod
+REGION: "us-west-2" # Oregon
+NAME: 'it''s'
+OLD:
+`))
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+
+	definitionsExpect(t, definitions, []definition{
+		{"SSL", true, Value{}},
+		{"RDS", false, Value{}},
+		{"ENV", true, StringValue("prod")},
+		{"REGION", true, StringValue("us-west-2")},
+		{"NAME", true, StringValue("it's")},
+		{"OLD", false, Value{}},
+	})
+
+	_, err = parseYAMLDefinitions([]byte("ZONES:\n  - a\n"))
+	if err == nil {
+		t.Error("Expected an error for a nested value")
+	}
+}
+
+func TestTfvarsDefinitions(t *testing.T) {
+	definitions := parseTfvarsDefinitions([]byte(`
+# Scalars
+environment = "prod" // Trailing comment
+instance_count = 3
+enable_ssl = true
+legacy = false
+/* Skipped */
+zones = [
+  "us-west-2a",
+  "us-west-2b",
+]
+tags = {
+  name = "skipped"
+}
+user_data = <<EOF
+debug = true
+EOF
+name = "${var.prefix}-api"
+region = "us-west-2"
+`))
+
+	definitionsExpect(t, definitions, []definition{
+		{"environment", true, StringValue("prod")},
+		{"instance_count", true, StringValue("3")},
+		{"enable_ssl", true, Value{}},
+		{"legacy", false, Value{}},
+		{"region", true, StringValue("us-west-2")},
+	})
+}
+
+func definitionsExpect(t *testing.T, definitions []definition, expected []definition) {
+	if len(definitions) != len(expected) {
+		t.Errorf("Expected %d definitions but received %d: %v", len(expected), len(definitions), definitions)
+		return
+	}
+
+	for i := range expected {
+		if !reflect.DeepEqual(definitions[i], expected[i]) {
+			t.Errorf("Expected definition %v but received %v", expected[i], definitions[i])
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package pre
+
+import "fmt"
+
+// Severity ranks diagnostics.
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+	SeverityInfo
+)
+
+func (s Severity) String() string {
+	result := ""
+	switch s {
+	case SeverityError:
+		result = "error"
+	case SeverityWarning:
+		result = "warning"
+	case SeverityInfo:
+		result = "info"
+	}
+	return result
+}
+
+// Diagnostic is a problem found in a template or definitions file.
+type Diagnostic struct {
+	Filename string
+	Line     int
+	Rule     string
+	Severity Severity
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d: %s %s: %s", d.Filename, d.Line, d.Severity, d.Rule, d.Message)
+}
+
+// errorLine returns the line of a syntax or processing error, or zero.
+func errorLine(err error) int {
+	switch e := err.(type) {
+	case SyntaxError:
+		return e.Line()
+	case ProcessingError:
+		return e.Line()
+	}
+	return 0
+}
+
+// errorMessage returns the message of a syntax or processing error without
+// its line.
+func errorMessage(err error) string {
+	switch e := err.(type) {
+	case SyntaxError:
+		return e.String()
+	case ProcessingError:
+		return e.String()
+	}
+	return err.Error()
+}
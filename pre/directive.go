@@ -0,0 +1,78 @@
+package pre
+
+import "fmt"
+
+// DirectiveToken is a token of a custom directive's parameters, such as an
+// identifier or a string.
+type DirectiveToken struct {
+	Token Token
+	Text  string
+}
+
+// Emitter writes a line of text to the output in place of a directive.
+type Emitter func(line string)
+
+// DirectiveHandler handles a custom directive. It receives the directive's
+// parameters, whether the directive is within an active block, and an
+// emitter for lines of output. Lines emitted while inactive are discarded.
+// An error stops processing, and is reported on the directive's line.
+type DirectiveHandler func(params []DirectiveToken, active bool, emit Emitter) error
+
+// isBuiltinDirective returns true for the directives the parser handles
+// itself.
+func isBuiltinDirective(name string) bool {
+	switch name {
+	case DirectiveDefine, DirectiveUndef, DirectiveIf, DirectiveIfdef, DirectiveIfndef, DirectiveElif, DirectiveElse, DirectiveEndif, DirectiveError, DirectiveSwitch, DirectiveCase, DirectiveDefault, DirectiveEndswitch, DirectiveFor, DirectiveEndfor, DirectiveRaw, DirectiveEndraw, DirectiveHeredoc:
+		return true
+	}
+	return false
+}
+
+// RegisterDirective adds a custom directive, which is handled by calling
+// handler. Parameters are scanned like those of the built-in directives, so
+// free-form text should be quoted. Registering a name again replaces its
+// handler. The built-in directives can't be replaced.
+func (p *Parser) RegisterDirective(name string, handler DirectiveHandler) error {
+	if !isDirectiveName(name) {
+		return fmt.Errorf("Invalid directive name '%s'", name)
+	}
+	if isBuiltinDirective(name) {
+		return fmt.Errorf("The !%s directive can't be replaced", name)
+	}
+
+	if p.directives == nil {
+		p.directives = make(map[string]DirectiveHandler)
+	}
+	p.directives[name] = handler
+	return nil
+}
+
+func (p *Parser) parseCustomDirective(name string, handler DirectiveHandler) error {
+	if p.verbose {
+		fmt.Printf("parseCustomDirective %s\n", name)
+	}
+
+	var params []DirectiveToken
+	for {
+		token, text, err := p.scanner.Scan()
+		if err != nil {
+			return err
+		}
+		if token == TokenLine || token == TokenEnd {
+			break
+		}
+		params = append(params, DirectiveToken{token, text})
+	}
+
+	active := p.IsActive()
+	err := handler(params, active, func(line string) {
+		if active {
+			p.pending = append(p.pending, line)
+		}
+	})
+	if err != nil {
+		return ProcessingError{err.Error(), p.scanner.Line(), 0, ProcessingErrorDirective}
+	}
+
+	return nil
+}
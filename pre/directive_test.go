@@ -0,0 +1,75 @@
+package pre
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRegisterDirective(t *testing.T) {
+	p := Parser{}
+
+	var owners []string
+	err := p.RegisterDirective("owner", func(params []DirectiveToken, active bool, emit Emitter) error {
+		if len(params) != 1 || params[0].Token != TokenString {
+			return errors.New("!owner expects a string")
+		}
+		owners = append(owners, params[0].Text)
+		emit("# Owner: " + params[0].Text)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+
+	p.SetText("a\n!owner \"infra\"\n!if NOPE\n!owner \"other\"\n!endif\nb\n")
+
+	var lines []string
+	var numbers []int
+	err = p.ParseLines(func(line string, number int) {
+		lines = append(lines, line)
+		numbers = append(numbers, number)
+	})
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+
+	// The handler runs in inactive blocks, but its output is discarded.
+	expected := []string{"a", "# Owner: infra", "b"}
+	if len(lines) != len(expected) || lines[1] != expected[1] || lines[2] != expected[2] {
+		t.Errorf("Expected %q but received %q", expected, lines)
+	}
+	if len(numbers) == 3 && numbers[1] != 2 {
+		t.Errorf("Expected the emitted line to map to line 2 but received %d", numbers[1])
+	}
+	if len(owners) != 2 {
+		t.Errorf("Expected the handler to be called twice but received %v", owners)
+	}
+
+	// Handler errors are reported on the directive's line.
+	p.SetText("a\n!owner infra\n")
+	err = p.ParseLines(func(line string, number int) {})
+	if pe, ok := err.(ProcessingError); !ok || pe.Line() != 2 {
+		t.Errorf("Expected an error on line 2 but received %v", err)
+	}
+}
+
+func TestRegisterDirectiveNames(t *testing.T) {
+	p := Parser{}
+	handler := func(params []DirectiveToken, active bool, emit Emitter) error { return nil }
+
+	for _, name := range []string{"", "if", "bad-name", "x1"} {
+		if err := p.RegisterDirective(name, handler); err == nil {
+			t.Errorf("Expected an error registering '%s'", name)
+		}
+	}
+
+	// The outline accepts registered directives.
+	if err := p.RegisterDirective("require_provider", handler); err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+	p.SetText("!require_provider aws \">= 5.0\"\n")
+	items, err := p.outline()
+	if err != nil || len(items) != 1 || items[0].text != `aws ">= 5.0"` {
+		t.Errorf("Expected the directive in the outline but received %v %v", items, err)
+	}
+}
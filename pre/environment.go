@@ -0,0 +1,47 @@
+package pre
+
+import (
+	"sort"
+	"strings"
+)
+
+// DefaultEnvironmentPrefix is the prefix of environment variables that
+// define symbols. For example, TERRACOTTA_DEFINE_SSL=1 defines SSL.
+const DefaultEnvironmentPrefix = "TERRACOTTA_DEFINE_"
+
+// environmentDefines returns a NAME=value definition for each variable in
+// environ, a list of KEY=value strings, that begins with prefix. The symbol
+// name is the remainder of the variable name. An empty prefix returns no
+// definitions.
+func environmentDefines(prefix string, environ []string) []string {
+	if prefix == "" {
+		return nil
+	}
+
+	var defines []string
+	for _, variable := range environ {
+		if !strings.HasPrefix(variable, prefix) {
+			continue
+		}
+
+		define := variable[len(prefix):]
+		if define == "" || strings.HasPrefix(define, "=") {
+			continue
+		}
+
+		defines = append(defines, define)
+	}
+
+	sort.Strings(defines)
+	return defines
+}
+
+// splitDefine splits a NAME=value definition. It returns false if the
+// definition doesn't have a value.
+func splitDefine(define string) (string, string, bool) {
+	i := strings.Index(define, "=")
+	if i < 0 {
+		return define, "", false
+	}
+	return define[:i], define[i+1:], true
+}
@@ -8,6 +8,11 @@ const (
 	ProcessingErrorOk ProcessingErrorKind = iota
 	ProcessingInvalidState
 	ProcessingInvalidLookahead
+	ProcessingErrorDirective
+	ProcessingErrorFunction
+	ProcessingErrorIterationLimit
+	ProcessingErrorIndex
+	ProcessingErrorSubstitution
 )
 
 type ProcessingError struct {
@@ -18,6 +23,9 @@ type ProcessingError struct {
 }
 
 func (e ProcessingError) Error() string {
+	if e.column > 0 {
+		return fmt.Sprintf("(%d,%d): %s", e.line, e.column, e.message)
+	}
 	return fmt.Sprintf("(%d): %s", e.line, e.message)
 }
 
@@ -25,6 +33,17 @@ func (e ProcessingError) String() string {
 	return e.message
 }
 
+// Line returns the line on which the error occurred.
+func (e ProcessingError) Line() int {
+	return e.line
+}
+
+// Column returns the column at which the error occurred, or zero if it
+// applies to the whole line.
+func (e ProcessingError) Column() int {
+	return e.column
+}
+
 func (e *ProcessingError) Kind() ProcessingErrorKind {
 	return e.kind
 }
@@ -0,0 +1,258 @@
+package pre
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ExplainSymbol is the value of a symbol, or of a function call, in a
+// condition when the condition was evaluated. The origin is where the value
+// came from, such as a file and line or the command line.
+type ExplainSymbol struct {
+	Name    string
+	Defined bool
+	Value   string
+	Origin  string
+}
+
+// ExplainArm is an !if, !elif or !else arm of a conditional block.
+type ExplainArm struct {
+	Directive string
+	Line      int
+	Condition string
+	Evaluated bool // False if an earlier arm was taken.
+	Result    bool // The value of the condition, if evaluated.
+	Taken     bool
+	Symbols   []ExplainSymbol
+}
+
+// ExplainBlock is a conditional block enclosing a line. It lists the arms
+// up to, and including, the one containing the line. A block that isn't
+// reached is within an arm that wasn't taken.
+type ExplainBlock struct {
+	Reached bool
+	Arms    []ExplainArm
+}
+
+// Explanation describes why a line of a template was included in, or
+// excluded from, the generated file. Blocks are listed from the outermost.
+type Explanation struct {
+	Filename  string
+	Line      int
+	Text      string
+	Directive bool // Directive lines are never included.
+	Active    bool
+	Blocks    []ExplainBlock
+}
+
+// Explain processes the template at filename, within the source directory,
+// up to the given line and explains whether the line is included in the
+// generated file.
+func (p *Preprocessor) Explain(source string, filename string, line int, defines []string, undefs []string) (*Explanation, error) {
+	rel, err := relativePath(source, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(rel, templateExtension) {
+		return nil, fmt.Errorf("'%s' is not a template", filename)
+	}
+
+	p.defines = defines
+	p.undefs = undefs
+
+	levels, err := p.enterAncestors(source)
+	if err != nil {
+		return nil, err
+	}
+	defer p.leave(levels)
+
+	var explanation *Explanation
+	included, err := p.withTemplate(source, rel, func(input string) error {
+		explanation, err = p.explainFile(input, line)
+		if err != nil {
+			return fmt.Errorf("%s%w", input, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !included {
+		return nil, fmt.Errorf("'%s' is excluded", filename)
+	}
+
+	return explanation, nil
+}
+
+func (p *Preprocessor) explainFile(filename string, line int) (*Explanation, error) {
+	buffer, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	text := string(buffer)
+	lines := splitLines(strings.TrimSuffix(text, "\n"))
+	if line < 1 || line > len(lines) || text == "" {
+		return nil, fmt.Errorf("(%d): The file has %d lines", line, len(lines))
+	}
+
+	p.parser.SetFile(filename)
+	p.parser.context.explain = true
+	defer func() { p.parser.context.explain = false }()
+
+	p.parser.Enter()
+	defer p.parser.Leave()
+
+	for {
+		item, err := p.parser.ParseLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if item.kind == ParseItemEnd {
+			return nil, fmt.Errorf("(%d): The line wasn't reached", line)
+		}
+
+		// A directive followed by a multiline comment spans lines.
+		if item.line < line {
+			continue
+		}
+
+		return &Explanation{
+			Filename:  filename,
+			Line:      line,
+			Text:      lines[line-1],
+			Directive: item.kind == ParseItemDirective,
+			Active:    item.active,
+			Blocks:    p.parser.context.explainBlocks(),
+		}, nil
+	}
+}
+
+// explainBranch records an arm of the current conditional block when
+// explaining. It is called after each !if, !elif and !else directive has
+// updated the scope.
+func (c *parserContext) explainBranch(directive string, line int, e *Expression, evaluated bool, result bool) {
+	if !c.explain || len(c.scopeStack) < 2 {
+		return
+	}
+
+	arm := ExplainArm{Directive: directive, Line: line, Evaluated: evaluated, Result: result, Taken: evaluated && result}
+	if e != nil {
+		arm.Condition = formatCondition(e)
+		if evaluated {
+			arm.Symbols = c.explainSymbols(e)
+		}
+	}
+
+	s := c.scope()
+	s.arms = append(s.arms, arm)
+}
+
+// explainSymbols returns the current values of the symbols and function
+// calls in an expression.
+func (c *parserContext) explainSymbols(e *Expression) []ExplainSymbol {
+	var symbols []ExplainSymbol
+	seen := make(map[string]bool)
+
+	var visit func(e *Expression)
+	visit = func(e *Expression) {
+		if e == nil {
+			return
+		}
+
+		name := atomKey(e)
+		if name != "" && !seen[name] {
+			seen[name] = true
+
+			symbol := ExplainSymbol{Name: name}
+			switch e.kind {
+			case ExpressionIdentifier:
+				value, defined := c.lookup(e.identifier)
+				symbol.Defined = defined
+				symbol.Value = value.String()
+				symbol.Origin = c.origin(e.identifier)
+			case ExpressionCall:
+				symbol.Value, symbol.Defined = c.explainCall(e)
+				if e.identifier == FunctionEnv {
+					symbol.Origin = originEnvironment
+				}
+			case ExpressionIndex:
+				value, found, err := newExpr(e).(*Index).value(FuncResolver(c.lookup))
+				symbol.Defined = found
+				symbol.Value = value.String()
+				if err != nil {
+					symbol.Value = err.Error()
+				}
+			}
+			symbols = append(symbols, symbol)
+		}
+
+		visit(e.left)
+		visit(e.right)
+		for _, argument := range e.arguments {
+			if argument.kind != ExpressionString {
+				visit(argument)
+			}
+		}
+	}
+	visit(e)
+
+	return symbols
+}
+
+// explainBlocks returns the conditional blocks enclosing the current line.
+func (c *parserContext) explainBlocks() []ExplainBlock {
+	var blocks []ExplainBlock
+	for i := 1; i < len(c.scopeStack); i++ {
+		arms := make([]ExplainArm, len(c.scopeStack[i].arms))
+		copy(arms, c.scopeStack[i].arms)
+		blocks = append(blocks, ExplainBlock{c.scopeStack[i-1].active, arms})
+	}
+	return blocks
+}
+
+// String describes the symbol's value and origin.
+func (s ExplainSymbol) String() string {
+	var result string
+	switch {
+	case s.Defined && s.Value != "":
+		result = "defined = " + strconv.Quote(s.Value)
+	case s.Defined:
+		result = "defined"
+	case s.Origin == "":
+		result = "never defined"
+	default:
+		result = "undefined"
+	}
+
+	if s.Origin != "" {
+		result += " (" + s.Origin + ")"
+	}
+
+	return s.Name + ": " + result
+}
+
+// explainCall returns the value of a function call and whether it's true.
+// The value of env is the variable's value, and that of a function that
+// returns a string is the string.
+func (c *parserContext) explainCall(e *Expression) (string, bool) {
+	if e.identifier == FunctionEnv && len(e.arguments) == 1 && e.arguments[0].kind == ExpressionString {
+		value, _ := os.LookupEnv(e.arguments[0].identifier)
+		return value, value != ""
+	}
+
+	value, err := newExpr(e).(*Call).value(FuncResolver(c.lookup))
+	if err != nil {
+		return err.Error(), false
+	}
+	if value.Kind() == ValueBool {
+		return "", value.Bool()
+	}
+	return value.String(), value.String() != ""
+}
@@ -0,0 +1,73 @@
+package pre
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terracotta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		configFilename: `{}`,
+		tfdefsFilename: "!define SSL\n",
+		"main.tft":     "!if SSL\n!if RDS\na\n!elif ECS\nb\n!else\nc\n!endif\n!endif\n",
+	}
+	for name, text := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filename := filepath.Join(dir, "main.tft")
+
+	p := Preprocessor{}
+	explanation, err := p.Explain(dir, filename, 7, []string{"ECS"}, nil)
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+
+	if explanation.Text != "c" || explanation.Active || explanation.Directive {
+		t.Errorf("Expected an excluded text line but received %v", explanation)
+	}
+
+	if len(explanation.Blocks) != 2 {
+		t.Fatalf("Expected 2 blocks but received %d", len(explanation.Blocks))
+	}
+
+	outer := explanation.Blocks[0]
+	if !outer.Reached || len(outer.Arms) != 1 || !outer.Arms[0].Taken {
+		t.Errorf("Expected the outer !if to be taken: %v", outer)
+	}
+	if symbols := outer.Arms[0].Symbols; len(symbols) != 1 || symbols[0].Origin != filepath.Join(dir, tfdefsFilename)+":1" {
+		t.Errorf("Expected SSL to be defined in the tfdefs: %v", symbols)
+	}
+
+	inner := explanation.Blocks[1]
+	if len(inner.Arms) != 3 {
+		t.Fatalf("Expected 3 arms but received %d", len(inner.Arms))
+	}
+	if inner.Arms[0].Taken || inner.Arms[0].Symbols[0].Origin != "" {
+		t.Errorf("Expected !if RDS to be false: %v", inner.Arms[0])
+	}
+	if !inner.Arms[1].Taken || inner.Arms[1].Symbols[0].Origin != originCommandLine {
+		t.Errorf("Expected !elif ECS to be taken: %v", inner.Arms[1])
+	}
+	if inner.Arms[2].Evaluated || inner.Arms[2].Taken {
+		t.Errorf("Expected !else to be skipped: %v", inner.Arms[2])
+	}
+
+	explanation, err = p.Explain(dir, filename, 5, []string{"ECS"}, nil)
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+	if !explanation.Active {
+		t.Errorf("Expected line 5 to be included")
+	}
+}
@@ -0,0 +1,427 @@
+package pre
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// Expr is a node of a parsed condition, as used by !if and !elif. The node
+// types are Ident, StringLit, NumberLit, Index, Call, Not, Binary and Group.
+type Expr interface {
+	// String returns the expression in canonical syntax.
+	String() string
+
+	// Eval evaluates the expression against the symbols found by resolver.
+	Eval(resolver SymbolResolver) (bool, error)
+
+	expr()
+}
+
+// BinaryOp is the operator of a binary expression.
+type BinaryOp int
+
+const (
+	OpAnd BinaryOp = iota
+	OpOr
+)
+
+func (op BinaryOp) String() string {
+	result := ""
+	switch op {
+	case OpAnd:
+		result = "&&"
+	case OpOr:
+		result = "||"
+	}
+	return result
+}
+
+// Ident is a symbol, which is true if it's defined and its value is true by
+// Value.Truth. The predefined symbols 'true' and 'false' are constants.
+type Ident struct {
+	Name string
+}
+
+// StringLit is a quoted string, which may only be a function argument.
+type StringLit struct {
+	Value string
+}
+
+// NumberLit is a number, which may be a function argument or an index.
+type NumberLit struct {
+	Value string
+}
+
+// Index is an element of a list or map, such as SIZES[ENV]. X is the symbol
+// whose value is the list or map, or another Index. The key is a number,
+// a string, a symbol or a function call. An element that doesn't exist is
+// false as a condition.
+type Index struct {
+	X      Expr
+	Key    Expr
+	column int // The column of the list or map, if parsed.
+}
+
+// Call calls a function, such as env("NAME").
+type Call struct {
+	Name   string
+	Args   []Expr
+	column int // The column of the name, if parsed.
+}
+
+// Not negates an expression.
+type Not struct {
+	X Expr
+}
+
+// Binary combines two expressions with && or ||.
+type Binary struct {
+	Op    BinaryOp
+	Left  Expr
+	Right Expr
+}
+
+// Group is an expression in parentheses.
+type Group struct {
+	X Expr
+}
+
+func (*Ident) expr()     {}
+func (*StringLit) expr() {}
+func (*NumberLit) expr() {}
+func (*Index) expr()     {}
+func (*Call) expr()      {}
+func (*Not) expr()       {}
+func (*Binary) expr()    {}
+func (*Group) expr()     {}
+
+// ParseExpression parses a condition, such as the text following !if.
+func ParseExpression(text string) (Expr, error) {
+	prefix := directivePrefixString + DirectiveIf + " "
+
+	p := Parser{}
+	p.scanner.SetText(prefix + text)
+
+	token, _, err := p.scanner.Scan()
+	if err != nil {
+		return nil, err
+	}
+	if token != TokenDirective {
+		return nil, SyntaxError{"Invalid expression", p.scanner.Line(), 0, SyntaxErrorInvalidExpression}
+	}
+
+	expression, err := p.parseExpression()
+	if se, ok := err.(SyntaxError); ok && se.column > len(prefix) {
+		// Report the column within the text.
+		se.column -= len(prefix)
+		return nil, se
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	token, _, err = p.scanner.Scan()
+	if err != nil {
+		return nil, err
+	}
+	if token != TokenLine && token != TokenEnd {
+		return nil, SyntaxError{"Unexpected text after expression", p.scanner.Line(), 0, SyntaxErrorInvalidExpression}
+	}
+
+	return newExpr(&expression), nil
+}
+
+// newExpr converts a node of the parser's expression tree.
+func newExpr(e *Expression) Expr {
+	switch e.kind {
+	case ExpressionIdentifier:
+		return &Ident{e.identifier}
+	case ExpressionString:
+		return &StringLit{e.identifier}
+	case ExpressionNumber:
+		return &NumberLit{e.identifier}
+	case ExpressionIndex:
+		return &Index{newExpr(e.left), newExpr(e.right), e.column}
+	case ExpressionCall:
+		var args []Expr
+		for _, argument := range e.arguments {
+			args = append(args, newExpr(argument))
+		}
+		return &Call{e.identifier, args, e.column}
+	case ExpressionUnary:
+		return &Not{newExpr(e.left)}
+	case ExpressionBinary:
+		op := OpAnd
+		if e.operator == TokenOr {
+			op = OpOr
+		}
+		return &Binary{op, newExpr(e.left), newExpr(e.right)}
+	case ExpressionGroup:
+		return &Group{newExpr(e.left)}
+	}
+	return nil
+}
+
+func (e *Ident) String() string {
+	return e.Name
+}
+
+func (e *StringLit) String() string {
+	return quoteString(e.Value)
+}
+
+func (e *NumberLit) String() string {
+	return e.Value
+}
+
+func (e *Index) String() string {
+	return e.X.String() + "[" + e.Key.String() + "]"
+}
+
+func (e *Call) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteString(e.Name)
+	buffer.WriteString("(")
+	for i, arg := range e.Args {
+		if i > 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString(arg.String())
+	}
+	buffer.WriteString(")")
+	return buffer.String()
+}
+
+func (e *Not) String() string {
+	if _, ok := e.X.(*Binary); ok {
+		return "!(" + e.X.String() + ")"
+	}
+	return "!" + e.X.String()
+}
+
+func (e *Binary) String() string {
+	return binaryOperand(e.Op, e.Left) + " " + e.Op.String() + " " + binaryOperand(e.Op, e.Right)
+}
+
+// binaryOperand returns an operand of a binary expression, in parentheses
+// if the operand has lower precedence.
+func binaryOperand(op BinaryOp, e Expr) string {
+	if inner, ok := e.(*Binary); ok && op == OpAnd && inner.Op == OpOr {
+		return "(" + e.String() + ")"
+	}
+	return e.String()
+}
+
+func (e *Group) String() string {
+	if _, ok := e.X.(*Binary); ok {
+		return "(" + e.X.String() + ")"
+	}
+	return e.X.String()
+}
+
+func (e *Ident) Eval(resolver SymbolResolver) (bool, error) {
+	// The predefined symbols can't be defined or undefined.
+	switch e.Name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+
+	value, defined := resolver.Lookup(e.Name)
+	return defined && value.Truth(), nil
+}
+
+func (e *StringLit) Eval(resolver SymbolResolver) (bool, error) {
+	return false, fmt.Errorf("The string %s can't be used as a condition", quoteString(e.Value))
+}
+
+func (e *NumberLit) Eval(resolver SymbolResolver) (bool, error) {
+	return false, fmt.Errorf("The number %s can't be used as a condition", e.Value)
+}
+
+func (e *Index) Eval(resolver SymbolResolver) (bool, error) {
+	value, found, err := e.value(resolver)
+	return found && value.Truth(), err
+}
+
+// value returns the element and whether it exists. It's an error if the
+// value isn't a list or map, or a list's index isn't a number. Errors are
+// reported as a callError.
+func (e *Index) value(resolver SymbolResolver) (Value, bool, error) {
+	var container Value
+	switch x := e.X.(type) {
+	case *Ident:
+		value, defined := resolver.Lookup(x.Name)
+		if !defined {
+			return Value{}, false, nil
+		}
+		container = value
+	case *Index:
+		value, found, err := x.value(resolver)
+		if err != nil || !found {
+			return Value{}, false, err
+		}
+		container = value
+	default:
+		return Value{}, false, callError{e.column, fmt.Sprintf("%s can't be indexed", e.X)}
+	}
+
+	var key Value
+	switch k := e.Key.(type) {
+	case *Ident:
+		value, defined := resolver.Lookup(k.Name)
+		if !defined {
+			return Value{}, false, nil
+		}
+		key = value
+	default:
+		value, err := argumentValue(k, TypeString, resolver)
+		if _, ok := err.(callError); ok {
+			return Value{}, false, err
+		}
+		if err != nil {
+			return Value{}, false, callError{e.column, err.Error()}
+		}
+		key = value
+	}
+
+	switch container.Kind() {
+	case ValueList:
+		i, err := strconv.Atoi(key.String())
+		if err != nil {
+			return Value{}, false, callError{e.column, fmt.Sprintf("%s is a list, so its index must be a number", e.X)}
+		}
+		value, found := container.Index(i)
+		return value, found, nil
+	case ValueMap:
+		value, found := container.Lookup(key.String())
+		return value, found, nil
+	}
+	return Value{}, false, callError{e.column, fmt.Sprintf("%s isn't a list or map", e.X)}
+}
+
+func (e *Call) Eval(resolver SymbolResolver) (bool, error) {
+	f, ok := functions[e.Name]
+	if ok && f.Result != TypeBool {
+		return false, fmt.Errorf("%s returns a %s, which can't be used as a condition", e.Name, f.Result)
+	}
+
+	value, err := e.value(resolver)
+	return value.Bool(), err
+}
+
+// value calls the function with its arguments. Errors are reported as a
+// callError at the column of the innermost call that failed.
+func (e *Call) value(resolver SymbolResolver) (Value, error) {
+	f, ok := functions[e.Name]
+	if !ok {
+		return Value{}, callError{e.column, fmt.Sprintf("Unknown function %s", e.Name)}
+	}
+	if len(e.Args) != len(f.Args) {
+		return Value{}, callError{e.column, fmt.Sprintf("%s expects %d arguments but received %d", e.Name, len(f.Args), len(e.Args))}
+	}
+
+	args := make([]Value, len(e.Args))
+	for i, arg := range e.Args {
+		value, err := argumentValue(arg, f.Args[i], resolver)
+		if _, ok := err.(callError); ok {
+			return Value{}, err
+		}
+		if err != nil {
+			return Value{}, callError{e.column, fmt.Sprintf("%s: %s", e.Name, err)}
+		}
+		args[i] = value
+	}
+
+	result, err := f.Call(resolver, args)
+	if err != nil {
+		return Value{}, callError{e.column, fmt.Sprintf("%s: %s", e.Name, err)}
+	}
+	return result, nil
+}
+
+// argumentValue evaluates a function argument of the type t.
+func argumentValue(e Expr, t Type, resolver SymbolResolver) (Value, error) {
+	switch t {
+	case TypeBool:
+		result, err := e.Eval(resolver)
+		return BoolValue(result), err
+	case TypeSymbol:
+		if ident, ok := e.(*Ident); ok {
+			return StringValue(ident.Name), nil
+		}
+		return Value{}, fmt.Errorf("Expected a symbol but received %s", e)
+	}
+
+	switch n := e.(type) {
+	case *StringLit:
+		return StringValue(n.Value), nil
+	case *NumberLit:
+		return StringValue(n.Value), nil
+	case *Index:
+		value, found, err := n.value(resolver)
+		if err == nil && !found {
+			err = fmt.Errorf("%s is not defined", n)
+		}
+		return value, err
+	case *Ident:
+		value, defined := resolver.Lookup(n.Name)
+		if !defined {
+			return Value{}, fmt.Errorf("%s is not defined", n.Name)
+		}
+		return value, nil
+	case *Call:
+		return n.value(resolver)
+	}
+	return Value{}, fmt.Errorf("Expected a %s but received %s", t, e)
+}
+
+func (e *Not) Eval(resolver SymbolResolver) (bool, error) {
+	result, err := e.X.Eval(resolver)
+	return !result, err
+}
+
+func (e *Binary) Eval(resolver SymbolResolver) (bool, error) {
+	left, err := e.Left.Eval(resolver)
+	if err != nil {
+		return false, err
+	}
+
+	// Both operators short circuit.
+	if (e.Op == OpAnd && !left) || (e.Op == OpOr && left) {
+		return left, nil
+	}
+	return e.Right.Eval(resolver)
+}
+
+func (e *Group) Eval(resolver SymbolResolver) (bool, error) {
+	return e.X.Eval(resolver)
+}
+
+// Walk traverses an expression depth first, calling visit for each node
+// before its children. If visit returns false, the node's children are
+// skipped.
+func Walk(e Expr, visit func(Expr) bool) {
+	if e == nil || !visit(e) {
+		return
+	}
+
+	switch n := e.(type) {
+	case *Index:
+		Walk(n.X, visit)
+		Walk(n.Key, visit)
+	case *Call:
+		for _, arg := range n.Args {
+			Walk(arg, visit)
+		}
+	case *Not:
+		Walk(n.X, visit)
+	case *Binary:
+		Walk(n.Left, visit)
+		Walk(n.Right, visit)
+	case *Group:
+		Walk(n.X, visit)
+	}
+}
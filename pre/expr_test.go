@@ -0,0 +1,101 @@
+package pre
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseExpression(t *testing.T) {
+	tests := map[string]string{
+		"A":                "A",
+		"!A&&(B||C)":       "!A && (B || C)",
+		"((A))":            "A",
+		"(A && B) || !(C)": "(A && B) || !C",
+		`env("HOME") || X`: `env("HOME") || X`,
+		"A || B && C || D": "A || B && C || D",
+		"!(A || B)":        "!(A || B)",
+	}
+	for text, expected := range tests {
+		e, err := ParseExpression(text)
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", text, err)
+			continue
+		}
+		if e.String() != expected {
+			t.Errorf("Expected %s to print as %s but received %s", text, expected, e.String())
+		}
+	}
+
+	for _, text := range []string{"", "A &&", "(A", "A B", "nope(\"x\")"} {
+		if _, err := ParseExpression(text); err == nil {
+			t.Errorf("Expected an error for '%s'", text)
+		}
+	}
+}
+
+func TestExprString(t *testing.T) {
+	// Nodes built by hand are printed with the parentheses they need.
+	e := &Binary{OpAnd, &Binary{OpOr, &Ident{"A"}, &Ident{"B"}}, &Not{&Binary{OpAnd, &Ident{"C"}, &Ident{"D"}}}}
+	if expected := "(A || B) && !(C && D)"; e.String() != expected {
+		t.Errorf("Expected %s but received %s", expected, e.String())
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	os.Setenv("TERRACOTTA_EXPR_TEST", "1")
+	defer os.Unsetenv("TERRACOTTA_EXPR_TEST")
+
+	resolver := MapResolver{"A": Value{}, "B": StringValue("x")}
+	tests := map[string]bool{
+		"A && B":                           true,
+		"A && C":                           false,
+		"!C || false":                      true,
+		"(C || true) && !false":            true,
+		`env("TERRACOTTA_EXPR_TEST") && A`: true,
+		`env("TERRACOTTA_EXPR_NONE")`:      false,
+	}
+	for text, expected := range tests {
+		e, err := ParseExpression(text)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error: %s", text, err)
+		}
+		result, err := e.Eval(resolver)
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", text, err)
+		} else if result != expected {
+			t.Errorf("Expected %s to be %t", text, expected)
+		}
+	}
+
+	if _, err := (&Call{Name: "nope"}).Eval(resolver); err == nil {
+		t.Error("Expected an error for an unknown function")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	e, err := ParseExpression(`A && !(B || env("C")) || A`)
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+
+	var names []string
+	Walk(e, func(e Expr) bool {
+		if ident, ok := e.(*Ident); ok {
+			names = append(names, ident.Name)
+		}
+		// Skip the arguments of calls.
+		_, call := e.(*Call)
+		return !call
+	})
+
+	if len(names) != 3 || names[0] != "A" || names[1] != "B" || names[2] != "A" {
+		t.Errorf("Expected [A B A] but received %v", names)
+	}
+}
+
+func TestParseExpressionColumn(t *testing.T) {
+	_, err := ParseExpression(`A && nope("x")`)
+	if se, ok := err.(SyntaxError); !ok || se.Column() != 6 {
+		t.Errorf("Expected an error at column 6 but received %v", err)
+	}
+}
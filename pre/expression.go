@@ -10,6 +10,10 @@ const (
 	ExpressionUnary
 	ExpressionBinary
 	ExpressionGroup
+	ExpressionString
+	ExpressionCall
+	ExpressionIndex
+	ExpressionNumber
 )
 
 func expressionToString(kind ExpressionKind) string {
@@ -25,16 +29,33 @@ func expressionToString(kind ExpressionKind) string {
 		result = "Binary"
 	case ExpressionGroup:
 		result = "Group"
+	case ExpressionString:
+		result = "String"
+	case ExpressionCall:
+		result = "Call"
+	case ExpressionIndex:
+		result = "Index"
+	case ExpressionNumber:
+		result = "Number"
 	}
 	return result
 }
 
+// Expression is a node in a conditional expression. A string expression
+// holds its text in identifier. A call expression holds the function name in
+// identifier, its arguments in arguments, and the column of its name. An
+// identifier expression also records the column of its name. An index
+// expression holds the list or map in left, the key in right, and the
+// column of the list or map. A number expression holds its digits in
+// identifier.
 type Expression struct {
 	kind       ExpressionKind
 	operator   Token
 	identifier string
 	left       *Expression
 	right      *Expression
+	arguments  []*Expression
+	column     int
 }
 
 func printExpression(level int, expression *Expression) {
@@ -48,4 +69,7 @@ func printExpression(level int, expression *Expression) {
 	if expression.right != nil {
 		printExpression(level+1, expression.right)
 	}
+	for _, argument := range expression.arguments {
+		printExpression(level+1, argument)
+	}
 }
@@ -0,0 +1,326 @@
+package pre
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// FormatText rewrites the directive lines of a template or definitions file
+// into canonical form: no space after the '!', single spaces around
+// operators, no redundant parentheses and a single space before a trailing
+// comment. Text lines, including lines within multiline comments, !raw
+// blocks and heredocs, are left untouched. If indent is positive, directives
+// are indented by that many spaces for each enclosing conditional block;
+// otherwise they start the line.
+func FormatText(text string, indent int) (string, error) {
+	var result bytes.Buffer
+
+	depth := 0
+	comment := false // Are we within a multiline comment?
+	var raw rawState
+	for i, line := range splitLinesKeepEnds(text) {
+		content := strings.TrimRight(line, "\r\n")
+		ending := line[len(content):]
+
+		// The lines of a !raw block or a heredoc are left as written.
+		if raw.active() && raw.rawLine(content) {
+			result.WriteString(line)
+			continue
+		}
+
+		trimmed := strings.TrimLeft(content, " \t")
+		if comment || !strings.HasPrefix(trimmed, directivePrefixString) || hasSubstitutionPrefix(trimmed) {
+			open := textCommentState(content, comment)
+			if !open {
+				if comment {
+					// The comment may have followed a directive.
+					raw.lineEnd()
+				}
+				raw.textLine(content)
+			}
+			comment = open
+			result.WriteString(line)
+			continue
+		}
+
+		code, trailing, ok := splitDirectiveComment(trimmed)
+		if !ok {
+			// A comment that separates parameters, or that spans lines, is
+			// left as written.
+			comment = !strings.Contains(trailing[len("/*"):], "*/")
+			name, _ := splitDirective(code)
+			raw.directive(name)
+			if !comment {
+				raw.lineEnd()
+			}
+			result.WriteString(line)
+			continue
+		}
+
+		directive, formatted, err := formatDirective(code)
+		if err != nil {
+			return "", lineError(err, i+1)
+		}
+		raw.directive(directive)
+		raw.lineEnd()
+
+		switch directive {
+		case DirectiveElif, DirectiveElse, DirectiveEndif, DirectiveCase, DirectiveDefault, DirectiveEndswitch, DirectiveEndfor:
+			if depth > 0 {
+				depth--
+			}
+		}
+
+		if indent > 0 {
+			result.WriteString(strings.Repeat(" ", depth*indent))
+		}
+		result.WriteString(formatted)
+		if trailing != "" {
+			result.WriteString(" ")
+			result.WriteString(trailing)
+		}
+		result.WriteString(ending)
+
+		switch directive {
+		case DirectiveIf, DirectiveIfdef, DirectiveIfndef, DirectiveElif, DirectiveElse, DirectiveSwitch, DirectiveCase, DirectiveDefault, DirectiveFor:
+			// As in Go, !case and !default are indented like their !switch.
+			depth++
+		}
+	}
+
+	return result.String(), nil
+}
+
+// formatDirective returns the name and canonical form of a directive line
+// without its trailing comment.
+func formatDirective(code string) (string, string, error) {
+	directive, rest := splitDirective(code)
+
+	// The message of !error is free-form, so it's only trimmed.
+	if directive == DirectiveError {
+		if rest = strings.TrimSpace(rest); rest != "" {
+			return directive, directivePrefixString + directive + " " + rest, nil
+		}
+		return directive, directivePrefixString + directive, nil
+	}
+
+	p := Parser{}
+	p.SetText(code)
+	items, err := p.outline()
+	if err != nil {
+		return directive, "", err
+	}
+
+	if len(items) != 1 || items[0].kind != ParseItemDirective {
+		return directive, "", SyntaxError{"Expected a single directive", 0, 0, SyntaxErrorInvalidDirective}
+	}
+
+	item := items[0]
+	result := directivePrefixString + item.directive
+	switch item.directive {
+	case DirectiveDefine, DirectiveUndef, DirectiveIfdef, DirectiveIfndef:
+		result += " " + item.symbol
+		if item.value.Kind() != ValueNone {
+			result += " " + defineLiteral(item.value)
+		}
+	case DirectiveIf, DirectiveElif, DirectiveSwitch:
+		result += " " + formatCondition(item.condition)
+	case DirectiveCase:
+		result += " " + formatCaseValues(item.values)
+	case DirectiveFor:
+		result += " " + formatLoop(item.symbol, item.list)
+	}
+
+	return item.directive, result, nil
+}
+
+// defineLiteral returns the value of a !define in canonical syntax. A string
+// that reads the same without quotes is left bare.
+func defineLiteral(value Value) string {
+	if value.Kind() == ValueString {
+		if v, err := parseDefineValue(value.String()); err == nil && v.Kind() == ValueString && v.String() == value.String() {
+			return value.String()
+		}
+	}
+	return value.Literal()
+}
+
+// splitDirective returns the name of the directive on a line beginning with
+// '!', and the text that follows it.
+func splitDirective(code string) (string, string) {
+	code = strings.TrimLeft(code[len(directivePrefixString):], " \t")
+	end := strings.IndexFunc(code, func(r rune) bool {
+		return r != '_' && !unicode.IsLetter(r)
+	})
+	if end < 0 {
+		return code, ""
+	}
+	return code[:end], code[end:]
+}
+
+// splitDirectiveComment separates the trailing comment from a directive
+// line. It returns false if the comment is followed by more of the
+// directive, or isn't closed on the same line.
+func splitDirectiveComment(line string) (string, string, bool) {
+	// The message of !error runs to the end of the line.
+	if directive, _ := splitDirective(line); directive == DirectiveError {
+		return strings.TrimRight(line, " \t"), "", true
+	}
+
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quoted && line[i] == '\\':
+			i++ // Skip the escaped character
+		case line[i] == '"':
+			quoted = !quoted
+		case quoted:
+			// Comments can't start within a string.
+		case line[i] == '#':
+			return strings.TrimRight(line[:i], " \t"), strings.TrimRight(line[i:], " \t"), true
+		case strings.HasPrefix(line[i:], "/*"):
+			code := strings.TrimRight(line[:i], " \t")
+			trailing := strings.TrimRight(line[i:], " \t")
+			end := strings.Index(trailing[len("/*"):], "*/")
+			if end < 0 || len("/*")+end+len("*/") != len(trailing) {
+				return code, trailing, false
+			}
+			return code, trailing, true
+		}
+	}
+
+	return strings.TrimRight(line, " \t"), "", true
+}
+
+// textCommentState reports whether a multiline comment is open at the end
+// of a text line, given whether one was open at its start.
+func textCommentState(line string, comment bool) bool {
+	for {
+		if comment {
+			end := strings.Index(line, "*/")
+			if end < 0 {
+				return true
+			}
+			line = line[end+len("*/"):]
+			comment = false
+		} else {
+			start := strings.Index(line, "/*")
+			if start < 0 {
+				return false
+			}
+			line = line[start+len("/*"):]
+			comment = true
+		}
+	}
+}
+
+// formatCondition returns the canonical form of a condition. Parentheses
+// around the whole condition are removed.
+func formatCondition(e *Expression) string {
+	var buffer bytes.Buffer
+	writeExpression(&buffer, ungroup(e))
+	return buffer.String()
+}
+
+// writeExpression writes an expression with single spaces around binary
+// operators. Parentheses are kept only around binary expressions, and
+// nested parentheses are collapsed.
+func writeExpression(buffer *bytes.Buffer, e *Expression) {
+	switch e.kind {
+	case ExpressionIdentifier:
+		buffer.WriteString(e.identifier)
+	case ExpressionString:
+		buffer.WriteString(quoteString(e.identifier))
+	case ExpressionNumber:
+		buffer.WriteString(e.identifier)
+	case ExpressionIndex:
+		writeExpression(buffer, e.left)
+		buffer.WriteString("[")
+		writeExpression(buffer, e.right)
+		buffer.WriteString("]")
+	case ExpressionCall:
+		buffer.WriteString(e.identifier)
+		buffer.WriteString("(")
+		for i, argument := range e.arguments {
+			if i > 0 {
+				buffer.WriteString(", ")
+			}
+			writeExpression(buffer, argument)
+		}
+		buffer.WriteString(")")
+	case ExpressionUnary:
+		buffer.WriteString("!")
+		writeExpression(buffer, e.left)
+	case ExpressionBinary:
+		writeExpression(buffer, e.left)
+		switch e.operator {
+		case TokenAnd:
+			buffer.WriteString(" && ")
+		case TokenOr:
+			buffer.WriteString(" || ")
+		}
+		writeExpression(buffer, e.right)
+	case ExpressionGroup:
+		inner := ungroup(e)
+		if inner.kind == ExpressionBinary {
+			buffer.WriteString("(")
+			writeExpression(buffer, inner)
+			buffer.WriteString(")")
+		} else {
+			writeExpression(buffer, inner)
+		}
+	}
+}
+
+// ungroup returns the expression within any parentheses.
+func ungroup(e *Expression) *Expression {
+	for e.kind == ExpressionGroup {
+		e = e.left
+	}
+	return e
+}
+
+// quoteString quotes a string parameter, escaping quotes and backslashes as
+// the scanner expects.
+func quoteString(s string) string {
+	var buffer bytes.Buffer
+	buffer.WriteString(`"`)
+	for _, r := range s {
+		if r == '"' || r == '\\' {
+			buffer.WriteRune('\\')
+		}
+		buffer.WriteRune(r)
+	}
+	buffer.WriteString(`"`)
+	return buffer.String()
+}
+
+// splitLinesKeepEnds splits text into lines, each with its line ending.
+func splitLinesKeepEnds(text string) []string {
+	var lines []string
+	for text != "" {
+		end := strings.IndexByte(text, '\n')
+		if end < 0 {
+			lines = append(lines, text)
+			break
+		}
+		lines = append(lines, text[:end+1])
+		text = text[end+1:]
+	}
+	return lines
+}
+
+// lineError sets the line of a syntax or processing error.
+func lineError(err error, line int) error {
+	switch e := err.(type) {
+	case SyntaxError:
+		e.line = line
+		return e
+	case ProcessingError:
+		e.line = line
+		return e
+	}
+	return fmt.Errorf("(%d): %s", line, err.Error())
+}
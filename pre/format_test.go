@@ -0,0 +1,117 @@
+package pre
+
+import "testing"
+
+func TestFormatDirectives(t *testing.T) {
+	formatExpect(t, 0,
+		"! define  A\n"+
+			"  !if  ( A&&(B) )||!( (C) )  # Comment\n"+
+			"resource \"x\" \"y\" {  \n"+
+			"\t!elif !A   /* Comment */\r\n"+
+			"!else\n"+
+			"  ! endif\n",
+		"!define A\n"+
+			"!if (A && B) || !C # Comment\n"+
+			"resource \"x\" \"y\" {  \n"+
+			"!elif !A /* Comment */\r\n"+
+			"!else\n"+
+			"!endif\n")
+
+	formatExpect(t, 0,
+		"!if env( \"A\\\"B\" ) &&(A||B)\n"+
+			"!error   \"Not # a comment\"  \n"+
+			"!endif",
+		"!if env(\"A\\\"B\") && (A || B)\n"+
+			"!error \"Not # a comment\"\n"+
+			"!endif")
+
+	formatExpect(t, 0,
+		"!ifdef   A  # Comment\n"+
+			"! ifndef B\n"+
+			"!endif\n"+
+			"!endif\n",
+		"!ifdef A # Comment\n"+
+			"!ifndef B\n"+
+			"!endif\n"+
+			"!endif\n")
+
+	formatExpect(t, 0,
+		"!define  A  prod\n"+
+			"!define B \"prod\"   # Comment\n"+
+			"!define C {b=[1 ,\"x y\"], a:true}\n"+
+			"!if  C[ \"b\" ][0]&&A\n"+
+			"!endif\n",
+		"!define A prod\n"+
+			"!define B prod # Comment\n"+
+			"!define C {b = [\"1\", \"x y\"], a = true}\n"+
+			"!if C[\"b\"][0] && A\n"+
+			"!endif\n")
+}
+
+func TestFormatIndent(t *testing.T) {
+	formatExpect(t, 2,
+		"!if A\n"+
+			"!if B\n"+
+			"x\n"+
+			"!elif C\n"+
+			"!else\n"+
+			"!endif\n"+
+			"!endif\n",
+		"!if A\n"+
+			"  !if B\n"+
+			"x\n"+
+			"  !elif C\n"+
+			"  !else\n"+
+			"  !endif\n"+
+			"!endif\n")
+
+	formatExpect(t, 2,
+		"!switch  lower( ENV )\n"+
+			"!case \"prod\" ,\"staging\"\n"+
+			"!if A\n"+
+			"!endif\n"+
+			"!default\n"+
+			"!endswitch\n",
+		"!switch lower(ENV)\n"+
+			"!case \"prod\", \"staging\"\n"+
+			"  !if A\n"+
+			"  !endif\n"+
+			"!default\n"+
+			"!endswitch\n")
+
+	formatExpect(t, 2,
+		"!for  X in \"a\",B\n"+
+			"!if X\n"+
+			"!endif\n"+
+			"!endfor\n",
+		"!for X in \"a\", B\n"+
+			"  !if X\n"+
+			"  !endif\n"+
+			"!endfor\n")
+}
+
+func TestFormatComments(t *testing.T) {
+	// Lines within multiline comments aren't directives.
+	text := "/*\n  ! if A\n*/\n!if A /* Spans\n  ! if\n*/\n!if A /* Splits */ && B\n"
+	formatExpect(t, 0, text, text)
+}
+
+func TestFormatError(t *testing.T) {
+	_, err := FormatText("x\n!if A &&\n", 0)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if errorLine(err) != 2 {
+		t.Errorf("Expected an error on line 2 but received %s", err.Error())
+	}
+}
+
+func formatExpect(t *testing.T, indent int, text string, expected string) {
+	result, err := FormatText(text, indent)
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+	if result != expected {
+		t.Errorf("Expected:\n%q\nbut received:\n%q", expected, result)
+	}
+}
@@ -0,0 +1,265 @@
+package pre
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The built-in functions.
+const (
+	// FunctionDefined tests whether a symbol is defined.
+	FunctionDefined = "defined"
+	// FunctionEnv tests whether an environment variable is set and not empty.
+	FunctionEnv = "env"
+	// FunctionExists tests whether a file or directory exists.
+	FunctionExists = "exists"
+	// FunctionContains tests whether a value contains a string, or a list
+	// has it as an element, or a map as a key.
+	FunctionContains = "contains"
+	// FunctionMatches tests whether a string matches a regular expression.
+	FunctionMatches = "matches"
+	// FunctionLower returns a string in lower case.
+	FunctionLower = "lower"
+	// FunctionUpper returns a string in upper case.
+	FunctionUpper = "upper"
+	// FunctionSemverGte tests whether a version is at least another.
+	FunctionSemverGte = "semver_gte"
+)
+
+// Type is the type of a function argument or result.
+type Type int
+
+const (
+	// TypeBool is a condition. An argument may be any expression.
+	TypeBool Type = iota
+	// TypeString is a string. An argument may be a quoted string, the value
+	// of a defined symbol, or a call to a function that returns a string.
+	TypeString
+	// TypeSymbol is the name of a symbol, which needn't be defined. An
+	// argument must be an identifier.
+	TypeSymbol
+	// TypeValue is any value. An argument may be given as for TypeString.
+	TypeValue
+)
+
+func (t Type) String() string {
+	result := ""
+	switch t {
+	case TypeBool:
+		result = "condition"
+	case TypeString:
+		result = "string"
+	case TypeSymbol:
+		result = "symbol"
+	case TypeValue:
+		result = "value"
+	}
+	return result
+}
+
+// Function is a function that may be called in expressions. Call receives
+// the arguments converted to Args, and the resolver of the symbols in scope.
+// A symbol argument is passed as a string value of its name. The result must
+// be of type Result, which is TypeBool or TypeString.
+type Function struct {
+	Args   []Type
+	Result Type
+	Call   func(symbols SymbolResolver, args []Value) (Value, error)
+}
+
+var functions = map[string]Function{
+	FunctionDefined:   {[]Type{TypeSymbol}, TypeBool, callDefined},
+	FunctionEnv:       {[]Type{TypeString}, TypeBool, callEnv},
+	FunctionExists:    {[]Type{TypeString}, TypeBool, callExists},
+	FunctionContains:  {[]Type{TypeValue, TypeString}, TypeBool, callContains},
+	FunctionMatches:   {[]Type{TypeString, TypeString}, TypeBool, callMatches},
+	FunctionLower:     {[]Type{TypeString}, TypeString, callLower},
+	FunctionUpper:     {[]Type{TypeString}, TypeString, callUpper},
+	FunctionSemverGte: {[]Type{TypeString, TypeString}, TypeBool, callSemverGte},
+}
+
+// RegisterFunction adds a function that may be called in expressions by
+// every parser. It should be called before parsing, such as from an init
+// function. Registering a name again replaces the function, but the
+// built-in functions can't be replaced.
+func RegisterFunction(name string, f Function) error {
+	if !isDirectiveName(name) {
+		return fmt.Errorf("Invalid function name '%s'", name)
+	}
+	if isBuiltinFunction(name) {
+		return fmt.Errorf("The %s function can't be replaced", name)
+	}
+	if f.Result != TypeBool && f.Result != TypeString {
+		return fmt.Errorf("The %s function must return a condition or a string", name)
+	}
+	if f.Call == nil {
+		return fmt.Errorf("The %s function has no implementation", name)
+	}
+
+	functions[name] = f
+	return nil
+}
+
+// FunctionNames returns the names of the functions that may be called, in
+// order.
+func FunctionNames() []string {
+	var names []string
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isBuiltinFunction(name string) bool {
+	switch name {
+	case FunctionDefined, FunctionEnv, FunctionExists, FunctionContains, FunctionMatches, FunctionLower, FunctionUpper, FunctionSemverGte:
+		return true
+	}
+	return false
+}
+
+// isDirectiveName returns true if name can be scanned as the name of a
+// directive or function.
+func isDirectiveName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r != '_' && !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// callError is an error in a function call, at the column of its name, or
+// in an index, at the column of the list or map.
+type callError struct {
+	column  int
+	message string
+}
+
+func (e callError) Error() string {
+	return e.message
+}
+
+func callDefined(symbols SymbolResolver, args []Value) (Value, error) {
+	_, defined := symbols.Lookup(args[0].String())
+	return BoolValue(defined), nil
+}
+
+func callEnv(symbols SymbolResolver, args []Value) (Value, error) {
+	// An environment variable is true if it is set and not empty.
+	value, _ := os.LookupEnv(args[0].String())
+	return BoolValue(value != ""), nil
+}
+
+func callExists(symbols SymbolResolver, args []Value) (Value, error) {
+	_, err := os.Stat(args[0].String())
+	return BoolValue(err == nil), nil
+}
+
+func callContains(symbols SymbolResolver, args []Value) (Value, error) {
+	switch args[0].Kind() {
+	case ValueList, ValueMap:
+		return BoolValue(args[0].Contains(args[1].String())), nil
+	}
+	return BoolValue(strings.Contains(args[0].String(), args[1].String())), nil
+}
+
+func callMatches(symbols SymbolResolver, args []Value) (Value, error) {
+	matched, err := regexp.MatchString(args[1].String(), args[0].String())
+	if err != nil {
+		return Value{}, fmt.Errorf("Invalid regular expression: %s", err)
+	}
+	return BoolValue(matched), nil
+}
+
+func callLower(symbols SymbolResolver, args []Value) (Value, error) {
+	return StringValue(strings.ToLower(args[0].String())), nil
+}
+
+func callUpper(symbols SymbolResolver, args []Value) (Value, error) {
+	return StringValue(strings.ToUpper(args[0].String())), nil
+}
+
+func callSemverGte(symbols SymbolResolver, args []Value) (Value, error) {
+	result, err := compareVersions(args[0].String(), args[1].String())
+	if err != nil {
+		return Value{}, err
+	}
+	return BoolValue(result >= 0), nil
+}
+
+// compareVersions compares two semantic versions, such as 1.5.0, returning
+// -1, 0 or 1. A leading 'v' and build metadata are ignored, and missing
+// minor or patch numbers are zero. A pre-release precedes its release.
+func compareVersions(a string, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < 3; i++ {
+		if va.numbers[i] != vb.numbers[i] {
+			if va.numbers[i] < vb.numbers[i] {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+
+	switch {
+	case va.prerelease == vb.prerelease:
+		return 0, nil
+	case va.prerelease == "":
+		return 1, nil
+	case vb.prerelease == "":
+		return -1, nil
+	case va.prerelease < vb.prerelease:
+		return -1, nil
+	}
+	return 1, nil
+}
+
+type version struct {
+	numbers    [3]int
+	prerelease string
+}
+
+func parseVersion(text string) (version, error) {
+	var v version
+
+	s := strings.TrimPrefix(strings.TrimSpace(text), "v")
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.Index(s, "-"); i >= 0 {
+		v.prerelease = s[i+1:]
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, fmt.Errorf("Invalid version '%s'", text)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("Invalid version '%s'", text)
+		}
+		v.numbers[i] = n
+	}
+
+	return v, nil
+}
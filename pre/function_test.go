@@ -0,0 +1,159 @@
+package pre
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFunctions(t *testing.T) {
+	os.Setenv("TERRACOTTA_FUNCTION_TEST", "1")
+	defer os.Unsetenv("TERRACOTTA_FUNCTION_TEST")
+
+	resolver := MapResolver{
+		"ENV":        StringValue("Prod"),
+		"AZS":        StringValue("us-west-2a, us-west-2b"),
+		"TF_VERSION": StringValue("1.6.2"),
+		"FLAG":       Value{},
+	}
+	tests := map[string]bool{
+		"defined(FLAG) && !defined(NOPE)":      true,
+		`env("TERRACOTTA_FUNCTION_TEST")`:      true,
+		`exists("function_test.go")`:           true,
+		`exists("nope.go")`:                    false,
+		`contains(AZS, "us-west-2b")`:          true,
+		`contains(AZS, "eu")`:                  false,
+		`matches(ENV, "^P")`:                   true,
+		`matches(lower(ENV), "^prod$")`:        true,
+		`contains(upper(ENV), "PROD")`:         true,
+		`semver_gte(TF_VERSION, "1.5.0")`:      true,
+		`semver_gte(TF_VERSION, "1.10")`:       false,
+		`semver_gte("v1.5.0", "1.5.0-rc1")`:    true,
+		`!defined(NOPE) || matches(NOPE, "x")`: true,
+	}
+	for text, expected := range tests {
+		e, err := ParseExpression(text)
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", text, err)
+			continue
+		}
+		result, err := e.Eval(resolver)
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", text, err)
+		} else if result != expected {
+			t.Errorf("Expected %s to be %t", text, expected)
+		}
+	}
+
+	for _, text := range []string{`matches(NOPE, "x")`, `matches(ENV, "(")`, `semver_gte(ENV, "1.0")`} {
+		e, err := ParseExpression(text)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error: %s", text, err)
+		}
+		if _, err := e.Eval(resolver); err == nil {
+			t.Errorf("Expected an error evaluating %s", text)
+		}
+	}
+}
+
+func TestFunctionSyntax(t *testing.T) {
+	tests := map[string]int{
+		`nope("x")`:               1,
+		`A && lower("x")`:         6,
+		`defined("A")`:            9,
+		`matches(ENV)`:            1,
+		`contains(A, "x", "y")`:   1,
+		`matches(defined(A), "")`: 9,
+		`lower(`:                  1,
+		`contains()`:              1,
+		`nosuch(A) /* x */`:       1,
+	}
+	for text, column := range tests {
+		// Errors are reported at the line of the directive, and columns from
+		// the start of the line.
+		for _, prefix := range []string{"", "a\nb\n"} {
+			line := strings.Count(prefix, "\n") + 1
+
+			p := Parser{}
+			p.SetText(prefix + "!if " + text + "\n!endif\n")
+			err := p.ParseLines(func(string, int) {})
+
+			se, ok := err.(SyntaxError)
+			if !ok {
+				t.Errorf("%s: Expected a syntax error but received %v", text, err)
+				continue
+			}
+			if se.Line() != line || se.Column() != column+4 {
+				t.Errorf("%s: Expected the error at (%d,%d) but received (%d,%d): %s", text, line, column+4, se.Line(), se.Column(), se)
+			}
+		}
+	}
+}
+
+func TestFunctionErrors(t *testing.T) {
+	p := Parser{}
+	p.SetText("a\n!if matches(  ENV, \"(\")\n!endif\n")
+	p.Enter()
+	p.DefineValue("ENV", StringValue("prod"))
+
+	err := p.ParseLines(func(line string, number int) {})
+	pe, ok := err.(ProcessingError)
+	if !ok || pe.Line() != 2 || pe.Column() != 5 {
+		t.Errorf("Expected an error at line 2, column 5 but received %v", err)
+	}
+}
+
+func TestRegisterFunction(t *testing.T) {
+	err := RegisterFunction("feature", Function{
+		Args:   []Type{TypeString},
+		Result: TypeBool,
+		Call: func(symbols SymbolResolver, args []Value) (Value, error) {
+			if args[0].String() == "broken" {
+				return Value{}, errors.New("unavailable")
+			}
+			return BoolValue(args[0].String() == "on"), nil
+		},
+	})
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+	defer delete(functions, "feature")
+
+	e, err := ParseExpression(`feature("on") && !feature(lower("OFF"))`)
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+	if result, err := e.Eval(MapResolver{}); err != nil || !result {
+		t.Errorf("Expected true but received %t %v", result, err)
+	}
+
+	e, _ = ParseExpression(`feature("broken")`)
+	if _, err := e.Eval(MapResolver{}); err == nil || err.Error() != "feature: unavailable" {
+		t.Errorf("Expected the function's error but received %v", err)
+	}
+
+	if err := RegisterFunction(FunctionEnv, Function{Result: TypeBool, Call: functions["feature"].Call}); err == nil {
+		t.Error("Expected an error replacing a built-in function")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.5.0", "1.5.0", 0},
+		{"1.5", "1.5.0", 0},
+		{"v1.10.0", "1.9.9", 1},
+		{"1.5.0-beta", "1.5.0", -1},
+		{"1.5.0-alpha", "1.5.0-beta", -1},
+		{"1.5.0+build", "1.5.0", 0},
+	}
+	for _, test := range tests {
+		result, err := compareVersions(test.a, test.b)
+		if err != nil || result != test.expected {
+			t.Errorf("Expected %s vs %s to be %d but received %d %v", test.a, test.b, test.expected, result, err)
+		}
+	}
+}
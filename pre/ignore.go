@@ -0,0 +1,155 @@
+package pre
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+)
+
+const ignoreFilename = ".terracottaignore"
+
+// ignorePattern is a single glob pattern with gitignore semantics.
+type ignorePattern struct {
+	pattern  string
+	base     string // The directory, relative to the root, the pattern applies to.
+	negate   bool   // The pattern was prefixed with '!'.
+	dirOnly  bool   // The pattern was suffixed with '/'.
+	anchored bool   // The pattern contains a '/' and matches relative paths.
+}
+
+// newIgnorePattern parses a single pattern line. It returns false if the
+// line is blank or a comment.
+func newIgnorePattern(line string, base string) (ignorePattern, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignorePattern{}, false
+	}
+
+	p := ignorePattern{base: base}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\") {
+		// Escaped leading '#' or '!'
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+
+	if line == "" {
+		return ignorePattern{}, false
+	}
+
+	p.pattern = line
+	return p, true
+}
+
+// match reports whether the pattern matches rel, a slash separated path
+// relative to the root of the walk.
+func (p *ignorePattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+
+	if p.base != "" {
+		if !strings.HasPrefix(rel, p.base+"/") {
+			return false
+		}
+		rel = rel[len(p.base)+1:]
+	}
+
+	if p.anchored {
+		return matchGlob(p.pattern, rel)
+	}
+
+	return matchGlob(p.pattern, path.Base(rel))
+}
+
+// readIgnoreFile loads the patterns in an ignore file. Patterns apply to
+// paths below base.
+func readIgnoreFile(filename string, base string) ([]ignorePattern, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var patterns []ignorePattern
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if p, ok := newIgnorePattern(scanner.Text(), base); ok {
+			patterns = append(patterns, p)
+		}
+	}
+
+	return patterns, scanner.Err()
+}
+
+// parsePatterns converts command-line glob patterns, which are relative to
+// the root of the walk.
+func parsePatterns(globs []string) []ignorePattern {
+	var patterns []ignorePattern
+	for _, glob := range globs {
+		if p, ok := newIgnorePattern(glob, ""); ok {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// matchPatterns reports whether rel is matched by the patterns. As with
+// gitignore, the last matching pattern wins, so a negated pattern can
+// reverse an earlier match.
+func matchPatterns(patterns []ignorePattern, rel string, isDir bool) bool {
+	matched := false
+	for i := range patterns {
+		if patterns[i].match(rel, isDir) {
+			matched = !patterns[i].negate
+		}
+	}
+	return matched
+}
+
+// matchGlob matches a slash separated glob pattern against a slash
+// separated name. In addition to the path.Match syntax, a '**' segment
+// matches zero or more path segments.
+func matchGlob(pattern string, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		matched, err := path.Match(pattern[0], name[0])
+		if err != nil || !matched {
+			return false
+		}
+
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+
+	return len(name) == 0
+}
@@ -0,0 +1,65 @@
+package pre
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	matchExpect(t, "*.tft", "main.tft", true)
+	matchExpect(t, "*.tft", "main.tf", false)
+	matchExpect(t, "modules/*", "modules/vpc", true)
+	matchExpect(t, "modules/*", "modules/vpc/main.tft", false)
+	matchExpect(t, "modules/**", "modules/vpc/main.tft", true)
+	matchExpect(t, "**/main.tft", "main.tft", true)
+	matchExpect(t, "**/main.tft", "a/b/main.tft", true)
+	matchExpect(t, "a/**/b", "a/b", true)
+	matchExpect(t, "a/**/b", "a/x/y/b", true)
+	matchExpect(t, "a/**/b", "a/x/y/c", false)
+}
+
+func TestIgnorePatterns(t *testing.T) {
+	var patterns []ignorePattern
+	for _, line := range []string{
+		"# Comment",
+		"",
+		"node_modules/",
+		"*.bak.tft",
+		"!keep.bak.tft",
+		"/vendor",
+	} {
+		if p, ok := newIgnorePattern(line, ""); ok {
+			patterns = append(patterns, p)
+		}
+	}
+
+	if len(patterns) != 4 {
+		t.Fatalf("Expected 4 patterns, received %d", len(patterns))
+	}
+
+	ignoreExpect(t, patterns, "node_modules", true, true)
+	ignoreExpect(t, patterns, "a/node_modules", true, true)
+	ignoreExpect(t, patterns, "node_modules", false, false)
+	ignoreExpect(t, patterns, "a/main.bak.tft", false, true)
+	ignoreExpect(t, patterns, "a/keep.bak.tft", false, false)
+	ignoreExpect(t, patterns, "vendor", true, true)
+	ignoreExpect(t, patterns, "a/vendor", true, false)
+}
+
+func TestNestedIgnorePatterns(t *testing.T) {
+	p, _ := newIgnorePattern("/local.tft", "modules/vpc")
+	patterns := []ignorePattern{p}
+
+	ignoreExpect(t, patterns, "local.tft", false, false)
+	ignoreExpect(t, patterns, "modules/vpc/local.tft", false, true)
+	ignoreExpect(t, patterns, "modules/vpc/a/local.tft", false, false)
+}
+
+func matchExpect(t *testing.T, pattern string, name string, expected bool) {
+	if matchGlob(pattern, name) != expected {
+		t.Errorf("Expected '%s' match '%s' = %t", pattern, name, expected)
+	}
+}
+
+func ignoreExpect(t *testing.T, patterns []ignorePattern, rel string, isDir bool, expected bool) {
+	if matchPatterns(patterns, rel, isDir) != expected {
+		t.Errorf("Expected '%s' (dir = %t) ignored = %t", rel, isDir, expected)
+	}
+}
@@ -0,0 +1,643 @@
+package pre
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultMaxDepth is the deepest nesting of conditional blocks allowed by
+// Lint by default.
+const DefaultMaxDepth = 3
+
+// maxLintAtoms limits the number of distinct symbols in the conditions that
+// are compared by truth table.
+const maxLintAtoms = 12
+
+// lintIgnoreMarker suppresses diagnostics on the line containing it, or on
+// the following line. It may be followed by a list of rule IDs.
+const lintIgnoreMarker = "terracotta:ignore"
+
+const (
+	RuleSyntax            = "TC001"
+	RuleUndefinedSymbol   = "TC002"
+	RuleUnusedSymbol      = "TC003"
+	RuleConstantCondition = "TC004"
+	RuleUnreachableArm    = "TC005"
+	RuleEmptyBlock        = "TC006"
+	RuleDeepNesting       = "TC007"
+	RuleDuplicateCase     = "TC008"
+)
+
+// LintRule describes a check performed by Lint.
+type LintRule struct {
+	ID          string
+	Severity    Severity
+	Description string
+}
+
+// LintRules lists the checks performed by Lint.
+var LintRules = []LintRule{
+	{RuleSyntax, SeverityError, "The file can't be parsed, or its conditional blocks are unbalanced"},
+	{RuleUndefinedSymbol, SeverityWarning, "A symbol is referenced in a condition or substitution but never defined"},
+	{RuleUnusedSymbol, SeverityInfo, "A symbol is defined but never referenced in a condition or substitution"},
+	{RuleConstantCondition, SeverityWarning, "A condition is always true or always false"},
+	{RuleUnreachableArm, SeverityWarning, "An !elif, !else, !case or !default arm can't be taken because earlier arms cover it"},
+	{RuleEmptyBlock, SeverityWarning, "A conditional block contains nothing"},
+	{RuleDeepNesting, SeverityInfo, "Conditional blocks are nested too deeply"},
+	{RuleDuplicateCase, SeverityError, "A !case value is already handled by an earlier !case of the same !switch"},
+}
+
+func ruleSeverity(id string) Severity {
+	for _, rule := range LintRules {
+		if rule.ID == id {
+			return rule.Severity
+		}
+	}
+	return SeverityError
+}
+
+// symbolSite is a location at which a symbol is defined or referenced.
+type symbolSite struct {
+	filename string
+	line     int
+}
+
+// linter accumulates diagnostics and symbol usage across files.
+type linter struct {
+	maxDepth    int
+	diagnostics []Diagnostic
+	known       map[string]bool
+	defined     map[string][]symbolSite
+	referenced  map[string][]symbolSite
+	directives  map[string]DirectiveHandler // Custom directives to accept.
+}
+
+func newLinter(maxDepth int) *linter {
+	return &linter{
+		maxDepth:   maxDepth,
+		known:      make(map[string]bool),
+		defined:    make(map[string][]symbolSite),
+		referenced: make(map[string][]symbolSite),
+	}
+}
+
+func (l *linter) report(filename string, line int, rule string, format string, a ...interface{}) {
+	if line < 1 {
+		line = 1
+	}
+	l.diagnostics = append(l.diagnostics, Diagnostic{filename, line, rule, ruleSeverity(rule), fmt.Sprintf(format, a...)})
+}
+
+// Lint checks the templates in the source directory, and the definitions
+// that apply to them, for likely mistakes. The definitions from the
+// project config, the environment, definitions files and the command line
+// are considered when checking for undefined symbols. A maxDepth of zero
+// uses DefaultMaxDepth. Diagnostics are ordered by file and line.
+func (p *Preprocessor) Lint(source string, defines []string, undefs []string, maxDepth int) ([]Diagnostic, error) {
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxDepth
+	}
+
+	l := newLinter(maxDepth)
+	l.directives = p.parser.directives
+
+	root, ancestors, err := projectAncestors(source)
+	if err != nil {
+		return nil, err
+	}
+
+	config := filepath.Join(root, configFilename)
+	if _, err := os.Stat(config); err == nil {
+		c, err := ReadConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		l.addKnown(c.Define)
+		l.addKnown(c.Undef)
+		l.addKnown(c.Matrix)
+	}
+
+	l.addKnown(p.environ)
+	l.addKnown(defines)
+	l.addKnown(undefs)
+
+	var defs []string
+	for _, ancestor := range ancestors {
+		tfdefs := filepath.Join(ancestor, tfdefsFilename)
+		if _, err := os.Stat(tfdefs); err == nil {
+			defs = append(defs, tfdefs)
+		}
+	}
+
+	for _, file := range p.defsFiles {
+		if file.directives {
+			defs = append(defs, file.filename)
+		}
+		for _, d := range file.definitions {
+			l.known[d.name] = true
+		}
+	}
+
+	var templates []string
+	err = p.collectFiles(source, "", &templates, &defs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, filename := range defs {
+		l.lintFile(filename, true)
+	}
+
+	for _, filename := range templates {
+		l.lintFile(filename, false)
+	}
+
+	l.checkSymbols()
+
+	return l.finish(), nil
+}
+
+// LintText checks a single template, given as text, without considering
+// definitions elsewhere. This is suitable for checking a file as it's
+// being edited.
+func LintText(filename string, text string, maxDepth int) []Diagnostic {
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxDepth
+	}
+
+	l := newLinter(maxDepth)
+
+	p := Parser{}
+	p.SetText(text)
+	items, err := p.outline()
+	l.lintOutline(filename, items, err, false)
+
+	return l.filter(l.diagnostics, map[string][]string{filename: splitLines(text)})
+}
+
+// addKnown records symbols, which may take the form NAME=value.
+func (l *linter) addKnown(symbols []string) {
+	for _, symbol := range symbols {
+		name, _, _ := splitDefine(symbol)
+		l.known[name] = true
+	}
+}
+
+func (l *linter) lintFile(filename string, defs bool) {
+	p := Parser{directives: l.directives}
+	p.SetFile(filename)
+	items, err := p.outline()
+	l.lintOutline(filename, items, err, defs)
+}
+
+// lintBlock tracks an open conditional block.
+type lintBlock struct {
+	start      outlineItem
+	conditions []*Expression  // The conditions of the arms so far.
+	cases      map[string]int // The line of each !case value so far, in a !switch block.
+	hasElse    bool           // An !else or !default has been seen.
+	empty      bool
+}
+
+// isSwitch returns true if the block was begun by !switch.
+func (b *lintBlock) isSwitch() bool {
+	return b.start.directive == DirectiveSwitch
+}
+
+// isIf returns true if the block was begun by !if, !ifdef or !ifndef.
+func (b *lintBlock) isIf() bool {
+	return isIfDirective(b.start.directive)
+}
+
+// endDirective returns the directive that ends a block.
+func endDirective(opener string) string {
+	switch opener {
+	case DirectiveSwitch:
+		return DirectiveEndswitch
+	case DirectiveFor:
+		return DirectiveEndfor
+	}
+	return DirectiveEndif
+}
+
+// lintOutline checks the structure and conditions of a single file.
+func (l *linter) lintOutline(filename string, items []outlineItem, err error, defs bool) {
+	if err != nil {
+		l.report(filename, errorLine(err), RuleSyntax, "%s", errorMessage(err))
+	}
+
+	var blocks []*lintBlock
+	var raw *outlineItem // The !raw block that hasn't been ended.
+	for _, item := range items {
+		if len(blocks) > 0 && (item.kind == ParseItemDirective || strings.TrimSpace(item.text) != "") {
+			switch item.directive {
+			case DirectiveElif, DirectiveElse, DirectiveEndif, DirectiveCase, DirectiveDefault, DirectiveEndswitch, DirectiveEndfor:
+			default:
+				block := blocks[len(blocks)-1]
+				block.empty = false
+				if block.isSwitch() && block.cases == nil && !block.hasElse {
+					l.report(filename, item.line, RuleUnreachableArm, "Lines before the first !case are never included")
+				}
+			}
+		}
+
+		if item.kind != ParseItemDirective {
+			for _, name := range listSymbols(item.substitutions) {
+				l.referenced[name] = append(l.referenced[name], symbolSite{filename, item.line})
+			}
+			continue
+		}
+
+		if defs && item.directive != DirectiveDefine && item.directive != DirectiveUndef {
+			l.report(filename, item.line, RuleSyntax, "Directives file may not contain !%s", item.directive)
+			continue
+		}
+
+		switch item.directive {
+		case DirectiveDefine:
+			l.known[item.symbol] = true
+			l.defined[item.symbol] = append(l.defined[item.symbol], symbolSite{filename, item.line})
+		case DirectiveUndef:
+			l.known[item.symbol] = true
+		case DirectiveIf, DirectiveIfdef, DirectiveIfndef, DirectiveSwitch, DirectiveFor:
+			l.reference(filename, item)
+			block := &lintBlock{start: item, empty: true}
+			switch item.directive {
+			case DirectiveSwitch:
+			case DirectiveFor:
+				// The variable is defined within the loop.
+				l.known[item.symbol] = true
+				for _, name := range listSymbols(item.list) {
+					l.referenced[name] = append(l.referenced[name], symbolSite{filename, item.line})
+				}
+			default:
+				l.checkCondition(filename, item, nil)
+				block.conditions = []*Expression{item.condition}
+			}
+
+			blocks = append(blocks, block)
+			if len(blocks) > l.maxDepth {
+				l.report(filename, item.line, RuleDeepNesting, "Conditional blocks are nested %d deep; the limit is %d", len(blocks), l.maxDepth)
+			}
+		case DirectiveCase, DirectiveDefault:
+			if len(blocks) == 0 || !blocks[len(blocks)-1].isSwitch() {
+				l.report(filename, item.line, RuleSyntax, "!%s without !switch", item.directive)
+				continue
+			}
+
+			block := blocks[len(blocks)-1]
+			if block.hasElse {
+				if item.directive == DirectiveDefault {
+					l.report(filename, item.line, RuleSyntax, "!default after !default")
+				} else {
+					l.report(filename, item.line, RuleUnreachableArm, "!case can't be reached; it follows !default")
+				}
+				continue
+			}
+
+			if item.directive == DirectiveDefault {
+				block.hasElse = true
+				continue
+			}
+
+			if block.cases == nil {
+				block.cases = make(map[string]int)
+			}
+			for _, value := range item.values {
+				if line, ok := block.cases[value]; ok {
+					l.report(filename, item.line, RuleDuplicateCase, "!case %s is already handled on line %d", quoteString(value), line)
+					continue
+				}
+				block.cases[value] = item.line
+			}
+		case DirectiveElif, DirectiveElse:
+			if len(blocks) == 0 {
+				l.report(filename, item.line, RuleSyntax, "!%s without !if", item.directive)
+				continue
+			}
+
+			block := blocks[len(blocks)-1]
+			if !block.isIf() {
+				l.report(filename, item.line, RuleSyntax, "!%s within !%s", item.directive, block.start.directive)
+				continue
+			}
+			if block.hasElse {
+				l.report(filename, item.line, RuleSyntax, "!%s after !else", item.directive)
+				continue
+			}
+
+			if item.directive == DirectiveElif {
+				l.reference(filename, item)
+				l.checkCondition(filename, item, block.conditions)
+				block.conditions = append(block.conditions, item.condition)
+			} else {
+				block.hasElse = true
+				if !satisfiable(nil, block.conditions) {
+					l.report(filename, item.line, RuleUnreachableArm, "!else can't be reached; earlier arms are always taken")
+				}
+			}
+		case DirectiveRaw:
+			start := item
+			raw = &start
+		case DirectiveEndraw:
+			if raw == nil {
+				l.report(filename, item.line, RuleSyntax, "!endraw without !raw")
+			}
+			raw = nil
+		case DirectiveEndif, DirectiveEndswitch, DirectiveEndfor:
+			if len(blocks) == 0 || endDirective(blocks[len(blocks)-1].start.directive) != item.directive {
+				opener := DirectiveIf
+				switch item.directive {
+				case DirectiveEndswitch:
+					opener = DirectiveSwitch
+				case DirectiveEndfor:
+					opener = DirectiveFor
+				}
+				l.report(filename, item.line, RuleSyntax, "!%s without !%s", item.directive, opener)
+				continue
+			}
+
+			block := blocks[len(blocks)-1]
+			if block.empty {
+				l.report(filename, block.start.line, RuleEmptyBlock, "Conditional block is empty")
+			}
+			blocks = blocks[:len(blocks)-1]
+		}
+	}
+
+	// Unterminated blocks are only reported when the whole file was parsed.
+	if err == nil {
+		for _, block := range blocks {
+			l.report(filename, block.start.line, RuleSyntax, "!%s without !%s", block.start.directive, endDirective(block.start.directive))
+		}
+		if raw != nil {
+			l.report(filename, raw.line, RuleSyntax, "!raw without !endraw")
+		}
+	}
+}
+
+// reference records the symbols referenced by a condition.
+func (l *linter) reference(filename string, item outlineItem) {
+	for _, name := range expressionSymbols(item.condition) {
+		l.referenced[name] = append(l.referenced[name], symbolSite{filename, item.line})
+	}
+}
+
+// checkCondition reports a condition that is constant, or an !elif that
+// can't be taken given the conditions of the earlier arms.
+func (l *linter) checkCondition(filename string, item outlineItem, previous []*Expression) {
+	if len(expressionAtoms(item.condition, nil)) == 0 {
+		// Literal conditions, such as !if false, are deliberate.
+		return
+	}
+
+	if len(expressionAtoms(item.condition, previous)) > maxLintAtoms {
+		return
+	}
+
+	canBeTrue := satisfiable(item.condition, nil)
+	canBeFalse := satisfiable(&Expression{ExpressionUnary, TokenNot, "", item.condition, nil, nil, 0}, nil)
+
+	switch {
+	case !canBeTrue:
+		l.report(filename, item.line, RuleConstantCondition, "!%s condition is always false", item.directive)
+	case !canBeFalse:
+		l.report(filename, item.line, RuleConstantCondition, "!%s condition is always true", item.directive)
+	case len(previous) > 0 && !satisfiable(item.condition, previous):
+		l.report(filename, item.line, RuleUnreachableArm, "!elif can't be reached; earlier arms cover its condition")
+	}
+}
+
+// checkSymbols reports symbols that are referenced but never defined, and
+// those defined but never referenced.
+func (l *linter) checkSymbols() {
+	for name, sites := range l.referenced {
+		if !l.known[name] {
+			for _, site := range sites {
+				l.report(site.filename, site.line, RuleUndefinedSymbol, "%s is never defined", name)
+			}
+		}
+	}
+
+	for name, sites := range l.defined {
+		if len(l.referenced[name]) == 0 {
+			for _, site := range sites {
+				l.report(site.filename, site.line, RuleUnusedSymbol, "%s is never referenced", name)
+			}
+		}
+	}
+}
+
+// finish removes suppressed diagnostics and sorts the rest.
+func (l *linter) finish() []Diagnostic {
+	lines := make(map[string][]string)
+	for _, d := range l.diagnostics {
+		if _, ok := lines[d.Filename]; !ok {
+			buffer, err := ioutil.ReadFile(d.Filename)
+			if err == nil {
+				lines[d.Filename] = splitLines(string(buffer))
+			} else {
+				lines[d.Filename] = nil
+			}
+		}
+	}
+
+	return l.filter(l.diagnostics, lines)
+}
+
+func (l *linter) filter(diagnostics []Diagnostic, lines map[string][]string) []Diagnostic {
+	var result []Diagnostic
+	for _, d := range diagnostics {
+		if !isSuppressed(lines[d.Filename], d.Line, d.Rule) {
+			result = append(result, d)
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Filename != result[j].Filename {
+			return result[i].Filename < result[j].Filename
+		}
+		return result[i].Line < result[j].Line
+	})
+
+	return result
+}
+
+// isSuppressed reports whether the rule is suppressed on a line, by a
+// marker on the same line or the line before.
+func isSuppressed(lines []string, line int, rule string) bool {
+	for _, n := range []int{line, line - 1} {
+		if n < 1 || n > len(lines) {
+			continue
+		}
+
+		i := strings.Index(lines[n-1], lintIgnoreMarker)
+		if i < 0 {
+			continue
+		}
+
+		rules := strings.FieldsFunc(lines[n-1][i+len(lintIgnoreMarker):], func(r rune) bool {
+			return r == ' ' || r == '\t' || r == ','
+		})
+
+		// Without rules, every rule is suppressed. Stop at anything that
+		// doesn't look like a rule, such as the end of a comment.
+		ids := 0
+		for _, id := range rules {
+			if !strings.HasPrefix(id, "TC") {
+				break
+			}
+			if id == rule {
+				return true
+			}
+			ids++
+		}
+
+		if ids == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitLines splits text into lines, ignoring a carriage return before
+// each line feed.
+func splitLines(text string) []string {
+	lines := strings.Split(text, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	return lines
+}
+
+// expressionSymbols returns the symbols referenced by an expression, in
+// order of first appearance, excluding the predefined symbols.
+func expressionSymbols(e *Expression) []string {
+	var symbols []string
+	seen := make(map[string]bool)
+
+	var visit func(e *Expression)
+	visit = func(e *Expression) {
+		if e == nil {
+			return
+		}
+		if e.kind == ExpressionIdentifier && e.identifier != "true" && e.identifier != "false" && !seen[e.identifier] {
+			seen[e.identifier] = true
+			symbols = append(symbols, e.identifier)
+		}
+		visit(e.left)
+		visit(e.right)
+		for _, argument := range e.arguments {
+			visit(argument)
+		}
+	}
+	visit(e)
+
+	return symbols
+}
+
+// atomKey identifies a symbol, element or function call whose value is
+// unknown to the truth table. Literals have no key.
+func atomKey(e *Expression) string {
+	switch e.kind {
+	case ExpressionIdentifier:
+		if e.identifier == "true" || e.identifier == "false" {
+			return ""
+		}
+		return e.identifier
+	case ExpressionCall, ExpressionIndex:
+		return formatCondition(e)
+	}
+	return ""
+}
+
+// expressionAtoms returns the distinct atoms of the expressions.
+func expressionAtoms(e *Expression, others []*Expression) []string {
+	var atoms []string
+	seen := make(map[string]bool)
+
+	var visit func(e *Expression)
+	visit = func(e *Expression) {
+		if e == nil {
+			return
+		}
+		if key := atomKey(e); key != "" {
+			if !seen[key] {
+				seen[key] = true
+				atoms = append(atoms, key)
+			}
+			return
+		}
+		visit(e.left)
+		visit(e.right)
+	}
+
+	visit(e)
+	for _, other := range others {
+		visit(other)
+	}
+
+	return atoms
+}
+
+// satisfiable reports whether there is an assignment of the atoms for which
+// e is true, or e is nil, and every one of excluded is false.
+func satisfiable(e *Expression, excluded []*Expression) bool {
+	atoms := expressionAtoms(e, excluded)
+	if len(atoms) > maxLintAtoms {
+		return true
+	}
+
+	assignment := make(map[string]bool)
+	for bits := 0; bits < 1<<uint(len(atoms)); bits++ {
+		for i, atom := range atoms {
+			assignment[atom] = bits&(1<<uint(i)) != 0
+		}
+
+		if e != nil && !evaluateAssignment(e, assignment) {
+			continue
+		}
+
+		found := true
+		for _, x := range excluded {
+			if evaluateAssignment(x, assignment) {
+				found = false
+				break
+			}
+		}
+
+		if found {
+			return true
+		}
+	}
+
+	return false
+}
+
+// evaluateAssignment evaluates an expression with the given atom values.
+func evaluateAssignment(e *Expression, assignment map[string]bool) bool {
+	if key := atomKey(e); key != "" {
+		return assignment[key]
+	}
+
+	switch e.kind {
+	case ExpressionIdentifier:
+		return e.identifier == "true"
+	case ExpressionUnary:
+		return !evaluateAssignment(e.left, assignment)
+	case ExpressionBinary:
+		if e.operator == TokenAnd {
+			return evaluateAssignment(e.left, assignment) && evaluateAssignment(e.right, assignment)
+		}
+		return evaluateAssignment(e.left, assignment) || evaluateAssignment(e.right, assignment)
+	case ExpressionGroup:
+		return evaluateAssignment(e.left, assignment)
+	}
+
+	return false
+}
@@ -0,0 +1,144 @@
+package pre
+
+import "testing"
+
+func TestLintConditions(t *testing.T) {
+	diagnostics := LintText("main.tft", `!if A && !A
+a
+!endif
+!if A || B
+ab
+!elif A
+unreachable
+!else
+other
+!endif
+!if A || !A
+always
+!else
+never
+!endif
+!if false
+disabled
+!endif
+`, 0)
+
+	lintExpect(t, diagnostics, []Diagnostic{
+		{"main.tft", 1, RuleConstantCondition, SeverityWarning, "!if condition is always false"},
+		{"main.tft", 6, RuleUnreachableArm, SeverityWarning, "!elif can't be reached; earlier arms cover its condition"},
+		{"main.tft", 11, RuleConstantCondition, SeverityWarning, "!if condition is always true"},
+		{"main.tft", 13, RuleUnreachableArm, SeverityWarning, "!else can't be reached; earlier arms are always taken"},
+	})
+}
+
+func TestLintStructure(t *testing.T) {
+	diagnostics := LintText("main.tft", `!if A
+
+!elif B
+!endif
+!if A
+ !if B
+  !if C
+   !if D
+d
+   !endif
+  !endif
+ !endif
+!endif
+!else
+!if E
+`, 3)
+
+	lintExpect(t, diagnostics, []Diagnostic{
+		{"main.tft", 1, RuleEmptyBlock, SeverityWarning, "Conditional block is empty"},
+		{"main.tft", 8, RuleDeepNesting, SeverityInfo, "Conditional blocks are nested 4 deep; the limit is 3"},
+		{"main.tft", 14, RuleSyntax, SeverityError, "!else without !if"},
+		{"main.tft", 15, RuleSyntax, SeverityError, "!if without !endif"},
+	})
+}
+
+func TestLintSwitch(t *testing.T) {
+	diagnostics := LintText("main.tft", `!define ENV
+!switch ENV
+before
+!case "prod", "staging"
+a
+!case "dev", "prod"
+b
+!elif A
+!default
+c
+!case "test"
+!default
+!endif
+!endswitch
+!case "x"
+!switch ENV
+`, 3)
+
+	lintExpect(t, diagnostics, []Diagnostic{
+		{"main.tft", 3, RuleUnreachableArm, SeverityWarning, "Lines before the first !case are never included"},
+		{"main.tft", 6, RuleDuplicateCase, SeverityError, "!case \"prod\" is already handled on line 4"},
+		{"main.tft", 8, RuleSyntax, SeverityError, "!elif within !switch"},
+		{"main.tft", 11, RuleUnreachableArm, SeverityWarning, "!case can't be reached; it follows !default"},
+		{"main.tft", 12, RuleSyntax, SeverityError, "!default after !default"},
+		{"main.tft", 13, RuleSyntax, SeverityError, "!endif without !if"},
+		{"main.tft", 15, RuleSyntax, SeverityError, "!case without !switch"},
+		{"main.tft", 16, RuleSyntax, SeverityError, "!switch without !endswitch"},
+	})
+}
+
+func TestLintLoop(t *testing.T) {
+	diagnostics := LintText("main.tft", `!for REGION in "a", REGIONS
+!if REGION
+!elif B
+!endif
+!endswitch
+!endfor
+!for X in "a"
+!endfor
+!for Y in "b"
+!else
+!endif
+`, 3)
+
+	lintExpect(t, diagnostics, []Diagnostic{
+		{"main.tft", 2, RuleEmptyBlock, SeverityWarning, "Conditional block is empty"},
+		{"main.tft", 5, RuleSyntax, SeverityError, "!endswitch without !switch"},
+		{"main.tft", 7, RuleEmptyBlock, SeverityWarning, "Conditional block is empty"},
+		{"main.tft", 9, RuleSyntax, SeverityError, "!for without !endfor"},
+		{"main.tft", 10, RuleSyntax, SeverityError, "!else within !for"},
+		{"main.tft", 11, RuleSyntax, SeverityError, "!endif without !if"},
+	})
+}
+
+func TestLintSuppression(t *testing.T) {
+	diagnostics := LintText("main.tft", `# terracotta:ignore TC004
+!if A && !A
+!endif # terracotta:ignore TC001
+!if A && !A # terracotta:ignore
+a
+!endif
+!if A && !A # terracotta:ignore TC006
+a
+!endif
+`, 0)
+
+	lintExpect(t, diagnostics, []Diagnostic{
+		{"main.tft", 2, RuleEmptyBlock, SeverityWarning, "Conditional block is empty"},
+		{"main.tft", 7, RuleConstantCondition, SeverityWarning, "!if condition is always false"},
+	})
+}
+
+func lintExpect(t *testing.T, diagnostics []Diagnostic, expected []Diagnostic) {
+	if len(diagnostics) != len(expected) {
+		t.Errorf("Expected %d diagnostics but received %d: %v", len(expected), len(diagnostics), diagnostics)
+		return
+	}
+
+	for i := range expected {
+		if diagnostics[i] != expected[i] {
+			t.Errorf("Expected diagnostic '%s' but received '%s'", expected[i], diagnostics[i])
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package pre
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// DefaultMaxIterations limits the iterations of the !for loops in a file,
+// including those of nested loops, unless the parser sets another limit.
+const DefaultMaxIterations = 1000
+
+// loopState is the progress of a !for loop. The body is repeated by
+// returning the scanner to the line following the !for.
+type loopState struct {
+	name   string
+	list   []*Expression
+	values []Value
+	index  int
+	start  Scanner
+	line   int    // The line of the !for.
+	origin string // The origin of the variable.
+}
+
+// SetMaxIterations limits the iterations of the !for loops in each file,
+// counting those of nested loops. Zero uses DefaultMaxIterations.
+func (p *Parser) SetMaxIterations(max int) {
+	p.maxIterations = max
+}
+
+// parseLoopList parses the elements of a !for following 'in'. Each is a
+// quoted string, a bare word as in the value of a !define, or a symbol or
+// element of a map whose value is a list, separated by commas.
+func (p *Parser) parseLoopList() ([]*Expression, error) {
+	var list []*Expression
+	for {
+		if word, ok := p.scanner.ScanWord(); ok {
+			list = append(list, &Expression{ExpressionString, TokenNone, word, nil, nil, nil, 0})
+			if done, err := p.parseLoopSeparator(); done || err != nil {
+				return list, err
+			}
+			continue
+		}
+
+		token, text, err := p.scanner.Scan()
+		if err != nil {
+			return nil, err
+		}
+
+		switch token {
+		case TokenString:
+			list = append(list, &Expression{ExpressionString, TokenNone, text, nil, nil, nil, 0})
+		case TokenIdentifier:
+			column := p.scanner.Column()
+			e, err := p.parseSymbolArgument(text, column, TypeValue)
+			if err != nil {
+				return nil, err
+			}
+			if e.kind == ExpressionIdentifier {
+				e.column = column
+			}
+			list = append(list, &e)
+		default:
+			return nil, SyntaxError{"!for expects words, quoted strings or list symbols", p.scanner.Line(), p.scanner.Column(), SyntaxErrorInvalidArgument}
+		}
+
+		if done, err := p.parseLoopSeparator(); done || err != nil {
+			return list, err
+		}
+	}
+}
+
+// parseLoopSeparator eats the comma that follows an element of a !for list,
+// and returns true if there isn't one, since the list has ended.
+func (p *Parser) parseLoopSeparator() (bool, error) {
+	token, _, err := p.scanner.Peek()
+	if err != nil {
+		return true, err
+	}
+	if token != TokenComma {
+		return true, p.scanner.Push()
+	}
+	p.scanner.Scan() // Eat the ,
+	return false, nil
+}
+
+// parseLoopHeader parses the variable and list of a !for.
+func (p *Parser) parseLoopHeader() (string, []*Expression, error) {
+	token, name, err := p.scanner.Scan()
+	if err != nil {
+		return "", nil, err
+	}
+	if token != TokenIdentifier {
+		return "", nil, SyntaxError{"!for expected an identifier", p.scanner.Line(), 0, SyntaxErrorExpectedIdentifier}
+	}
+
+	token, text, err := p.scanner.Scan()
+	if err != nil {
+		return "", nil, err
+	}
+	if token != TokenIdentifier || text != "in" {
+		return "", nil, SyntaxError{"!for expected 'in' after the variable", p.scanner.Line(), p.scanner.Column(), SyntaxErrorInvalidExpression}
+	}
+
+	list, err := p.parseLoopList()
+	return name, list, err
+}
+
+// listSymbols returns the symbols in a !for list.
+func listSymbols(list []*Expression) []string {
+	var names []string
+	for _, e := range list {
+		names = append(names, expressionSymbols(e)...)
+	}
+	return names
+}
+
+// formatLoop returns the parameters of a !for in canonical syntax.
+func formatLoop(name string, list []*Expression) string {
+	var buffer bytes.Buffer
+	buffer.WriteString(name)
+	buffer.WriteString(" in ")
+	for i, e := range list {
+		if i > 0 {
+			buffer.WriteString(", ")
+		}
+		writeExpression(&buffer, e)
+	}
+	return buffer.String()
+}
+
+// parseFor begins a block that's repeated for each element of a list, with
+// the variable bound to the element in a namespace of its own. Symbols
+// defined in the block are local to each iteration.
+func (p *Parser) parseFor() error {
+	if p.verbose {
+		fmt.Printf("parseFor\n")
+	}
+
+	name, list, err := p.parseLoopHeader()
+	if err != nil {
+		return err
+	}
+
+	err = p.checkSymbol(name)
+	if err != nil {
+		return err
+	}
+
+	err = p.expectDirectiveEnd(DirectiveFor)
+	if err != nil {
+		return err
+	}
+
+	p.context.enterBranch()
+
+	// A loop that isn't reached is scanned once, without evaluating it.
+	var values []Value
+	if p.IsActive() {
+		values, err = p.context.evaluateList(list)
+		if pe, ok := err.(ProcessingError); ok {
+			pe.line = p.scanner.Line()
+			return pe
+		}
+	}
+	if p.context.verbose {
+		fmt.Printf("!for %s %d\n", name, len(values))
+	}
+
+	loop := &loopState{name, list, values, 0, p.scanner, p.scanner.Line(), p.definitionOrigin()}
+	p.context.scope().loop = loop
+	p.context.takeBranch(len(values) > 0)
+	p.context.pushNamespace()
+
+	return p.beginIteration(loop)
+}
+
+func (p *Parser) parseEndFor() error {
+	if p.verbose {
+		fmt.Printf("parseEndFor\n")
+	}
+
+	err := p.expectDirectiveEnd(DirectiveEndfor)
+	if err != nil {
+		return err
+	}
+
+	if len(p.context.scopeStack) < 2 || p.context.scope().loop == nil {
+		return SyntaxError{"!endfor without !for", p.scanner.Line(), 0, SyntaxErrorInvalidDirective}
+	}
+
+	loop := p.context.scope().loop
+	p.context.leaveNamespace()
+
+	if loop.index+1 < len(loop.values) {
+		loop.index++
+		p.context.pushNamespace()
+
+		// The scanner is returned to the body once the !endfor is parsed.
+		start := loop.start
+		p.repeat = &start
+		return p.beginIteration(loop)
+	}
+
+	p.context.leaveBranch()
+
+	return nil
+}
+
+// beginIteration binds the loop variable to the current element, counting
+// the iteration against the limit.
+func (p *Parser) beginIteration(loop *loopState) error {
+	if loop.index >= len(loop.values) {
+		p.context.explainLoop(loop)
+		return nil
+	}
+
+	max := p.maxIterations
+	if max <= 0 {
+		max = DefaultMaxIterations
+	}
+	p.iterations++
+	if p.iterations > max {
+		message := fmt.Sprintf("!for loops exceeded the limit of %d iterations", max)
+		return ProcessingError{message, loop.line, 0, ProcessingErrorIterationLimit}
+	}
+
+	p.context.defineValue(loop.name, loop.values[loop.index], loop.origin)
+	p.context.explainLoop(loop)
+
+	return nil
+}
+
+// pushNamespace adds a namespace for the variable of a !for loop, without
+// leaving the current conditional blocks.
+func (c *parserContext) pushNamespace() {
+	c.nameStack = append(c.nameStack, *newNameTable())
+}
+
+// evaluateList returns the elements of a !for list. A list contributes its
+// elements and a map its keys, while any other value is split at commas. A
+// symbol or element that isn't defined has no elements.
+func (c *parserContext) evaluateList(list []*Expression) ([]Value, error) {
+	var values []Value
+	for _, e := range list {
+		if e.kind == ExpressionString {
+			values = append(values, StringValue(e.identifier))
+			continue
+		}
+
+		value, defined, err := c.evaluateSubject(e)
+		if err != nil {
+			return nil, err
+		}
+		if !defined {
+			continue
+		}
+
+		switch value.Kind() {
+		case ValueList:
+			values = append(values, value.Elements()...)
+		case ValueMap:
+			for _, key := range value.Keys() {
+				values = append(values, StringValue(key))
+			}
+		default:
+			for _, element := range strings.Split(value.String(), ",") {
+				if element = strings.TrimSpace(element); element != "" {
+					values = append(values, StringValue(element))
+				}
+			}
+		}
+	}
+	return values, nil
+}
+
+// explainLoop records the current iteration of a !for loop when explaining,
+// or the symbols of its list if it has no elements.
+func (c *parserContext) explainLoop(loop *loopState) {
+	if !c.explain || len(c.scopeStack) < 2 {
+		return
+	}
+
+	iterating := loop.index < len(loop.values)
+	arm := ExplainArm{Directive: DirectiveFor, Line: loop.line, Condition: formatLoop(loop.name, loop.list), Evaluated: true, Result: iterating, Taken: iterating}
+	if iterating {
+		arm.Symbols = c.explainSymbols(&Expression{ExpressionIdentifier, TokenNone, loop.name, nil, nil, nil, 0})
+	} else {
+		for _, e := range loop.list {
+			if e.kind != ExpressionString {
+				arm.Symbols = append(arm.Symbols, c.explainSymbols(e)...)
+			}
+		}
+	}
+
+	// Each iteration replaces the last.
+	c.scope().arms = []ExplainArm{arm}
+}
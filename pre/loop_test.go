@@ -0,0 +1,173 @@
+package pre
+
+import (
+	"strings"
+	"testing"
+)
+
+// loopExpect parses text with the symbols defined and compares the active
+// lines.
+func loopExpect(t *testing.T, defines map[string]string, text string, expected string) {
+	t.Helper()
+
+	p := Parser{}
+	p.SetText(text)
+	p.Enter()
+	for name, value := range defines {
+		p.DefineValue(name, StringValue(value))
+	}
+
+	var lines []string
+	err := p.ParseLines(func(line string, number int) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if actual := strings.Join(lines, ","); actual != expected {
+		t.Errorf("Expected '%s' but received '%s'", expected, actual)
+	}
+}
+
+func TestLoop(t *testing.T) {
+	text := `a
+!for REGION in "us-east-1", REGIONS
+!if matches(REGION, "^us-")
+us
+!else
+other
+!endif
+!endfor
+b`
+
+	loopExpect(t, nil, text, "a,us,b")
+	loopExpect(t, map[string]string{"REGIONS": "eu-west-1, us-west-2"}, text, "a,us,other,us,b")
+
+	// A loop with no elements, or that isn't reached, is skipped.
+	loopExpect(t, map[string]string{"REGIONS": ""}, "!for R in REGIONS\nx\n!endfor\ny", "y")
+	loopExpect(t, nil, "!if false\n!for R in \"a\"\nx\n!endfor\n!endif\ny", "y")
+}
+
+func TestLoopWords(t *testing.T) {
+	// Bare words are strings, as in the value of a !define, while symbols,
+	// elements and calls are evaluated.
+	text := `!define R us-east-1
+!for REGION in us-east-1, us-west-2 # Comment
+!{REGION}
+!endfor
+!for X in 1, eu-west-1/a,"q", R, lower(NAME), a.b /* Comment */
+!{X}
+!endfor`
+
+	loopExpect(t, map[string]string{"NAME": "N"}, text, "us-east-1,us-west-2,1,eu-west-1/a,q,us-east-1,n,a.b")
+
+	// The list is formatted with the words quoted.
+	formatExpect(t, 0, "!for REGION in us-east-1,  us-west-2\n!endfor\n", "!for REGION in \"us-east-1\", \"us-west-2\"\n!endfor\n")
+
+	for _, text := range []string{"!for X in us-east-1 us-west-2\n!endfor\n", "!for X in a, !b\n!endfor\n"} {
+		p := Parser{}
+		p.SetText(text)
+		p.Enter()
+		if err := p.ParseLines(func(string, int) {}); err == nil {
+			t.Errorf("Expected an error for %q", text)
+		}
+	}
+}
+
+func TestLoopNesting(t *testing.T) {
+	text := `!for A in "1", "2"
+!for B in "x", "y"
+!switch B
+!case "x"
+!if contains(A, "1")
+one
+!else
+two
+!endif
+!default
+y
+!endswitch
+!endfor
+!endfor`
+
+	loopExpect(t, nil, text, "one,y,two,y")
+}
+
+func TestLoopNamespace(t *testing.T) {
+	// The variable and the symbols defined in the body are local to each
+	// iteration, and the variable hides a symbol of the same name.
+	text := `!for X in "a", "b"
+!if defined(SEEN)
+seen
+!endif
+!define SEEN
+!endfor
+!if defined(SEEN)
+after
+!endif
+!if matches(X, "^outer$")
+outer
+!endif`
+
+	loopExpect(t, map[string]string{"X": "outer"}, text, "outer")
+}
+
+func TestLoopLines(t *testing.T) {
+	p := Parser{}
+	p.SetText("!for X in \"a\", \"b\"\nx\n!endfor\ny\n")
+	p.Enter()
+
+	var numbers []int
+	err := p.ParseLines(func(line string, number int) {
+		numbers = append(numbers, number)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(numbers) != 3 || numbers[0] != 2 || numbers[1] != 2 || numbers[2] != 4 {
+		t.Errorf("Unexpected line numbers %v", numbers)
+	}
+}
+
+func TestLoopIterationLimit(t *testing.T) {
+	p := Parser{}
+	p.SetMaxIterations(5)
+	p.SetText("!for A in \"1\", \"2\"\n!for B in \"1\", \"2\", \"3\"\n!endfor\n!endfor\n")
+	p.Enter()
+
+	err := p.ParseLines(func(string, int) {})
+	pe, ok := err.(ProcessingError)
+	if !ok || pe.Kind() != ProcessingErrorIterationLimit || pe.Line() != 2 {
+		t.Errorf("Expected the iteration limit on line 2 but received %v", err)
+	}
+}
+
+func TestLoopErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		kind SyntaxErrorKind
+	}{
+		{"!endfor\n", SyntaxErrorInvalidDirective},
+		{"!for X in \"a\"\n!endif\n", SyntaxErrorInvalidDirective},
+		{"!for X in \"a\"\n!else\n", SyntaxErrorInvalidDirective},
+		{"!if A\n!endfor\n", SyntaxErrorInvalidDirective},
+		{"!for \"a\"\n", SyntaxErrorExpectedIdentifier},
+		{"!for X of \"a\"\n", SyntaxErrorInvalidExpression},
+		{"!for X in\n", SyntaxErrorInvalidArgument},
+		{"!for true in \"a\"\n", SyntaxErrorPredefinedSymbol},
+	}
+
+	for _, test := range tests {
+		p := Parser{}
+		p.SetText(test.text)
+		p.Enter()
+
+		err := p.ParseLines(func(string, int) {})
+		se, ok := err.(SyntaxError)
+		if !ok || se.Kind() != test.kind {
+			t.Errorf("Expected a syntax error of kind %d for %q but received %v", test.kind, test.text, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package pre
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MaxMatrixSymbols limits the size of a matrix, which doubles with each
+// symbol.
+const MaxMatrixSymbols = 12
+
+// MatrixCombination is the result of rendering the source directory with
+// one combination of the matrix symbols.
+type MatrixCombination struct {
+	// Defined lists the matrix symbols that were defined.
+	Defined []string
+	// Undefined lists the matrix symbols that were undefined.
+	Undefined []string
+	// Files holds the generated files, keyed by their slash separated path
+	// relative to the source directory.
+	Files map[string]string
+	// Err is the error that stopped rendering, such as an !error directive.
+	Err error
+}
+
+// Name identifies the combination by its defined symbols, such as
+// "SSL+RDS", or "none" if no symbols are defined.
+func (c *MatrixCombination) Name() string {
+	if len(c.Defined) == 0 {
+		return "none"
+	}
+	return strings.Join(c.Defined, "+")
+}
+
+// MatrixFile describes how a generated file varies across the matrix.
+type MatrixFile struct {
+	Filename string
+	// Variants groups the names of the combinations that generated
+	// identical output.
+	Variants [][]string
+}
+
+// MatrixSummary describes the differences between combinations.
+type MatrixSummary struct {
+	Files []MatrixFile
+	// Failed lists the names of the combinations that failed.
+	Failed []string
+	// Unused lists the matrix symbols that never affect the output.
+	Unused []string
+}
+
+// RenderMatrix renders the source directory once for every combination of
+// the matrix symbols being defined or undefined. The matrix symbols are
+// applied after the other command-line definitions. Combinations are
+// ordered so that bit i of a combination's index is set if symbols[i] is
+// defined.
+func (p *Preprocessor) RenderMatrix(source string, symbols []string, defines []string, undefs []string) ([]MatrixCombination, error) {
+	if len(symbols) > MaxMatrixSymbols {
+		return nil, fmt.Errorf("A matrix may not have more than %d symbols", MaxMatrixSymbols)
+	}
+
+	count := 1 << uint(len(symbols))
+	combinations := make([]MatrixCombination, count)
+	for i := 0; i < count; i++ {
+		c := &combinations[i]
+		for j, symbol := range symbols {
+			if i&(1<<uint(j)) != 0 {
+				c.Defined = append(c.Defined, symbol)
+			} else {
+				c.Undefined = append(c.Undefined, symbol)
+			}
+		}
+
+		// Each combination gets a fresh parser, since a failed render may
+		// leave namespaces open.
+		r := *p
+		r.parser = p.parser.configured()
+		r.exclude = append([]ignorePattern(nil), p.exclude...)
+
+		combinationDefines := append(append([]string(nil), defines...), c.Defined...)
+		combinationUndefs := append(append([]string(nil), undefs...), c.Undefined...)
+		c.Files, c.Err = r.RenderDirectory(source, combinationDefines, combinationUndefs)
+	}
+
+	return combinations, nil
+}
+
+// SummarizeMatrix compares the output of the combinations returned by
+// RenderMatrix for the given symbols. Failed combinations are excluded
+// from the comparison.
+func SummarizeMatrix(symbols []string, combinations []MatrixCombination) MatrixSummary {
+	summary := MatrixSummary{}
+
+	files := make(map[string]bool)
+	for i := range combinations {
+		c := &combinations[i]
+		if c.Err != nil {
+			summary.Failed = append(summary.Failed, c.Name())
+			continue
+		}
+		for filename := range c.Files {
+			files[filename] = true
+		}
+	}
+
+	var filenames []string
+	for filename := range files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		file := MatrixFile{Filename: filename}
+		variants := make(map[string]int)
+		for i := range combinations {
+			c := &combinations[i]
+			if c.Err != nil {
+				continue
+			}
+
+			text, ok := c.Files[filename]
+			if !ok {
+				// Distinguish a missing file from an empty one.
+				text = "\x00"
+			}
+
+			index, found := variants[text]
+			if !found {
+				index = len(file.Variants)
+				variants[text] = index
+				file.Variants = append(file.Variants, nil)
+			}
+			file.Variants[index] = append(file.Variants[index], c.Name())
+		}
+		summary.Files = append(summary.Files, file)
+	}
+
+	// A symbol is unused if toggling it never changes the output.
+	for j, symbol := range symbols {
+		bit := 1 << uint(j)
+		used := false
+		for i := 0; i < len(combinations) && !used; i++ {
+			if i&bit != 0 || i|bit >= len(combinations) {
+				continue
+			}
+
+			off, on := &combinations[i], &combinations[i|bit]
+			if off.Err == nil && on.Err == nil && !sameFiles(off.Files, on.Files) {
+				used = true
+			}
+		}
+
+		if !used {
+			summary.Unused = append(summary.Unused, symbol)
+		}
+	}
+
+	return summary
+}
+
+func sameFiles(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for filename, text := range a {
+		if other, ok := b[filename]; !ok || other != text {
+			return false
+		}
+	}
+
+	return true
+}
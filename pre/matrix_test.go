@@ -0,0 +1,112 @@
+package pre
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// matrixSource returns a temporary source directory holding a template,
+// which the caller removes.
+func matrixSource(t *testing.T, template string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "terracotta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.tft"), []byte(template), 0666); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// matrixExpect renders a template for every combination of the symbols,
+// and checks the output of each combination, in order.
+func matrixExpect(t *testing.T, p *Preprocessor, template string, symbols []string, expected []string) {
+	t.Helper()
+
+	dir := matrixSource(t, template)
+	defer os.RemoveAll(dir)
+
+	combinations, err := p.RenderMatrix(dir, symbols, nil, nil)
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+	if len(combinations) != len(expected) {
+		t.Fatalf("Expected %d combinations but received %d", len(expected), len(combinations))
+	}
+
+	for i, c := range combinations {
+		if c.Err != nil {
+			t.Errorf("Unexpected error for %s: %v", c.Name(), c.Err)
+		} else if text := c.Files["main.tf"]; text != expected[i] {
+			t.Errorf("Expected %q for %s but received %q", expected[i], c.Name(), text)
+		}
+	}
+}
+
+func TestMatrixResolver(t *testing.T) {
+	// Each combination uses the preprocessor's resolver.
+	p := Preprocessor{}
+	p.SetResolver(MapResolver{"REGION": StringValue("us-west-2")})
+	matrixExpect(t, &p, "!if REGION\nregion\n!endif\n!if SSL\nssl\n!endif\n", []string{"SSL"}, []string{"region\n", "region\nssl\n"})
+}
+
+func TestMatrixDirective(t *testing.T) {
+	// Custom directives are handled in each combination, which also records
+	// coverage.
+	coverage := NewCoverage()
+	p := Preprocessor{}
+	p.SetCoverage(coverage)
+	p.RegisterDirective("owner", func(params []DirectiveToken, active bool, emit Emitter) error {
+		emit("# Owner: infra")
+		return nil
+	})
+	matrixExpect(t, &p, "!owner\n!if SSL\nssl\n!endif\n", []string{"SSL"}, []string{"# Owner: infra\n", "# Owner: infra\nssl\n"})
+
+	blocks := coverage.Blocks()
+	if len(blocks) != 1 || blocks[0].Reached != 2 || blocks[0].Arms[0].Taken != 1 {
+		t.Errorf("Expected the !if to be reached twice and taken once but received %v", blocks)
+	}
+}
+
+func TestMatrixStrict(t *testing.T) {
+	dir := matrixSource(t, "a\n!if ENV\nb\n!endif\n")
+	defer os.RemoveAll(dir)
+
+	// Every combination is rendered in strict mode, so a valued symbol used
+	// as a condition is an error.
+	p := Preprocessor{}
+	p.SetStrict(true)
+	combinations, err := p.RenderMatrix(dir, []string{"SSL"}, []string{"ENV=prod"}, nil)
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+	for _, c := range combinations {
+		if c.Err == nil || !strings.Contains(c.Err.Error(), "isn't Boolean") {
+			t.Errorf("Expected a valued symbol error for %s but received %v", c.Name(), c.Err)
+		}
+	}
+}
+
+func TestMatrixMaxIterations(t *testing.T) {
+	dir := matrixSource(t, "!for X in \"a\", \"b\", \"c\"\nx\n!endfor\n")
+	defer os.RemoveAll(dir)
+
+	// The loop limit applies to every combination.
+	p := Preprocessor{}
+	p.SetMaxIterations(2)
+	combinations, err := p.RenderMatrix(dir, []string{"SSL"}, nil, nil)
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+	for _, c := range combinations {
+		if c.Err == nil {
+			t.Errorf("Expected the loop limit to stop %s", c.Name())
+		}
+	}
+}
@@ -1,30 +1,49 @@
 package pre
 
+type nameEntry struct {
+	defined bool
+	value   Value
+	origin  string // Where the symbol was defined or undefined.
+}
+
 type nameTable struct {
-	names map[string]bool
+	names map[string]nameEntry
 }
 
 func newNameTable() *nameTable {
 	t := new(nameTable)
-	t.names = make(map[string]bool)
+	t.names = make(map[string]nameEntry)
 	return t
 }
 
-func (t *nameTable) define(name string) {
-	t.names[name] = true
+func (t *nameTable) define(name string, origin string) {
+	t.names[name] = nameEntry{true, Value{}, origin}
+}
+
+func (t *nameTable) defineValue(name string, value Value, origin string) {
+	t.names[name] = nameEntry{true, value, origin}
 }
 
-func (t *nameTable) undef(name string) {
-	// delete(t.names, name)
-	t.names[name] = true
+func (t *nameTable) undef(name string, origin string) {
+	// Record the undef, rather than deleting the name, so that it hides
+	// definitions in enclosing namespaces.
+	t.names[name] = nameEntry{false, Value{}, origin}
 }
 
 func (t *nameTable) defined(name string) bool {
-	defined, exists := t.names[name]
-	return exists && defined
+	entry, exists := t.names[name]
+	return exists && entry.defined
 }
 
 func (t *nameTable) exists(name string) bool {
 	_, exists := t.names[name]
 	return exists
 }
+
+func (t *nameTable) value(name string) Value {
+	return t.names[name].value
+}
+
+func (t *nameTable) origin(name string) string {
+	return t.names[name].origin
+}
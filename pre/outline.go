@@ -0,0 +1,159 @@
+package pre
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// outlineItem is a line of a template with any directive parsed, but not
+// evaluated. An outline describes the structure of a template regardless
+// of which symbols are defined.
+type outlineItem struct {
+	kind      ParseItemKind
+	line      int
+	text      string        // The text of a text line, the message of !error, or the parameters of a custom directive.
+	directive string        // The directive name.
+	symbol    string        // The symbol of !define, !undef, !ifdef or !ifndef, or the variable of !for.
+	value     Value         // The value of !define, if it has one.
+	condition *Expression   // The condition of !if or !elif, its equivalent for !ifdef and !ifndef, or the value of !switch.
+	values    []string      // The values of !case.
+	list      []*Expression // The list of !for.
+	// The expressions substituted into a text line.
+	substitutions []*Expression
+}
+
+// outline parses every line of the current file or text without evaluating
+// directives. On error, the items parsed so far are returned with the
+// error.
+func (p *Parser) outline() ([]outlineItem, error) {
+	var items []outlineItem
+	for {
+		raw := p.scanner.state == scanStateInit && p.scanner.raw.active()
+		token, text, err := p.scanner.Scan()
+		if err != nil {
+			return items, err
+		}
+
+		switch token {
+		case TokenText:
+			item := outlineItem{kind: ParseItemText, line: p.scanner.Line(), text: text}
+			if !raw {
+				substitutions, err := parseSubstitutions(text, item.line)
+				if err != nil {
+					return items, err
+				}
+				for i := range substitutions {
+					item.substitutions = append(item.substitutions, &substitutions[i].expression)
+				}
+			}
+			items = append(items, item)
+		case TokenDirective:
+			item, err := p.outlineDirective(text)
+			if err != nil {
+				return items, err
+			}
+			items = append(items, item)
+		case TokenEnd:
+			return items, nil
+		default:
+			return items, SyntaxError{"Unexpected line expression", p.scanner.Line(), 0, SyntaxErrorInvalidExpression}
+		}
+	}
+}
+
+// definedCondition returns the condition equivalent to !ifdef, or with
+// negate, !ifndef.
+func definedCondition(symbol string, column int, negate bool) *Expression {
+	argument := &Expression{ExpressionIdentifier, TokenNone, symbol, nil, nil, nil, 0}
+	call := &Expression{ExpressionCall, TokenNone, FunctionDefined, nil, nil, []*Expression{argument}, column}
+	if negate {
+		return &Expression{ExpressionUnary, TokenNot, "", call, nil, nil, 0}
+	}
+	return call
+}
+
+func (p *Parser) outlineDirective(directive string) (outlineItem, error) {
+	item := outlineItem{kind: ParseItemDirective, directive: directive}
+
+	switch directive {
+	case DirectiveDefine, DirectiveUndef:
+		token, text, err := p.scanner.Scan()
+		if err != nil {
+			return item, err
+		}
+		if token != TokenIdentifier {
+			message := fmt.Sprintf("!%s expected an identifier", directive)
+			return item, SyntaxError{message, p.scanner.Line(), 0, SyntaxErrorExpectedIdentifier}
+		}
+		item.symbol = text
+		if directive == DirectiveDefine {
+			item.value, err = p.parseDefineRest(text)
+			if err != nil {
+				return item, err
+			}
+		}
+	case DirectiveIfdef, DirectiveIfndef:
+		token, text, err := p.scanner.Scan()
+		if err != nil {
+			return item, err
+		}
+		if token != TokenIdentifier {
+			message := fmt.Sprintf("!%s expected an identifier", directive)
+			return item, SyntaxError{message, p.scanner.Line(), 0, SyntaxErrorExpectedIdentifier}
+		}
+		item.symbol = text
+		item.condition = definedCondition(text, p.scanner.Column(), directive == DirectiveIfndef)
+	case DirectiveIf, DirectiveElif:
+		expression, err := p.parseExpression()
+		if err != nil {
+			return item, err
+		}
+		item.condition = &expression
+	case DirectiveSwitch:
+		expression, err := p.parseSwitchSubject()
+		if err != nil {
+			return item, err
+		}
+		item.condition = &expression
+	case DirectiveCase:
+		values, err := p.parseCaseValues()
+		if err != nil {
+			return item, err
+		}
+		item.values = values
+	case DirectiveFor:
+		name, list, err := p.parseLoopHeader()
+		if err != nil {
+			return item, err
+		}
+		item.symbol = name
+		item.list = list
+	case DirectiveElse, DirectiveEndif, DirectiveDefault, DirectiveEndswitch, DirectiveEndfor, DirectiveRaw, DirectiveEndraw, DirectiveHeredoc:
+		// No parameters
+	case DirectiveError:
+		message, err := p.scanner.ScanRest()
+		if err != nil {
+			return item, err
+		}
+		if unquoted, err := strconv.Unquote(message); err == nil {
+			message = unquoted
+		}
+		item.text = message
+	default:
+		if _, ok := p.directives[directive]; ok {
+			// The parameters of a custom directive are left to its handler.
+			text, err := p.scanner.ScanRest()
+			if err != nil {
+				return item, err
+			}
+			item.text = text
+			break
+		}
+		message := fmt.Sprintf("Unrecognized directive %s", directive)
+		return item, SyntaxError{message, p.scanner.Line(), 0, SyntaxErrorUnrecognizedDirective}
+	}
+
+	err := p.expectDirectiveEnd(directive)
+	item.line = p.scanner.Line()
+	return item, err
+}
@@ -1,28 +1,114 @@
 package pre
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+)
 
 const (
 	DirectiveDefine = "define"
 	DirectiveUndef  = "undef"
 	DirectiveIf     = "if"
+	DirectiveIfdef  = "ifdef"
+	DirectiveIfndef = "ifndef"
 	DirectiveElif   = "elif"
 	DirectiveElse   = "else"
 	DirectiveEndif  = "endif"
+	DirectiveError  = "error"
+
+	DirectiveSwitch    = "switch"
+	DirectiveCase      = "case"
+	DirectiveDefault   = "default"
+	DirectiveEndswitch = "endswitch"
+
+	DirectiveFor    = "for"
+	DirectiveEndfor = "endfor"
+
+	DirectiveRaw     = "raw"
+	DirectiveEndraw  = "endraw"
+	DirectiveHeredoc = "heredoc"
 )
 
 type Parser struct {
-	scanner Scanner
-	context parserContext
-	verbose bool
+	scanner       Scanner
+	context       parserContext
+	filename      string
+	origin        string
+	directives    map[string]DirectiveHandler
+	pending       []string // Lines emitted by a custom directive.
+	emitted       bool     // The last line of text was emitted by a custom directive.
+	substituted   bool     // The last line of text differs from the template, due to substitution.
+	repeat        *Scanner // The start of a !for body to repeat.
+	iterations    int      // The iterations of !for loops in the current file.
+	maxIterations int
+	inRaw         bool // A !raw block hasn't been ended.
+	verbose       bool
 }
 
 func (p *Parser) SetFile(name string) {
+	p.filename = name
 	p.scanner.SetFile(name)
+	p.repeat = nil
+	p.iterations = 0
+	p.inRaw = false
 }
 
 func (p *Parser) SetText(text string) {
+	p.filename = ""
 	p.scanner.SetText(text)
+	p.repeat = nil
+	p.iterations = 0
+	p.inRaw = false
+}
+
+// SetOrigin sets where the symbols defined by Define, DefineValue and Undef
+// come from, such as the command line. By default, the origin is the file
+// and line being parsed. Pass an empty string to restore the default.
+func (p *Parser) SetOrigin(origin string) {
+	p.origin = origin
+}
+
+// SetResolver sets the resolver consulted for symbols that haven't been
+// defined or undefined. Pass nil to remove it.
+func (p *Parser) SetResolver(resolver SymbolResolver) {
+	p.context.resolver = resolver
+}
+
+// configured returns a parser with the same configuration, such as its
+// resolver, strict mode, loop limit and custom directives, but without any
+// symbols or parsing state.
+func (p *Parser) configured() Parser {
+	c := Parser{}
+	c.SetResolver(p.context.resolver)
+	c.SetStrict(p.context.strict)
+	c.SetMaxIterations(p.maxIterations)
+	c.SetCoverage(p.context.coverage)
+	for name, handler := range p.directives {
+		c.RegisterDirective(name, handler)
+	}
+	return c
+}
+
+// Names returns a resolver for the symbols defined in the parser's current
+// namespaces. It doesn't consult the parser's own resolver.
+func (p *Parser) Names() SymbolResolver {
+	return FuncResolver(func(name string) (Value, bool) {
+		value, defined, _ := p.context.lookupName(name)
+		return value, defined
+	})
+}
+
+// SetStrict determines whether a symbol with a value other than true,
+// false, 1 or 0 may be used as a condition. In strict mode, doing so is a
+// syntax error, and defined() or !ifdef must be used instead.
+func (p *Parser) SetStrict(strict bool) {
+	p.context.strict = strict
+}
+
+// SetCoverage records the arms taken in conditional blocks. Pass nil to stop
+// recording.
+func (p *Parser) SetCoverage(coverage *Coverage) {
+	p.context.coverage = coverage
 }
 
 func (p *Parser) SetVerbose(scanner bool, parser bool, context bool) {
@@ -49,7 +135,19 @@ type ParseItem struct {
 
 type LineCallback func(line string)
 
+// NumberedLineCallback receives an active line of text and its line number
+// in the file being parsed.
+type NumberedLineCallback func(line string, number int)
+
 func (p *Parser) Parse(callback LineCallback) error {
+	return p.ParseLines(func(line string, number int) {
+		callback(line)
+	})
+}
+
+// ParseLines parses like Parse, but also passes the line number of each
+// active line of text to the callback.
+func (p *Parser) ParseLines(callback NumberedLineCallback) error {
 	p.Enter()
 	for {
 		item, err := p.ParseLine()
@@ -59,7 +157,7 @@ func (p *Parser) Parse(callback LineCallback) error {
 
 		if item.kind == ParseItemText {
 			if item.active {
-				callback(item.text)
+				callback(item.text, item.line)
 			}
 		} else if item.kind == ParseItemEnd {
 			break
@@ -97,28 +195,52 @@ func (p *Parser) Enter() {
 }
 
 func (p *Parser) Leave() {
-	p.context.enterNamespace()
+	p.context.leaveNamespace()
 }
 
 func (p *Parser) Define(symbol string) error {
-	if symbol == "true" {
-		return SyntaxError{"true is a predefined symbol", p.scanner.Line(), 0, SyntaxErrorPredefinedSymbol}
+	err := p.checkSymbol(symbol)
+	if err != nil {
+		return err
 	}
-	if symbol == "false" {
-		return SyntaxError{"false is a predefined symbol", p.scanner.Line(), 0, SyntaxErrorPredefinedSymbol}
+	p.context.define(symbol, p.definitionOrigin())
+	return nil
+}
+
+// DefineValue defines a symbol with a value.
+func (p *Parser) DefineValue(symbol string, value Value) error {
+	err := p.checkSymbol(symbol)
+	if err != nil {
+		return err
 	}
-	p.context.define(symbol)
+	p.context.defineValue(symbol, value, p.definitionOrigin())
 	return nil
 }
 
 func (p *Parser) Undef(symbol string) error {
+	err := p.checkSymbol(symbol)
+	if err != nil {
+		return err
+	}
+	p.context.undef(symbol, p.definitionOrigin())
+	return nil
+}
+
+// definitionOrigin returns where a symbol being defined comes from.
+func (p *Parser) definitionOrigin() string {
+	if p.origin != "" || p.filename == "" {
+		return p.origin
+	}
+	return fmt.Sprintf("%s:%d", p.filename, p.scanner.Line())
+}
+
+func (p *Parser) checkSymbol(symbol string) error {
 	if symbol == "true" {
 		return SyntaxError{"true is a predefined symbol", p.scanner.Line(), 0, SyntaxErrorPredefinedSymbol}
 	}
 	if symbol == "false" {
 		return SyntaxError{"false is a predefined symbol", p.scanner.Line(), 0, SyntaxErrorPredefinedSymbol}
 	}
-	p.context.undef(symbol)
 	return nil
 }
 
@@ -127,6 +249,25 @@ func (p *Parser) ParseLine() (ParseItem, error) {
 		fmt.Printf("ParseLine\n")
 	}
 
+	// Lines emitted by a custom directive follow it.
+	if len(p.pending) > 0 {
+		text := p.pending[0]
+		p.pending = p.pending[1:]
+		p.emitted = true
+		p.substituted = false
+		return ParseItem{ParseItemText, text, p.scanner.Line(), true}, nil
+	}
+	p.emitted = false
+	p.substituted = false
+
+	// The body of a !for loop follows its !endfor for each iteration.
+	if p.repeat != nil {
+		p.scanner = *p.repeat
+		p.repeat = nil
+	}
+
+	// The lines of a !raw block or heredoc aren't substituted.
+	raw := p.scanner.state == scanStateInit && p.scanner.raw.active()
 	token, text, err := p.scanner.Scan()
 	if err != nil {
 		return ParseItem{}, err
@@ -140,7 +281,16 @@ func (p *Parser) ParseLine() (ParseItem, error) {
 		}
 		return ParseItem{ParseItemDirective, text, p.scanner.Line(), p.IsActive()}, nil
 	case TokenText:
-		return ParseItem{ParseItemText, text, p.scanner.Line(), p.IsActive()}, nil
+		active := p.IsActive()
+		if active && !raw {
+			substituted, err := p.substitute(text)
+			if err != nil {
+				return ParseItem{}, err
+			}
+			p.substituted = substituted != text
+			text = substituted
+		}
+		return ParseItem{ParseItemText, text, p.scanner.Line(), active}, nil
 	case TokenEnd:
 		return ParseItem{ParseItemEnd, "", p.scanner.Line(), false}, nil
 	}
@@ -167,13 +317,39 @@ func (p *Parser) parseDirective(directive string) error {
 		result = p.parseUndef()
 	case DirectiveIf: // "if"
 		result = p.parseIf()
+	case DirectiveIfdef, DirectiveIfndef: // "ifdef", "ifndef"
+		result = p.parseIfdef(directive)
 	case DirectiveElif: // "elif"
 		result = p.parseElIf()
 	case DirectiveElse: // "else"
 		result = p.parseElse()
 	case DirectiveEndif: // "endif"
 		result = p.parseEndIf()
+	case DirectiveError: // "error"
+		result = p.parseError()
+	case DirectiveSwitch: // "switch"
+		result = p.parseSwitch()
+	case DirectiveCase: // "case"
+		result = p.parseCase()
+	case DirectiveDefault: // "default"
+		result = p.parseDefault()
+	case DirectiveEndswitch: // "endswitch"
+		result = p.parseEndSwitch()
+	case DirectiveFor: // "for"
+		result = p.parseFor()
+	case DirectiveEndfor: // "endfor"
+		result = p.parseEndFor()
+	case DirectiveRaw: // "raw"
+		result = p.parseRaw()
+	case DirectiveEndraw: // "endraw"
+		result = p.parseEndRaw()
+	case DirectiveHeredoc: // "heredoc"
+		result = p.parseHeredoc()
 	default:
+		if handler, ok := p.directives[directive]; ok {
+			result = p.parseCustomDirective(directive, handler)
+			break
+		}
 		message := fmt.Sprintf("Unrecognized directive %s\n", directive)
 		result = SyntaxError{message, p.scanner.Line(), 0, SyntaxErrorUnrecognizedDirective}
 	}
@@ -242,15 +418,68 @@ func (p *Parser) parseIf() error {
 
 	p.context.enterBranch()
 
-	result := p.context.evaluateExpression(&expression)
+	result, err := p.evaluate(&expression)
+	if err != nil {
+		return err
+	}
 	if p.context.verbose {
 		fmt.Printf("!if %t\n", result)
 	}
 	p.context.takeBranch(result)
+	p.context.coverBranch(DirectiveIf, p.filename, p.scanner.Line())
+	p.context.explainBranch(DirectiveIf, p.scanner.Line(), &expression, true, result)
+
+	return nil
+}
+
+// parseIfdef begins a conditional block that tests whether a symbol is
+// defined, or with !ifndef, undefined. The symbol's value is ignored.
+func (p *Parser) parseIfdef(directive string) error {
+	if p.verbose {
+		fmt.Printf("parseIfdef %s\n", directive)
+	}
+
+	token, text, err := p.scanner.Scan()
+	if err != nil {
+		return err
+	}
+	if token != TokenIdentifier {
+		message := fmt.Sprintf("!%s expected an identifier", directive)
+		return SyntaxError{message, p.scanner.Line(), 0, SyntaxErrorExpectedIdentifier}
+	}
+
+	err = p.expectDirectiveEnd(directive)
+	if err != nil {
+		return err
+	}
+
+	p.context.enterBranch()
+
+	result := p.context.isDefined(text)
+	if directive == DirectiveIfndef {
+		result = !result
+	}
+	if p.context.verbose {
+		fmt.Printf("!%s %t\n", directive, result)
+	}
+	p.context.takeBranch(result)
+	p.context.coverBranch(directive, p.filename, p.scanner.Line())
+
+	expression := Expression{ExpressionIdentifier, TokenNone, text, nil, nil, nil, 0}
+	p.context.explainBranch(directive, p.scanner.Line(), &expression, true, result)
 
 	return nil
 }
 
+// isIfDirective returns true if the directive begins a conditional block.
+func isIfDirective(directive string) bool {
+	switch directive {
+	case DirectiveIf, DirectiveIfdef, DirectiveIfndef:
+		return true
+	}
+	return false
+}
+
 func (p *Parser) parseElIf() error {
 	if p.verbose {
 		fmt.Printf("parseElIf\n")
@@ -271,11 +500,20 @@ func (p *Parser) parseElIf() error {
 	if err != nil {
 		return err
 	}
+	err = p.expectIfBlock(DirectiveElif)
+	if err != nil {
+		return err
+	}
 
 	p.context.nextBranch()
 
-	if !p.context.previousBranchTaken() {
-		result := p.context.evaluateExpression(&expression)
+	evaluated := !p.context.previousBranchTaken()
+	result := false
+	if evaluated {
+		result, err = p.evaluate(&expression)
+		if err != nil {
+			return err
+		}
 		if p.context.verbose {
 			fmt.Printf("!elif %t\n", result)
 		}
@@ -287,6 +525,9 @@ func (p *Parser) parseElIf() error {
 		}
 	}
 
+	p.context.coverBranch(DirectiveElif, p.filename, p.scanner.Line())
+	p.context.explainBranch(DirectiveElif, p.scanner.Line(), &expression, evaluated, result)
+
 	return nil
 }
 
@@ -299,10 +540,15 @@ func (p *Parser) parseElse() error {
 	if err != nil {
 		return err
 	}
+	err = p.expectIfBlock(DirectiveElse)
+	if err != nil {
+		return err
+	}
 
 	p.context.nextBranch()
 
-	if !p.context.previousBranchTaken() {
+	evaluated := !p.context.previousBranchTaken()
+	if evaluated {
 		if p.context.verbose {
 			fmt.Printf("!else\n")
 		}
@@ -314,6 +560,9 @@ func (p *Parser) parseElse() error {
 		}
 	}
 
+	p.context.coverBranch(DirectiveElse, p.filename, p.scanner.Line())
+	p.context.explainBranch(DirectiveElse, p.scanner.Line(), nil, evaluated, evaluated)
+
 	return nil
 }
 
@@ -326,12 +575,62 @@ func (p *Parser) parseEndIf() error {
 	if err != nil {
 		return err
 	}
+	err = p.expectIfBlock(DirectiveEndif)
+	if err != nil {
+		return err
+	}
 
 	p.context.leaveBranch()
 
 	return nil
 }
 
+// parseError fails processing with the given message when it is in an
+// active branch. The message may be quoted.
+func (p *Parser) parseError() error {
+	if p.verbose {
+		fmt.Printf("parseError\n")
+	}
+
+	message, err := p.scanner.ScanRest()
+	if err != nil {
+		return err
+	}
+
+	err = p.expectDirectiveEnd(DirectiveError)
+	if err != nil {
+		return err
+	}
+
+	if !p.IsActive() {
+		return nil
+	}
+
+	if unquoted, err := strconv.Unquote(message); err == nil {
+		message = unquoted
+	}
+	if message == "" {
+		message = "!error"
+	}
+
+	return ProcessingError{message, p.scanner.Line(), 0, ProcessingErrorDirective}
+}
+
+// evaluate evaluates the condition of the current directive. Errors are
+// reported on the directive's line.
+func (p *Parser) evaluate(e *Expression) (bool, error) {
+	result, err := p.context.evaluateExpression(e)
+	switch ee := err.(type) {
+	case ProcessingError:
+		ee.line = p.scanner.Line()
+		return false, ee
+	case SyntaxError:
+		ee.line = p.scanner.Line()
+		return false, ee
+	}
+	return result, err
+}
+
 func (p *Parser) expectDirectiveEnd(directive string) error {
 	token, _, err := p.scanner.Peek()
 	if err != nil {
@@ -375,7 +674,7 @@ func (p *Parser) parseExpression() (Expression, error) {
 		}
 
 		// Wrap in binary expression
-		expression = Expression{ExpressionBinary, TokenOr, "", &left, &right}
+		expression = Expression{ExpressionBinary, TokenOr, "", &left, &right, nil, 0}
 
 		token, _, err = p.scanner.Peek()
 		if err != nil {
@@ -417,7 +716,7 @@ func (p *Parser) parseTerm() (Expression, error) {
 		}
 
 		// Wrap in binary expression
-		expression = Expression{ExpressionBinary, TokenAnd, "", &left, &right}
+		expression = Expression{ExpressionBinary, TokenAnd, "", &left, &right, nil, 0}
 
 		token, _, err = p.scanner.Peek()
 		if err != nil {
@@ -447,8 +746,7 @@ func (p *Parser) parseFactor() (Expression, error) {
 	// var err error
 	switch token {
 	case TokenIdentifier:
-		// result, err = p.parseIdentifier(text)
-		result = Expression{ExpressionIdentifier, TokenNone, text, nil, nil}
+		result, err = p.parseIdentifier(text, p.scanner.Column())
 	case TokenLParen:
 		result, err = p.parseGroup()
 	case TokenNot:
@@ -461,6 +759,229 @@ func (p *Parser) parseFactor() (Expression, error) {
 	return result, err
 }
 
+func (p *Parser) parseIdentifier(text string, column int) (Expression, error) {
+	if p.verbose {
+		fmt.Printf("parseIdentifier %s\n", text)
+	}
+
+	token, _, err := p.scanner.Peek()
+	if err != nil {
+		return Expression{}, err
+	}
+
+	// An identifier followed by a parenthesis is a function call.
+	if token == TokenLParen {
+		p.scanner.Scan() // Eat the (
+		return p.parseCall(text, column, TypeBool)
+	}
+
+	// An identifier followed by a bracket is an element of a list or map.
+	if token == TokenLBracket {
+		p.scanner.Scan() // Eat the [
+		return p.parseIndex(Expression{ExpressionIdentifier, TokenNone, text, nil, nil, nil, column}, column)
+	}
+
+	err = p.scanner.Push()
+	if err != nil {
+		return Expression{}, err
+	}
+
+	return Expression{ExpressionIdentifier, TokenNone, text, nil, nil, nil, column}, nil
+}
+
+// parseIndex parses the key of an element of a list or map, following the
+// opening bracket, and of any elements of that element. The key is a
+// number, a quoted string, a symbol or a function call. The list or map is
+// at column.
+func (p *Parser) parseIndex(container Expression, column int) (Expression, error) {
+	if p.verbose {
+		fmt.Printf("parseIndex %s\n", formatCondition(&container))
+	}
+
+	for {
+		token, text, err := p.scanner.Scan()
+		if err != nil {
+			return Expression{}, err
+		}
+
+		var key Expression
+		switch token {
+		case TokenNumber:
+			key = Expression{ExpressionNumber, TokenNone, text, nil, nil, nil, 0}
+		case TokenString:
+			key = Expression{ExpressionString, TokenNone, text, nil, nil, nil, 0}
+		case TokenIdentifier:
+			key, err = p.parseSymbolArgument(text, p.scanner.Column(), TypeString)
+			if err != nil {
+				return Expression{}, err
+			}
+		default:
+			message := fmt.Sprintf("%s[] expects a number, string or symbol", formatCondition(&container))
+			return Expression{}, SyntaxError{message, p.scanner.Line(), column, SyntaxErrorInvalidExpression}
+		}
+
+		token, _, err = p.scanner.Scan()
+		if err != nil {
+			return Expression{}, err
+		}
+		if token != TokenRBracket {
+			message := fmt.Sprintf("%s[] requires a closing bracket", formatCondition(&container))
+			return Expression{}, SyntaxError{message, p.scanner.Line(), column, SyntaxErrorInvalidExpression}
+		}
+
+		inner := container
+		container = Expression{ExpressionIndex, TokenNone, "", &inner, &key, nil, column}
+
+		token, _, err = p.scanner.Peek()
+		if err != nil {
+			return Expression{}, err
+		}
+		if token != TokenLBracket {
+			return container, p.scanner.Push()
+		}
+		p.scanner.Scan() // Eat the [
+	}
+}
+
+// parseCall parses the arguments of a call to the named function, which is
+// at column, following the opening parenthesis. The function must return a
+// result of the given type.
+func (p *Parser) parseCall(name string, column int, result Type) (Expression, error) {
+	if p.verbose {
+		fmt.Printf("parseCall %s\n", name)
+	}
+
+	f, ok := functions[name]
+	if !ok {
+		message := fmt.Sprintf("Unknown function %s", name)
+		return Expression{}, SyntaxError{message, p.scanner.TokenLine(), column, SyntaxErrorUnknownFunction}
+	}
+
+	if f.Result == TypeBool && result != TypeBool {
+		message := fmt.Sprintf("%s returns a condition, but a %s is expected", name, result)
+		return Expression{}, SyntaxError{message, p.scanner.TokenLine(), column, SyntaxErrorInvalidArgument}
+	}
+	if f.Result != TypeBool && result == TypeBool {
+		message := fmt.Sprintf("%s returns a %s, which can't be used as a condition", name, f.Result)
+		return Expression{}, SyntaxError{message, p.scanner.TokenLine(), column, SyntaxErrorInvalidArgument}
+	}
+
+	token, _, err := p.scanner.Peek()
+	if err != nil {
+		return Expression{}, err
+	}
+
+	var arguments []*Expression
+	if token == TokenRParen {
+		p.scanner.Scan() // Eat the )
+	} else {
+		err = p.scanner.Push()
+		if err != nil {
+			return Expression{}, err
+		}
+
+		for {
+			// Extra arguments are parsed as values, so that the count can
+			// be reported.
+			t := TypeValue
+			if len(arguments) < len(f.Args) {
+				t = f.Args[len(arguments)]
+			}
+
+			argument, err := p.parseArgument(name, t)
+			if err != nil {
+				return Expression{}, err
+			}
+			arguments = append(arguments, &argument)
+
+			token, _, err = p.scanner.Scan()
+			if err != nil {
+				return Expression{}, err
+			}
+			if token == TokenRParen {
+				break
+			}
+			if token != TokenComma {
+				message := fmt.Sprintf("%s requires a closing parenthesis", name)
+				return Expression{}, SyntaxError{message, p.scanner.TokenLine(), column, SyntaxErrorInvalidExpression}
+			}
+		}
+	}
+
+	if len(arguments) != len(f.Args) {
+		message := fmt.Sprintf("%s expects %d arguments but received %d", name, len(f.Args), len(arguments))
+		if len(f.Args) == 1 {
+			message = fmt.Sprintf("%s expects 1 argument but received %d", name, len(arguments))
+		}
+		return Expression{}, SyntaxError{message, p.scanner.TokenLine(), column, SyntaxErrorInvalidArgument}
+	}
+
+	return Expression{ExpressionCall, TokenNone, name, nil, nil, arguments, column}, nil
+}
+
+// parseArgument parses an argument of the type t to the named function.
+func (p *Parser) parseArgument(name string, t Type) (Expression, error) {
+	if p.verbose {
+		fmt.Printf("parseArgument %s\n", t)
+	}
+
+	// A condition may be any expression.
+	if t == TypeBool {
+		return p.parseExpression()
+	}
+
+	token, text, err := p.scanner.Scan()
+	if err != nil {
+		return Expression{}, err
+	}
+	column := p.scanner.Column()
+
+	switch token {
+	case TokenIdentifier:
+		return p.parseSymbolArgument(text, column, t)
+	case TokenString:
+		if t != TypeSymbol {
+			return Expression{ExpressionString, TokenNone, text, nil, nil, nil, 0}, nil
+		}
+	case TokenNumber:
+		if t != TypeSymbol {
+			return Expression{ExpressionNumber, TokenNone, text, nil, nil, nil, 0}, nil
+		}
+	case TokenRParen, TokenComma:
+		message := fmt.Sprintf("%s is missing an argument", name)
+		return Expression{}, SyntaxError{message, p.scanner.TokenLine(), column, SyntaxErrorInvalidArgument}
+	}
+
+	message := fmt.Sprintf("%s expects a %s", name, t)
+	return Expression{}, SyntaxError{message, p.scanner.TokenLine(), column, SyntaxErrorInvalidArgument}
+}
+
+// parseSymbolArgument parses an argument of the type t that begins with the
+// identifier at column: a symbol, a function call or an element of a list
+// or map.
+func (p *Parser) parseSymbolArgument(text string, column int, t Type) (Expression, error) {
+	next, _, err := p.scanner.Peek()
+	if err != nil {
+		return Expression{}, err
+	}
+
+	if next == TokenLParen && t != TypeSymbol {
+		p.scanner.Scan() // Eat the (
+		return p.parseCall(text, column, t)
+	}
+
+	if next == TokenLBracket && t != TypeSymbol {
+		p.scanner.Scan() // Eat the [
+		return p.parseIndex(Expression{ExpressionIdentifier, TokenNone, text, nil, nil, nil, column}, column)
+	}
+
+	err = p.scanner.Push()
+	if err != nil {
+		return Expression{}, err
+	}
+	return Expression{ExpressionIdentifier, TokenNone, text, nil, nil, nil, 0}, nil
+}
+
 func (p *Parser) parseGroup() (Expression, error) {
 	if p.verbose {
 		fmt.Printf("parseGroup\n")
@@ -500,7 +1021,7 @@ func (p *Parser) parseGroup() (Expression, error) {
 	}
 
 	// Wrap in grouping expression
-	result := Expression{ExpressionGroup, TokenNone, "", &expression, nil}
+	result := Expression{ExpressionGroup, TokenNone, "", &expression, nil, nil, 0}
 
 	return result, nil
 }
@@ -516,7 +1037,7 @@ func (p *Parser) parseNot() (Expression, error) {
 	}
 
 	// Wrap in unary expression
-	result := Expression{ExpressionUnary, TokenNot, "", &expression, nil}
+	result := Expression{ExpressionUnary, TokenNot, "", &expression, nil, nil, 0}
 
 	return result, nil
 }
@@ -526,17 +1047,26 @@ func (p *Parser) parseSymbolDefine(text string) (Expression, error) {
 		fmt.Printf("parseSymbolDefine %s\n", text)
 	}
 
+	value, err := p.parseDefineRest(text)
+	if err != nil {
+		return Expression{}, err
+	}
+
 	token, _, err := p.scanner.Scan()
 	if err != nil {
 		return Expression{}, err
 	}
 
-	expression := Expression{ExpressionIdentifier, TokenNone, text, nil, nil}
+	expression := Expression{ExpressionIdentifier, TokenNone, text, nil, nil, nil, 0}
 
 	var result Expression
 	switch token {
 	case TokenLine, TokenEnd:
-		err = p.Define(text)
+		if value.Kind() == ValueNone {
+			err = p.Define(text)
+		} else {
+			err = p.DefineValue(text, value)
+		}
 		result = expression
 	default:
 		return Expression{}, SyntaxError{"define expects a symbol", p.scanner.Line(), 0, SyntaxErrorInvalidExpression}
@@ -545,6 +1075,27 @@ func (p *Parser) parseSymbolDefine(text string) (Expression, error) {
 	return result, err
 }
 
+// parseDefineRest parses the value of the symbol being defined, if the rest
+// of the line has one. A comment that follows the symbol is left to the
+// scanner, since it may span lines.
+func (p *Parser) parseDefineRest(name string) (Value, error) {
+	if !p.scanner.HasRest() {
+		return Value{}, nil
+	}
+
+	rest, err := p.scanner.ScanRest()
+	if err != nil {
+		return Value{}, err
+	}
+
+	value, err := parseDefineValue(rest)
+	if ve, ok := err.(valueError); ok {
+		message := fmt.Sprintf("!define %s has an invalid value: %s", name, ve.message)
+		return Value{}, SyntaxError{message, p.scanner.Line(), p.scanner.Column() + ve.offset, SyntaxErrorInvalidValue}
+	}
+	return value, err
+}
+
 func (p *Parser) parseSymbolUndef(text string) (Expression, error) {
 	if p.verbose {
 		fmt.Printf("parseSymbolUndef %s\n", text)
@@ -555,7 +1106,7 @@ func (p *Parser) parseSymbolUndef(text string) (Expression, error) {
 		return Expression{}, err
 	}
 
-	expression := Expression{ExpressionIdentifier, TokenNone, text, nil, nil}
+	expression := Expression{ExpressionIdentifier, TokenNone, text, nil, nil, nil, 0}
 
 	var result Expression
 	switch token {
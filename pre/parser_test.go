@@ -1,6 +1,10 @@
 package pre
 
-import "testing"
+import (
+	"os"
+	"strings"
+	"testing"
+)
 
 func TestParseSimpleExpression(t *testing.T) {
 	p := Parser{}
@@ -226,6 +230,288 @@ func TestParseMultilineCommentRegression(t *testing.T) {
 	p.Leave()
 }
 
+func TestParseNamespaces(t *testing.T) {
+	p := Parser{}
+	// p.SetVerbose(true, true, true)
+
+	p.Enter()
+	p.Define("FOO")
+
+	// Symbols defined in an inner namespace don't outlive it.
+	p.SetText("!define BAR\n!if FOO && BAR\ngood\n!endif\n")
+	p.Enter()
+	parseExpectDirective(t, &p)
+	parseExpectDirective(t, &p)
+	parseExpectText(t, &p, "good", true)
+	parseExpectDirective(t, &p)
+	parseExpectEnd(t, &p)
+	p.Leave()
+
+	p.SetText("!if FOO && !BAR\ngood\n!endif\n")
+	p.Enter()
+	parseExpectDirective(t, &p)
+	parseExpectText(t, &p, "good", true)
+	parseExpectDirective(t, &p)
+	parseExpectEnd(t, &p)
+	p.Leave()
+	p.Leave()
+}
+
+func TestParsePredefinedSymbols(t *testing.T) {
+	// The predefined symbols are constants, which a resolver can't change.
+	p := Parser{}
+	p.SetText("!if true\na\n!endif\n!if false\nb\n!endif\n!if !false && (true || A)\nc\n!endif\n")
+	p.SetResolver(MapResolver{"false": Value{}})
+
+	var lines []string
+	err := p.Parse(func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := strings.Join(lines, ","); actual != "a,c" {
+		t.Errorf("Expected 'a,c' but received '%s'", actual)
+	}
+
+	if err := p.Define("true"); err == nil {
+		t.Error("Expected an error defining true")
+	}
+}
+
+func TestParseEnvironmentFunction(t *testing.T) {
+	p := Parser{}
+	// p.SetVerbose(true, true, true)
+
+	os.Setenv("TERRACOTTA_TEST_SET", "1")
+	os.Setenv("TERRACOTTA_TEST_EMPTY", "")
+	defer os.Unsetenv("TERRACOTTA_TEST_SET")
+	defer os.Unsetenv("TERRACOTTA_TEST_EMPTY")
+
+	p.SetText(`!if env("TERRACOTTA_TEST_SET")
+good
+!endif
+!if env("TERRACOTTA_TEST_EMPTY") || env("TERRACOTTA_TEST_UNSET")
+bad
+!endif
+!if nope("X")
+`)
+
+	p.Enter()
+	parseExpectDirective(t, &p)
+	parseExpectText(t, &p, "good", true)
+	parseExpectDirective(t, &p)
+	parseExpectDirective(t, &p)
+	parseExpectText(t, &p, "bad", false)
+	parseExpectDirective(t, &p)
+	parseExpectSyntaxErrorKind(t, &p, SyntaxErrorUnknownFunction)
+	p.Leave()
+}
+
+func TestParseErrorDirective(t *testing.T) {
+	p := Parser{}
+	// p.SetVerbose(true, true, true)
+
+	p.SetText("!if FOO\n!error Not reached\n!endif\n!error \"FOO is required\"\n")
+
+	p.Enter()
+	parseExpectDirective(t, &p)
+	parseExpectDirective(t, &p)
+	parseExpectDirective(t, &p)
+
+	_, err := p.ParseLine()
+	pe, found := err.(ProcessingError)
+	if !found || pe.Kind() != ProcessingErrorDirective {
+		t.Fatalf("Expected !error but received %v", err)
+	}
+
+	if pe.String() != "FOO is required" || pe.Line() != 4 {
+		t.Errorf("Unexpected error '%s' on line %d", pe.String(), pe.Line())
+	}
+	p.Leave()
+}
+
+func TestParseIfdef(t *testing.T) {
+	p := Parser{}
+
+	p.SetText("!define A\n!ifdef A\na\n!endif\n!ifndef C\nc\n!endif\n!ifdef B\nb\n!elif true\nbad\n!endif\n!ifndef A\nbad\n!else\nnot a\n!endif\n")
+
+	p.Enter()
+	p.DefineValue("B", StringValue("false"))
+	parseExpectDirective(t, &p)
+	parseExpectDirective(t, &p)
+	parseExpectText(t, &p, "a", true)
+	parseExpectDirective(t, &p)
+	parseExpectDirective(t, &p)
+	parseExpectText(t, &p, "c", true)
+	parseExpectDirective(t, &p)
+
+	// The value of a symbol doesn't matter to !ifdef.
+	parseExpectDirective(t, &p)
+	parseExpectText(t, &p, "b", true)
+	parseExpectDirective(t, &p)
+	parseExpectText(t, &p, "bad", false)
+	parseExpectDirective(t, &p)
+
+	parseExpectDirective(t, &p)
+	parseExpectText(t, &p, "bad", false)
+	parseExpectDirective(t, &p)
+	parseExpectText(t, &p, "not a", true)
+	parseExpectDirective(t, &p)
+	parseExpectEnd(t, &p)
+	p.Leave()
+
+	p.SetText("!ifdef A && B\n!endif\n")
+	p.Enter()
+	parseExpectSyntaxErrorKind(t, &p, SyntaxErrorInvalidExpression)
+	p.Leave()
+}
+
+func TestParseTruthiness(t *testing.T) {
+	tests := []struct {
+		value    Value
+		expected bool
+	}{
+		{Value{}, true},
+		{StringValue("true"), true},
+		{StringValue("1"), true},
+		{StringValue("prod"), true},
+		{StringValue("false"), false},
+		{StringValue("FALSE"), false},
+		{StringValue("0"), false},
+		{StringValue(""), false},
+		{BoolValue(false), false},
+	}
+
+	for _, test := range tests {
+		p := Parser{}
+		p.SetText("!if A\nyes\n!endif\n")
+		p.Enter()
+		p.DefineValue("A", test.value)
+
+		var lines []string
+		err := p.ParseLines(func(line string, number int) {
+			lines = append(lines, line)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(lines) == 1) != test.expected {
+			t.Errorf("Expected A=%q to be %t", test.value.String(), test.expected)
+		}
+		if test.value.Truth() != test.expected {
+			t.Errorf("Expected the truth of %q to be %t", test.value.String(), test.expected)
+		}
+	}
+}
+
+func TestParseStrict(t *testing.T) {
+	for _, value := range []string{"true", "0", "False"} {
+		p := Parser{}
+		p.SetStrict(true)
+		p.SetText("!if A\n!endif\n")
+		p.Enter()
+		p.DefineValue("A", StringValue(value))
+		if err := p.ParseLines(func(string, int) {}); err != nil {
+			t.Errorf("Unexpected error for A=%s: %v", value, err)
+		}
+	}
+
+	p := Parser{}
+	p.SetStrict(true)
+	p.SetText("!ifdef ENV\n!endif\n!if defined(ENV) && matches(ENV, \"^prod\")\n!endif\n!if true && ENV\n!endif\n")
+	p.Enter()
+	p.DefineValue("ENV", StringValue("prod"))
+	parseExpectDirective(t, &p)
+	parseExpectDirective(t, &p)
+	parseExpectDirective(t, &p)
+	parseExpectDirective(t, &p)
+
+	_, err := p.ParseLine()
+	se, ok := err.(SyntaxError)
+	if !ok || se.Kind() != SyntaxErrorValuedSymbol {
+		t.Fatalf("Expected a valued symbol error but received %v", err)
+	}
+	if se.Line() != 5 || se.Column() != 13 {
+		t.Errorf("Expected the error at (5,13) but received %v", se)
+	}
+}
+
+func TestParseCoverage(t *testing.T) {
+	coverage := NewCoverage()
+
+	for _, foo := range []bool{false, true} {
+		p := Parser{}
+		p.SetCoverage(coverage)
+		p.SetText("!if FOO\n!elif BAR\n!if BAZ\n!endif\n!else\n!endif\n")
+
+		p.Enter()
+		if foo {
+			p.Define("FOO")
+		}
+		for i := 0; i < 6; i++ {
+			parseExpectDirective(t, &p)
+		}
+		parseExpectEnd(t, &p)
+		p.Leave()
+	}
+
+	blocks := coverage.Blocks()
+	if len(blocks) != 2 {
+		t.Fatalf("Expected 2 blocks but received %d", len(blocks))
+	}
+
+	outer, inner := blocks[0], blocks[1]
+	if outer.Reached != 2 || len(outer.Arms) != 3 {
+		t.Fatalf("Unexpected outer block %v", outer)
+	}
+
+	for i, taken := range []int{1, 0, 1} {
+		if outer.Arms[i].Taken != taken {
+			t.Errorf("Expected arm %d taken %d times but received %d", i, taken, outer.Arms[i].Taken)
+		}
+	}
+
+	if inner.Line != 3 || inner.Reached != 0 || len(inner.Arms) != 1 {
+		t.Errorf("Unexpected inner block %v", inner)
+	}
+}
+
+func TestEnvironmentDefines(t *testing.T) {
+	environ := []string{"PATH=/bin", "TERRACOTTA_DEFINE_SSL=1", "TERRACOTTA_DEFINE_ENV=prod=a", "TERRACOTTA_DEFINE_="}
+	defines := environmentDefines(DefaultEnvironmentPrefix, environ)
+
+	if len(defines) != 2 || defines[0] != "ENV=prod=a" || defines[1] != "SSL=1" {
+		t.Errorf("Unexpected environment defines %v", defines)
+	}
+
+	name, value, ok := splitDefine(defines[0])
+	if name != "ENV" || value != "prod=a" || !ok {
+		t.Errorf("Unexpected split '%s' = '%s'", name, value)
+	}
+
+	if environmentDefines("", environ) != nil {
+		t.Error("Expected no environment defines without a prefix")
+	}
+}
+
+func parseExpectSyntaxErrorKind(t *testing.T, p *Parser, expected SyntaxErrorKind) {
+	_, err := p.ParseLine()
+	if err == nil {
+		t.Error("Expected syntax error")
+		return
+	}
+
+	se, found := err.(SyntaxError)
+	if !found {
+		t.Error("Expected syntax error")
+	}
+
+	if se.Kind() != expected {
+		t.Errorf("Expected syntax error kind %d but received %d", expected, se.Kind())
+	}
+}
+
 func parseExpectDirective(t *testing.T, p *Parser) {
 	item, err := p.ParseLine()
 	if err != nil {
@@ -1,78 +1,453 @@
 package pre
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"sort"
 	"strings"
 )
 
 const terraformDirectory = ".terraform"
+const gitDirectory = ".git"
 const tfdefsFilename = "terraform.tfdefs"
 const terraformExtension = ".tf"
 const templateExtension = ".tft"
 
+// The origins of symbols that aren't defined in a file.
+const originEnvironment = "environment"
+const originCommandLine = "command line"
+
 // Preprocessor encapsulates file parsing and code generation.
 type Preprocessor struct {
-	parser Parser
+	parser    Parser
+	include   []ignorePattern
+	exclude   []ignorePattern
+	noRecurse bool
+	defines   []string
+	undefs    []string
+	environ   []string
+	defsFiles []definitionsFile
+	rendered  map[string]string
+	sources   map[string][]int // The template line of each rendered line, negated if it isn't copied as written.
+	sourceMap SourceMapMode
+	coverage  *Coverage
+}
+
+// SetInclude restricts the templates that are processed to those matching
+// one of the glob patterns. Patterns use gitignore semantics and are relative
+// to the source directory.
+func (p *Preprocessor) SetInclude(globs []string) {
+	p.include = parsePatterns(globs)
+}
+
+// SetExclude skips files and directories matching any of the glob patterns.
+// Patterns use gitignore semantics and are relative to the source directory.
+func (p *Preprocessor) SetExclude(globs []string) {
+	p.exclude = parsePatterns(globs)
+}
+
+// SetRecursive determines whether subdirectories are processed.
+func (p *Preprocessor) SetRecursive(recursive bool) {
+	p.noRecurse = !recursive
+}
+
+// SetEnvironmentPrefix defines a symbol for each environment variable that
+// begins with prefix. The symbol is named by the remainder of the variable
+// name and takes the variable's value. An empty prefix disables the import.
+func (p *Preprocessor) SetEnvironmentPrefix(prefix string) {
+	p.environ = environmentDefines(prefix, os.Environ())
+}
+
+// SetDefinitionsFiles loads definitions files, which are applied in order.
+// A file may be in JSON, YAML or Terraform variables format, or may contain
+// directives as in 'terraform.tfdefs'.
+func (p *Preprocessor) SetDefinitionsFiles(filenames []string) error {
+	p.defsFiles = nil
+	for _, filename := range filenames {
+		file, err := readDefinitionsFile(filename)
+		if err != nil {
+			return err
+		}
+		p.defsFiles = append(p.defsFiles, file)
+	}
+	return nil
+}
+
+// SetResolver sets the resolver consulted for symbols that aren't defined by
+// the config, definitions files, the environment, the command line or
+// directives. Pass nil to remove it.
+func (p *Preprocessor) SetResolver(resolver SymbolResolver) {
+	p.parser.SetResolver(resolver)
+}
+
+// SetStrict determines whether symbols with non-Boolean values may be used
+// as conditions, as with Parser.SetStrict.
+func (p *Preprocessor) SetStrict(strict bool) {
+	p.parser.SetStrict(strict)
+}
+
+// SetMaxIterations limits the iterations of the !for loops in each
+// template, as with Parser.SetMaxIterations.
+func (p *Preprocessor) SetMaxIterations(max int) {
+	p.parser.SetMaxIterations(max)
+}
+
+// RegisterDirective adds a custom directive to the templates, as with
+// Parser.RegisterDirective.
+func (p *Preprocessor) RegisterDirective(name string, handler DirectiveHandler) error {
+	return p.parser.RegisterDirective(name, handler)
+}
+
+// SetCoverage records the arms taken in conditional blocks while processing.
+// Pass nil to stop recording.
+func (p *Preprocessor) SetCoverage(coverage *Coverage) {
+	p.coverage = coverage
+	p.parser.SetCoverage(coverage)
 }
 
 // ProcessDirectory enumerates and parses relevant files in the source
 // directory and generates corresponding files in the output directory.
 // After the current directory is complete, subdirectories are processed.
 func (p *Preprocessor) ProcessDirectory(source string, output string, defines []string, undefs []string) {
+	err := p.processTree(source, output, defines, undefs)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// RenderDirectory processes the source directory like ProcessDirectory, but
+// returns the generated files rather than writing them. The files are keyed
+// by their slash separated path relative to the source directory.
+func (p *Preprocessor) RenderDirectory(source string, defines []string, undefs []string) (map[string]string, error) {
+	p.rendered = make(map[string]string)
+	defer func() { p.rendered = nil }()
+
+	err := p.processTree(source, "", defines, undefs)
+	return p.rendered, err
+}
+
+// Files returns the templates and 'terraform.tfdefs' files that would be
+// processed in the source directory, in the order they would be processed.
+func (p *Preprocessor) Files(source string) ([]string, []string, error) {
+	var templates []string
+	var defs []string
+	err := p.collectFiles(source, "", &templates, &defs)
+	return templates, defs, err
+}
+
+func (p *Preprocessor) processTree(source string, output string, defines []string, undefs []string) error {
+	p.defines = defines
+	p.undefs = undefs
+
+	levels, err := p.enterAncestors(source)
+	if err != nil {
+		return err
+	}
+
+	err = p.processDirectory(source, output, "")
+	if err != nil {
+		return err
+	}
+
+	p.leave(levels)
+	return nil
+}
+
+// processDirectory processes a single directory. The rel parameter is the
+// slash separated path of the directory relative to the source root, which
+// is used to match include and exclude patterns.
+func (p *Preprocessor) processDirectory(source string, output string, rel string) error {
 	if _, err := os.Stat(source); os.IsNotExist(err) {
-		log.Fatalf("Directory '%s' does not exist", source)
+		return fmt.Errorf("Directory '%s' does not exist", source)
 	}
 
-	if _, err := os.Stat(output); os.IsNotExist(err) {
-		log.Fatalf("Directory '%s' does not exist", output)
+	if p.rendered == nil {
+		if _, err := os.Stat(output); os.IsNotExist(err) {
+			return fmt.Errorf("Directory '%s' does not exist", output)
+		}
 	}
 
-	dirs, files, tfdefs, err := p.getDirectoryContents(source)
+	// Patterns in a '.terracottaignore' file apply to this directory and
+	// its subdirectories.
+	excludes := len(p.exclude)
+	defer func() { p.exclude = p.exclude[:excludes] }()
+
+	err := p.loadIgnoreFile(source, rel)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	dirs, files, tfdefs, err := p.getDirectoryContents(source, rel)
+	if err != nil {
+		return err
+	}
+
+	err = p.enterDefinitions(source, tfdefs)
+	if err != nil {
+		return err
+	}
+
+	for _, templateFilename := range files {
+		baseName := removeFileExtension(templateFilename)
+		generatedFilename := baseName + terraformExtension
+
+		input := path.Join(source, templateFilename)
+		err := p.processFile(input, path.Join(output, generatedFilename))
+		if err != nil {
+			return fmt.Errorf("%s%w", input, err)
+		}
+	}
+
+	// Preprocess subdirectories.
+	if !p.noRecurse {
+		for _, dir := range dirs {
+			err = p.processDirectory(path.Join(source, dir), path.Join(output, dir), path.Join(rel, dir))
+			if err != nil {
+				return err
+			}
+		}
 	}
 
+	p.parser.Leave()
+	return nil
+}
+
+// enterDefinitions opens the namespace for a directory and applies its
+// definitions file, if it has one, followed by the overrides.
+func (p *Preprocessor) enterDefinitions(source string, tfdefs bool) error {
 	p.parser.Enter()
 
 	// If there's a file called 'terraform.tfdefs', load it.
 	if tfdefs {
-		err = p.processDefines(path.Join(source, tfdefsFilename))
+		filename := path.Join(source, tfdefsFilename)
+		err := p.processDefines(filename)
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("%s%w", filename, err)
 		}
 	}
 
-	// Apply any command-line overrides after the file-based defs.
-	err = p.applyDefines(defines, undefs)
+	// Apply any environment and command-line overrides after the
+	// file-based defs.
+	return p.applyDefines()
+}
+
+// ProcessFiles parses individual templates within the source directory and
+// generates the corresponding files in the output directory. For each
+// template, the definitions files in the directories between the source
+// directory and the template are loaded in order, so that the result is the
+// same as processing the entire source directory. Files that aren't
+// templates, or that are excluded, are skipped.
+func (p *Preprocessor) ProcessFiles(source string, output string, files []string, defines []string, undefs []string) {
+	if _, err := os.Stat(source); os.IsNotExist(err) {
+		log.Fatalf("Directory '%s' does not exist", source)
+	}
+
+	p.defines = defines
+	p.undefs = undefs
+
+	levels, err := p.enterAncestors(source)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer p.leave(levels)
 
-	for _, templateFilename := range files {
-		baseName := removeFileExtension(templateFilename)
-		generatedFilename := baseName + terraformExtension
+	for _, file := range files {
+		rel, err := relativePath(source, file)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-		err := p.processFile(path.Join(source, templateFilename), path.Join(output, generatedFilename))
+		if !strings.HasSuffix(rel, templateExtension) {
+			continue
+		}
+
+		err = p.processTemplate(source, output, rel)
 		if err != nil {
-			log.Fatal(templateFilename + err.Error())
-			return
+			log.Fatal(file + err.Error())
 		}
 	}
+}
 
-	// Preprocess subdirectories.
-	for _, dir := range dirs {
-		p.ProcessDirectory(path.Join(source, dir), path.Join(output, dir), nil, nil)
+// processTemplate processes the template at rel, a slash separated path
+// relative to the source directory, after entering each of its ancestors.
+func (p *Preprocessor) processTemplate(source string, output string, rel string) error {
+	_, err := p.withTemplate(source, rel, func(input string) error {
+		generated := removeFileExtension(rel) + terraformExtension
+		return p.processFile(input, path.Join(output, generated))
+	})
+	return err
+}
+
+// withTemplate enters each of the ancestors of the template at rel, within
+// the source directory, and calls fn with the template's filename. It
+// returns false, without calling fn, if the template is excluded.
+func (p *Preprocessor) withTemplate(source string, rel string, fn func(input string) error) (bool, error) {
+	excludes := len(p.exclude)
+	defer func() { p.exclude = p.exclude[:excludes] }()
+
+	var dirs []string
+	if dir := path.Dir(rel); dir != "." {
+		dirs = strings.Split(dir, "/")
 	}
 
-	p.parser.Leave()
+	err := p.enterDirectory(source, "")
+	if err != nil {
+		return false, err
+	}
+	defer p.parser.Leave()
+
+	err = p.applyDefines()
+	if err != nil {
+		return false, err
+	}
+
+	dir := ""
+	for _, name := range dirs {
+		dir = path.Join(dir, name)
+		if strings.EqualFold(name, terraformDirectory) ||
+			strings.EqualFold(name, gitDirectory) ||
+			matchPatterns(p.exclude, dir, true) {
+			return false, nil
+		}
+
+		err = p.enterDirectory(path.Join(source, dir), dir)
+		if err != nil {
+			return false, err
+		}
+		defer p.parser.Leave()
+
+		err = p.applyDefines()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if !p.isIncluded(rel) {
+		return false, nil
+	}
+
+	return true, fn(path.Join(source, rel))
+}
+
+// enterAncestors applies the project config and the definitions files in
+// the directories from the project root down to, but not including, dir.
+// Each is applied in its own namespace, so that nearer definitions take
+// precedence. It returns the number of namespaces entered.
+func (p *Preprocessor) enterAncestors(dir string) (int, error) {
+	root, ancestors, err := projectAncestors(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	levels := 0
+
+	config := filepath.Join(root, configFilename)
+	if _, err := os.Stat(config); err == nil {
+		c, err := ReadConfig(config)
+		if err != nil {
+			return levels, err
+		}
+
+		p.parser.Enter()
+		levels++
+
+		err = p.defineSymbols(config, c.Define, c.Undef)
+		if err != nil {
+			return levels, err
+		}
+	}
+
+	for _, ancestor := range ancestors {
+		p.parser.Enter()
+		levels++
+
+		tfdefs := filepath.Join(ancestor, tfdefsFilename)
+		if _, err := os.Stat(tfdefs); err == nil {
+			err = p.processDefines(tfdefs)
+			if err != nil {
+				return levels, err
+			}
+		}
+	}
+
+	return levels, nil
 }
 
-func (p *Preprocessor) getDirectoryContents(path string) ([]string, []string, bool, error) {
-	list, err := ioutil.ReadDir(path)
+// projectAncestors returns the project root for dir and the directories
+// from the root down to, but not including, dir.
+func projectAncestors(dir string) (string, []string, error) {
+	root, err := FindProjectRoot(dir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rel, err := relativePath(root, dir)
+	if err != nil || rel == "." {
+		return root, nil, err
+	}
+
+	// The root and each directory below it, up to dir.
+	ancestors := []string{root}
+	if parent := path.Dir(rel); parent != "." {
+		current := root
+		for _, name := range strings.Split(parent, "/") {
+			current = filepath.Join(current, name)
+			ancestors = append(ancestors, current)
+		}
+	}
+
+	return root, ancestors, nil
+}
+
+// leave closes the given number of namespaces.
+func (p *Preprocessor) leave(levels int) {
+	for i := 0; i < levels; i++ {
+		p.parser.Leave()
+	}
+}
+
+// enterDirectory opens the namespace for a directory and loads its ignore
+// file and definitions file, if present.
+func (p *Preprocessor) enterDirectory(dir string, rel string) error {
+	err := p.loadIgnoreFile(dir, rel)
+	if err != nil {
+		return err
+	}
+
+	p.parser.Enter()
+
+	tfdefs := path.Join(dir, tfdefsFilename)
+	if _, err := os.Stat(tfdefs); err == nil {
+		return p.processDefines(tfdefs)
+	}
+
+	return nil
+}
+
+// loadIgnoreFile adds the patterns in the directory's '.terracottaignore'
+// file, if any, to the exclude patterns.
+func (p *Preprocessor) loadIgnoreFile(dir string, rel string) error {
+	ignoreFile := path.Join(dir, ignoreFilename)
+	if _, err := os.Stat(ignoreFile); err != nil {
+		return nil
+	}
+
+	patterns, err := readIgnoreFile(ignoreFile, rel)
+	if err != nil {
+		return err
+	}
+
+	p.exclude = append(p.exclude, patterns...)
+	return nil
+}
+
+func (p *Preprocessor) getDirectoryContents(dir string, rel string) ([]string, []string, bool, error) {
+	list, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return nil, nil, false, err
 	}
@@ -81,13 +456,19 @@ func (p *Preprocessor) getDirectoryContents(path string) ([]string, []string, bo
 	var files []string
 	var dirs []string
 	for _, file := range list {
+		name := path.Join(rel, file.Name())
 		if file.IsDir() {
-			// Read all directories except '.terraform'
-			if !strings.EqualFold(file.Name(), terraformDirectory) {
+			// Read all directories except '.terraform', '.git' and those
+			// that are excluded.
+			if !strings.EqualFold(file.Name(), terraformDirectory) &&
+				!strings.EqualFold(file.Name(), gitDirectory) &&
+				!matchPatterns(p.exclude, name, true) {
 				dirs = append(dirs, file.Name())
 			}
 		} else if strings.HasSuffix(file.Name(), templateExtension) {
-			files = append(files, file.Name())
+			if p.isIncluded(name) {
+				files = append(files, file.Name())
+			}
 		} else if strings.EqualFold(file.Name(), tfdefsFilename) {
 			hasDefines = true
 		}
@@ -99,26 +480,101 @@ func (p *Preprocessor) getDirectoryContents(path string) ([]string, []string, bo
 	return dirs, files, hasDefines, nil
 }
 
-func (p *Preprocessor) processFile(input string, output string) error {
-	f, err := os.Create(output)
+// collectFiles appends the templates and definitions files that would be
+// processed in the source directory, in the order they would be processed.
+func (p *Preprocessor) collectFiles(source string, rel string, templates *[]string, defs *[]string) error {
+	excludes := len(p.exclude)
+	defer func() { p.exclude = p.exclude[:excludes] }()
+
+	err := p.loadIgnoreFile(source, rel)
+	if err != nil {
+		return err
+	}
+
+	dirs, files, tfdefs, err := p.getDirectoryContents(source, rel)
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
+	if tfdefs {
+		*defs = append(*defs, path.Join(source, tfdefsFilename))
+	}
+
+	for _, file := range files {
+		*templates = append(*templates, path.Join(source, file))
+	}
+
+	if !p.noRecurse {
+		for _, dir := range dirs {
+			err = p.collectFiles(path.Join(source, dir), path.Join(rel, dir), templates, defs)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// isIncluded reports whether the template at rel passes the include and
+// exclude patterns.
+func (p *Preprocessor) isIncluded(rel string) bool {
+	if matchPatterns(p.exclude, rel, false) {
+		return false
+	}
+
+	// Without include patterns, every template is included.
+	return len(p.include) == 0 || matchPatterns(p.include, rel, false)
+}
+
+func (p *Preprocessor) processFile(input string, output string) error {
+	var buffer bytes.Buffer
+	var sources []int
 
 	p.parser.SetFile(input)
 	p.parser.Enter()
 
-	err = p.parser.Parse(func(line string) {
-		f.WriteString(line + eol)
+	source := sourceMapPath(input, output)
+	previous := -1
+
+	err := p.parser.ParseLines(func(line string, number int) {
+		// Mark the first line, and those that don't follow on from the
+		// previous one. The comment itself has no template line.
+		if p.sourceMap == SourceMapComments && number != previous+1 {
+			buffer.WriteString(sourceMapComment(source, number) + eol)
+			sources = append(sources, 0)
+		}
+		previous = number
+
+		buffer.WriteString(line + eol)
+		if p.parser.emitted || p.parser.substituted {
+			sources = append(sources, -number)
+		} else {
+			sources = append(sources, number)
+		}
 	})
 	if err != nil {
 		return err
 	}
 
 	p.parser.Leave()
-	return nil
+
+	if p.rendered != nil {
+		p.rendered[output] = buffer.String()
+		if p.sources != nil {
+			p.sources[output] = sources
+		}
+		return nil
+	}
+
+	if p.sourceMap == SourceMapFile {
+		err = writeSourceMap(output, source, sources)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(output, buffer.Bytes(), 0666)
 }
 
 func (p *Preprocessor) processDefines(filename string) error {
@@ -127,10 +583,75 @@ func (p *Preprocessor) processDefines(filename string) error {
 	return p.parser.ParseDefines()
 }
 
-func (p *Preprocessor) applyDefines(defines []string, undefs []string) error {
+// applyDefines applies the environment, definitions files and command-line
+// definitions. These are applied in each directory, after its definitions
+// file, so that they take precedence over the config and definitions
+// files. Each of them takes precedence over those before it.
+func (p *Preprocessor) applyDefines() error {
+	err := p.defineSymbols(originEnvironment, p.environ, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range p.defsFiles {
+		if file.directives {
+			err = p.processDefines(file.filename)
+			if err != nil {
+				return fmt.Errorf("%s%s", file.filename, err.Error())
+			}
+		} else {
+			err = p.defineAll(file.filename, file.definitions)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return p.defineSymbols(originCommandLine, p.defines, p.undefs)
+}
+
+// defineAll applies definitions loaded from a file.
+func (p *Preprocessor) defineAll(filename string, definitions []definition) error {
+	p.parser.SetOrigin(filename)
+	defer p.parser.SetOrigin("")
+
+	for _, d := range definitions {
+		var err error
+		switch {
+		case !d.defined:
+			err = p.parser.Undef(d.name)
+		case d.value.Kind() == ValueNone:
+			err = p.parser.Define(d.name)
+		default:
+			err = p.parser.DefineValue(d.name, d.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defineSymbols defines and then undefines symbols. A definition may take
+// the form NAME=value to give the symbol a value, which is a list or map if
+// it's written as one. The origin records where the symbols come from.
+func (p *Preprocessor) defineSymbols(origin string, defines []string, undefs []string) error {
+	p.parser.SetOrigin(origin)
+	defer p.parser.SetOrigin("")
+
 	if defines != nil {
 		for _, define := range defines {
-			err := p.parser.Define(define)
+			var err error
+			if name, text, ok := splitDefine(define); ok {
+				var value Value
+				value, err = ParseValue(text)
+				if err != nil {
+					return fmt.Errorf("%s: %s", name, err.Error())
+				}
+				err = p.parser.DefineValue(name, value)
+			} else {
+				err = p.parser.Define(define)
+			}
 			if err != nil {
 				return err
 			}
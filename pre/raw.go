@@ -0,0 +1,162 @@
+package pre
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// rawKind is the kind of the lines being passed through verbatim.
+type rawKind int
+
+const (
+	rawNone rawKind = iota
+	// rawBlock is the lines of a !raw block, up to its !endraw.
+	rawBlock
+	// rawHeredoc is the lines of a heredoc, up to its marker.
+	rawHeredoc
+)
+
+// heredocPattern matches a line that begins a heredoc, such as
+// 'user_data = <<-EOF'.
+var heredocPattern = regexp.MustCompile(`<<-?([A-Za-z_][A-Za-z0-9_-]*)[ \t]*$`)
+
+// endRawPattern matches an !endraw directive, with any trailing comment.
+var endRawPattern = regexp.MustCompile(`^[ \t]*![ \t]*endraw[ \t]*($|#|/\*)`)
+
+// rawState tracks the lines that are passed through verbatim, without
+// scanning them for directives or comments: those of a !raw block, and
+// those of a heredoc unless !heredoc came before it. The state is a value,
+// so it's copied with the scanner.
+type rawState struct {
+	kind       rawKind
+	marker     string // The marker that ends a heredoc.
+	pending    bool   // A !raw directive begins a block on the next line.
+	directives bool   // The next heredoc is scanned for directives.
+}
+
+// active returns true if the next line is within a !raw block or a heredoc.
+func (r *rawState) active() bool {
+	return r.kind != rawNone
+}
+
+// rawLine returns true if a line, read while active, is verbatim text. The
+// !endraw that ends a block isn't, so it's scanned as a directive. The
+// marker that ends a heredoc is part of the heredoc.
+func (r *rawState) rawLine(line string) bool {
+	switch r.kind {
+	case rawBlock:
+		if endRawPattern.MatchString(line) {
+			r.kind = rawNone
+			return false
+		}
+	case rawHeredoc:
+		if strings.TrimSpace(line) == r.marker {
+			r.kind = rawNone
+			r.marker = ""
+		}
+	}
+	return true
+}
+
+// textLine notes a line of text outside of a multiline comment, which may
+// begin a heredoc.
+func (r *rawState) textLine(line string) {
+	trimmed := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "//") {
+		return
+	}
+
+	match := heredocPattern.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+	if r.directives {
+		r.directives = false
+		return
+	}
+	r.kind = rawHeredoc
+	r.marker = match[1]
+}
+
+// directive notes a directive, which may change how the lines that follow
+// are scanned.
+func (r *rawState) directive(name string) {
+	switch name {
+	case DirectiveRaw:
+		r.pending = true
+	case DirectiveHeredoc:
+		r.directives = true
+	}
+}
+
+// lineEnd notes the end of a directive line.
+func (r *rawState) lineEnd() {
+	if r.pending {
+		r.pending = false
+		r.kind = rawBlock
+	}
+}
+
+// verbatimLines returns the numbers of the lines of a text that are within
+// !raw blocks or heredocs, up to any syntax error.
+func verbatimLines(text string) []int {
+	s := Scanner{}
+	s.SetText(text)
+
+	var lines []int
+	for {
+		raw := s.state == scanStateInit && s.raw.active()
+		token, _, err := s.Scan()
+		if err != nil || token == TokenEnd {
+			return lines
+		}
+		if raw && token == TokenText {
+			lines = append(lines, s.Line())
+		}
+	}
+}
+
+// parseRaw begins a block whose lines are included as written, without
+// being scanned for directives or comments. The scanner passes the lines
+// through until the !endraw.
+func (p *Parser) parseRaw() error {
+	if p.verbose {
+		fmt.Printf("parseRaw\n")
+	}
+
+	err := p.expectDirectiveEnd(DirectiveRaw)
+	if err != nil {
+		return err
+	}
+
+	p.inRaw = true
+	return nil
+}
+
+func (p *Parser) parseEndRaw() error {
+	if p.verbose {
+		fmt.Printf("parseEndRaw\n")
+	}
+
+	err := p.expectDirectiveEnd(DirectiveEndraw)
+	if err != nil {
+		return err
+	}
+
+	if !p.inRaw {
+		return SyntaxError{"!endraw without !raw", p.scanner.Line(), 0, SyntaxErrorInvalidDirective}
+	}
+	p.inRaw = false
+	return nil
+}
+
+// parseHeredoc scans the next heredoc for directives, rather than passing
+// its lines through as written.
+func (p *Parser) parseHeredoc() error {
+	if p.verbose {
+		fmt.Printf("parseHeredoc\n")
+	}
+
+	return p.expectDirectiveEnd(DirectiveHeredoc)
+}
@@ -0,0 +1,90 @@
+package pre
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRaw(t *testing.T) {
+	text := `!raw
+! grep -v x
+/* not a comment
+!endif
+  !endraw # Comment
+!if matches(ENV, "^prod$")
+a
+!raw
+# kept
+!endraw
+!endif
+b`
+
+	switchExpect(t, "prod", text, "! grep -v x,/* not a comment,!endif,a,# kept,b")
+	switchExpect(t, "dev", text, "! grep -v x,/* not a comment,!endif,b")
+}
+
+func TestHeredoc(t *testing.T) {
+	text := `user_data = <<-EOF
+  !/bin/bash
+  !if ENV
+  EOF
+# x = <<EOF
+!heredoc
+policy = <<POLICY
+!if matches(ENV, "^prod$")
+prod
+!endif
+POLICY
+z = <<EOF
+!endif
+EOF`
+
+	switchExpect(t, "prod", text, "user_data = <<-EOF,  !/bin/bash,  !if ENV,  EOF,# x = <<EOF,policy = <<POLICY,prod,POLICY,z = <<EOF,!endif,EOF")
+	switchExpect(t, "dev", text, "user_data = <<-EOF,  !/bin/bash,  !if ENV,  EOF,# x = <<EOF,policy = <<POLICY,POLICY,z = <<EOF,!endif,EOF")
+}
+
+func TestRawErrors(t *testing.T) {
+	for _, text := range []string{"!endraw\n", "!raw x\n!endraw\n", "!raw\n!endraw\n!endraw\n"} {
+		p := Parser{}
+		p.SetText(text)
+		p.Enter()
+
+		err := p.ParseLines(func(string, int) {})
+		if _, ok := err.(SyntaxError); !ok {
+			t.Errorf("Expected a syntax error for %q but received %v", text, err)
+		}
+	}
+
+	diagnostics := LintText("main.tft", "!raw\n!if\n", 0)
+	lintExpect(t, diagnostics, []Diagnostic{
+		{"main.tft", 1, RuleSyntax, SeverityError, "!raw without !endraw"},
+	})
+}
+
+func TestFormatRaw(t *testing.T) {
+	formatExpect(t, 2,
+		"!if  A\n"+
+			"! raw\n"+
+			"!if  B\n"+
+			"!endraw\n"+
+			"x = <<EOF\n"+
+			"! endif\n"+
+			"EOF\n"+
+			"!endif\n",
+		"!if A\n"+
+			"  !raw\n"+
+			"!if  B\n"+
+			"  !endraw\n"+
+			"x = <<EOF\n"+
+			"! endif\n"+
+			"EOF\n"+
+			"!endif\n")
+}
+
+func TestVerbatimLines(t *testing.T) {
+	text := strings.Join([]string{"!raw", "!a", "!endraw", "x = <<EOF", "!b", "EOF", "!heredoc", "y = <<EOF", "!if A", "!endif", "EOF"}, "\n")
+	if lines := verbatimLines(text); !reflect.DeepEqual(lines, []int{2, 5, 6}) {
+		t.Errorf("Expected lines 2, 5 and 6 to be verbatim but received %v", lines)
+	}
+}
@@ -0,0 +1,62 @@
+package pre
+
+import "os"
+
+// The origin of symbols found by a parser's resolver.
+const originResolver = "resolver"
+
+// SymbolResolver looks up symbols by name. A parser consults its resolver
+// for symbols that haven't been defined or undefined by directives or the
+// Define and Undef methods.
+type SymbolResolver interface {
+	// Lookup returns the value of a symbol and whether it is defined.
+	Lookup(name string) (Value, bool)
+}
+
+// MapResolver resolves the symbols in a map. Symbols defined without a value
+// have the zero Value.
+type MapResolver map[string]Value
+
+// Lookup returns the value of a symbol and whether it is defined.
+func (m MapResolver) Lookup(name string) (Value, bool) {
+	value, ok := m[name]
+	return value, ok
+}
+
+// FuncResolver resolves symbols by calling a function.
+type FuncResolver func(name string) (Value, bool)
+
+// Lookup returns the value of a symbol and whether it is defined.
+func (f FuncResolver) Lookup(name string) (Value, bool) {
+	return f(name)
+}
+
+// EnvironmentResolver resolves a symbol from the environment variable named
+// by the symbol with Prefix before it. The symbol is defined if the variable
+// is set, and takes its value.
+type EnvironmentResolver struct {
+	Prefix string
+}
+
+// Lookup returns the value of a symbol and whether it is defined.
+func (r EnvironmentResolver) Lookup(name string) (Value, bool) {
+	value, ok := os.LookupEnv(r.Prefix + name)
+	if !ok {
+		return Value{}, false
+	}
+	return StringValue(value), true
+}
+
+// ChainResolver resolves a symbol from the first of its resolvers that
+// defines it.
+type ChainResolver []SymbolResolver
+
+// Lookup returns the value of a symbol and whether it is defined.
+func (c ChainResolver) Lookup(name string) (Value, bool) {
+	for _, r := range c {
+		if value, ok := r.Lookup(name); ok {
+			return value, true
+		}
+	}
+	return Value{}, false
+}
@@ -0,0 +1,55 @@
+package pre
+
+import (
+	"os"
+	"testing"
+)
+
+func TestResolvers(t *testing.T) {
+	os.Setenv("TERRACOTTA_RESOLVER_TEST_A", "env")
+	defer os.Unsetenv("TERRACOTTA_RESOLVER_TEST_A")
+
+	chain := ChainResolver{
+		MapResolver{"B": StringValue("map")},
+		EnvironmentResolver{"TERRACOTTA_RESOLVER_TEST_"},
+		FuncResolver(func(name string) (Value, bool) { return StringValue("func"), name == "A" || name == "C" }),
+	}
+
+	expected := map[string]string{"A": "env", "B": "map", "C": "func"}
+	for name, text := range expected {
+		value, ok := chain.Lookup(name)
+		if !ok || value.String() != text {
+			t.Errorf("Expected %s to resolve to %s but received %t %s", name, text, ok, value)
+		}
+	}
+
+	if _, ok := chain.Lookup("D"); ok {
+		t.Error("Expected D to be undefined")
+	}
+}
+
+func TestParserResolver(t *testing.T) {
+	p := Parser{}
+	p.SetResolver(MapResolver{"FLAG": Value{}, "OFF": Value{}})
+
+	// Directives take precedence over the resolver.
+	p.SetText("!undef OFF\n!if FLAG && !OFF\nyes\n!endif\n")
+
+	p.Enter()
+	parseExpectDirective(t, &p)
+	parseExpectDirective(t, &p)
+	parseExpectText(t, &p, "yes", true)
+	parseExpectDirective(t, &p)
+	parseExpectEnd(t, &p)
+
+	if _, ok := p.Names().Lookup("FLAG"); ok {
+		t.Error("Expected Names not to include resolved symbols")
+	}
+	if _, ok := p.Names().Lookup("OFF"); ok {
+		t.Error("Expected OFF to be undefined")
+	}
+	if origin := p.context.origin("FLAG"); origin != originResolver {
+		t.Errorf("Expected FLAG to come from the resolver but received '%s'", origin)
+	}
+	p.Leave()
+}
@@ -3,6 +3,7 @@ package pre
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"unicode"
 )
 
@@ -21,6 +22,8 @@ const (
 	scanStateMultiComment
 	scanStateSlash
 	scanStateHash
+	scanStateString
+	scanStateNumber
 )
 
 // We use a '!' since '#' is reserved for single-line comments.
@@ -36,9 +39,13 @@ type Scanner struct {
 	nextText  string
 	nextErr   error
 	line      int
+	lineStart int  // The position of the first rune of the current line.
+	lastStart int  // The position of the first rune of the previous line.
+	start     int  // The position of the first rune of the last parameter token.
 	comment   bool // Is the scanner currently in a multiline comment?
 	multiline int
 	prev      scanState // The state previous to the comment.
+	raw       rawState  // The lines passed through verbatim.
 	verbose   bool
 }
 
@@ -46,7 +53,11 @@ func (s *Scanner) reset() {
 	s.state = scanStateInit
 	s.lookahead = 0
 	s.line = 0
+	s.lineStart = 0
+	s.lastStart = 0
+	s.start = 0
 	s.comment = false
+	s.raw = rawState{}
 }
 
 func (s *Scanner) SetFile(name string) {
@@ -71,6 +82,27 @@ func (s *Scanner) Line() int {
 	return s.line
 }
 
+// TokenLine returns the line of the last directive parameter token. This is
+// the line of the directive, even before the end of the line is scanned.
+func (s *Scanner) TokenLine() int {
+	// A token at the end of a line is returned after the line ends.
+	if s.start < s.lineStart {
+		return s.line
+	}
+	return s.line + 1
+}
+
+// Column returns the column, from one, at which the last directive parameter
+// token began. It can be used to locate an error within a directive.
+func (s *Scanner) Column() int {
+	// A token at the end of a line is returned after the line ends.
+	lineStart := s.lineStart
+	if s.start < lineStart {
+		lineStart = s.lastStart
+	}
+	return s.start - lineStart + 1
+}
+
 // Peek returns k=1 lookahead tokens.
 func (s *Scanner) Peek() (Token, string, error) {
 	if s.lookahead > 1 {
@@ -108,6 +140,13 @@ func (s *Scanner) Scan() (Token, string, error) {
 		return TokenEnd, "", nil
 	}
 
+	// The lines of a !raw block or a heredoc are text, as written.
+	if s.state == scanStateInit && s.raw.active() {
+		if line, ok := s.scanRawLine(); ok {
+			return TokenText, line, nil
+		}
+	}
+
 	var text bytes.Buffer
 	for {
 		r := s.buffer.next()
@@ -137,7 +176,17 @@ func (s *Scanner) Scan() (Token, string, error) {
 					s.state = scanStateText
 				}
 			case directivePrefixRune: // '!'
-				s.state = scanStateBang
+				// A substitution, such as !{NAME}, begins text.
+				end := s.buffer.position + len(substitutionEscape) - 1
+				if end > len(s.buffer.runes) {
+					end = len(s.buffer.runes)
+				}
+				if hasSubstitutionPrefix(string(s.buffer.runes[s.buffer.position-1 : end])) {
+					s.state = scanStateText
+					text.WriteRune(r)
+				} else {
+					s.state = scanStateBang
+				}
 			default:
 				s.state = scanStateText
 				text.WriteRune(r)
@@ -151,6 +200,7 @@ func (s *Scanner) Scan() (Token, string, error) {
 			case '\r', '\n', unicode.MaxRune:
 				s.nextLine(r)
 				s.state = scanStateInit
+				s.raw.textLine(text.String())
 				return TokenText, text.String(), nil
 			case '/':
 				if s.buffer.current() == '*' {
@@ -195,6 +245,7 @@ func (s *Scanner) Scan() (Token, string, error) {
 			case r == '\r' || r == '\n' || r == unicode.MaxRune:
 				s.nextLine(r)
 				s.state = scanStateLine
+				s.raw.directive(text.String())
 				return TokenDirective, text.String(), nil
 			case r == '#':
 				// Any single-line comments after a directive get eaten.
@@ -213,6 +264,7 @@ func (s *Scanner) Scan() (Token, string, error) {
 			default:
 				s.state = scanStateParams
 				s.buffer.push()
+				s.raw.directive(text.String())
 				return TokenDirective, text.String(), nil
 			}
 
@@ -220,6 +272,9 @@ func (s *Scanner) Scan() (Token, string, error) {
 			if s.verbose {
 				fmt.Printf("scanStateParams %#U\n", r)
 			}
+			if r != ' ' && r != '\t' {
+				s.start = s.buffer.position - 1
+			}
 			switch {
 			case r == ' ' || r == '\t':
 				// Ignore interstitial whitespace
@@ -247,6 +302,17 @@ func (s *Scanner) Scan() (Token, string, error) {
 				return TokenLParen, "", nil
 			case r == ')':
 				return TokenRParen, "", nil
+			case r == ',':
+				return TokenComma, "", nil
+			case r == '[':
+				return TokenLBracket, "", nil
+			case r == ']':
+				return TokenRBracket, "", nil
+			case unicode.IsDigit(r):
+				s.state = scanStateNumber
+				text.WriteRune(r)
+			case r == '"':
+				s.state = scanStateString
 			case r == '#':
 				// Any single-line comments after a directive get eaten.
 				text.WriteRune(r)
@@ -286,6 +352,43 @@ func (s *Scanner) Scan() (Token, string, error) {
 				return TokenIdentifier, text.String(), nil
 			}
 
+		case scanStateNumber:
+			if s.verbose {
+				fmt.Printf("scanStateNumber %#U\n", r)
+			}
+			switch {
+			case unicode.IsDigit(r):
+				text.WriteRune(r)
+			case r == '\r' || r == '\n' || r == unicode.MaxRune:
+				s.nextLine(r)
+				s.state = scanStateLine
+				return TokenNumber, text.String(), nil
+			default:
+				s.buffer.push()
+				s.state = scanStateParams
+				return TokenNumber, text.String(), nil
+			}
+
+		case scanStateString:
+			if s.verbose {
+				fmt.Printf("scanStateString %#U\n", r)
+			}
+			switch r {
+			case '"':
+				s.state = scanStateParams
+				return TokenString, text.String(), nil
+			case '\\':
+				// Escape the next rune, such as a quote.
+				next := s.buffer.current()
+				if next != '\r' && next != '\n' && next != unicode.MaxRune {
+					text.WriteRune(s.buffer.next())
+				}
+			case '\r', '\n', unicode.MaxRune:
+				return TokenNone, text.String(), SyntaxError{"Unterminated string", s.line, 0, SyntaxErrorUnterminatedString}
+			default:
+				text.WriteRune(r)
+			}
+
 		case scanStateLine:
 			if s.verbose {
 				fmt.Printf("scanStateLine\n")
@@ -297,6 +400,7 @@ func (s *Scanner) Scan() (Token, string, error) {
 			}
 
 			s.state = scanStateInit
+			s.raw.lineEnd()
 			return TokenLine, "", nil
 
 		case scanStateSingleComment:
@@ -351,6 +455,117 @@ func (s *Scanner) Scan() (Token, string, error) {
 	}
 }
 
+// ScanRest returns the remaining text on the current directive line, with
+// surrounding whitespace removed. This allows a directive to take free-form
+// parameters, such as a message. The end of line is left to be scanned.
+func (s *Scanner) ScanRest() (string, error) {
+	if s.lookahead > 0 {
+		return "", ProcessingError{"Invalid lookahead", s.line, 0, ProcessingInvalidLookahead}
+	}
+
+	// The directive was the last thing on the line.
+	if s.state != scanStateParams {
+		return "", nil
+	}
+
+	var text bytes.Buffer
+	for {
+		r := s.buffer.next()
+		switch r {
+		case '\r', '\n', unicode.MaxRune:
+			s.nextLine(r)
+			s.state = scanStateLine
+			return strings.TrimSpace(text.String()), nil
+		case ' ', '\t':
+			if text.Len() > 0 {
+				text.WriteRune(r)
+			}
+		default:
+			// The column is that of the first rune of the text.
+			if text.Len() == 0 {
+				s.start = s.buffer.position - 1
+			}
+			text.WriteRune(r)
+		}
+	}
+}
+
+// ScanWord returns the next directive parameter if it's a bare word, as in
+// the value of a !define, and true. A word ends at whitespace, a comma or a
+// comment. A symbol isn't a word, so nothing is scanned if the parameter is
+// a symbol, possibly followed by an index or arguments, or a quoted string.
+func (s *Scanner) ScanWord() (string, bool) {
+	if s.lookahead > 0 || s.state != scanStateParams {
+		return "", false
+	}
+
+	start := s.buffer.position
+	for start < len(s.buffer.runes) && (s.buffer.runes[start] == ' ' || s.buffer.runes[start] == '\t') {
+		start++
+	}
+
+	end := start
+	symbol := true
+	for end < len(s.buffer.runes) {
+		r := s.buffer.runes[end]
+		if !isBareRune(r) || (r == '/' && end+1 < len(s.buffer.runes) && (s.buffer.runes[end+1] == '/' || s.buffer.runes[end+1] == '*')) {
+			break
+		}
+		if r != '_' && !unicode.IsLetter(r) {
+			symbol = false
+		}
+		end++
+	}
+
+	if end == start || symbol || s.buffer.runes[start] == '!' {
+		return "", false
+	}
+
+	s.start = start
+	s.buffer.position = end
+	return string(s.buffer.runes[start:end]), true
+}
+
+// scanRawLine returns the next line as written, if it's within a !raw block
+// or a heredoc. The !endraw that ends a block is left to be scanned.
+func (s *Scanner) scanRawLine() (string, bool) {
+	end := s.buffer.position
+	for end < len(s.buffer.runes) && s.buffer.runes[end] != '\r' && s.buffer.runes[end] != '\n' {
+		end++
+	}
+
+	line := string(s.buffer.runes[s.buffer.position:end])
+	if !s.raw.rawLine(line) {
+		return "", false
+	}
+
+	s.buffer.position = end
+	s.nextLine(s.buffer.next())
+	return line, true
+}
+
+// HasRest returns true if text other than a comment remains on the current
+// directive line, which ScanRest would return.
+func (s *Scanner) HasRest() bool {
+	if s.lookahead > 0 || s.state != scanStateParams {
+		return false
+	}
+
+	for i := s.buffer.position; i < len(s.buffer.runes); i++ {
+		switch r := s.buffer.runes[i]; r {
+		case ' ', '\t':
+			continue
+		case '\r', '\n', '#':
+			return false
+		case '/':
+			return i+1 >= len(s.buffer.runes) || s.buffer.runes[i+1] != '*'
+		default:
+			return true
+		}
+	}
+	return false
+}
+
 // chomp will eat any remaining end of line characters.
 // This is mainly useful on Windows, which uses CR\LF.
 // NOTE: Should not eat any following lines.
@@ -367,6 +582,8 @@ func (s *Scanner) chomp(current rune) {
 func (s *Scanner) nextLine(current rune) {
 	s.chomp(current)
 	s.line++
+	s.lastStart = s.lineStart
+	s.lineStart = s.buffer.position
 	if s.verbose {
 		fmt.Println("LINE")
 	}
@@ -211,6 +211,24 @@ func TestInvalidSlash(t *testing.T) {
 	scanExpectSyntaxErrorKind(t, &s, SyntaxErrorInvalidDirective)
 }
 
+func TestStringParameters(t *testing.T) {
+	s := Scanner{}
+	// s.SetVerbose(true)
+
+	s.SetText("!if env(\"CI\") && \"a \\\" b\"\n!if \"open\n")
+
+	scanExpectTokenText(t, &s, TokenDirective, DirectiveIf)
+	scanExpectTokenText(t, &s, TokenIdentifier, "env")
+	scanExpectToken(t, &s, TokenLParen)
+	scanExpectTokenText(t, &s, TokenString, "CI")
+	scanExpectToken(t, &s, TokenRParen)
+	scanExpectToken(t, &s, TokenAnd)
+	scanExpectTokenText(t, &s, TokenString, "a \" b")
+	scanExpectToken(t, &s, TokenLine)
+	scanExpectTokenText(t, &s, TokenDirective, DirectiveIf)
+	scanExpectSyntaxErrorKind(t, &s, SyntaxErrorUnterminatedString)
+}
+
 //
 // Helpers
 //
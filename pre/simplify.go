@@ -0,0 +1,340 @@
+package pre
+
+import (
+	"bytes"
+	"strings"
+)
+
+// truth is the result of partially evaluating a condition.
+type truth int
+
+const (
+	truthUnknown truth = iota
+	truthFalse
+	truthTrue
+)
+
+func truthOf(value bool) truth {
+	if value {
+		return truthTrue
+	}
+	return truthFalse
+}
+
+// KnownSymbol is the fixed state of a symbol for SimplifyText.
+type KnownSymbol struct {
+	// Defined is true if the symbol is defined, whatever its value.
+	Defined bool
+	// Truth is the symbol's value as a condition.
+	Truth bool
+}
+
+// KnownSymbols converts definitions, which may take the form NAME=value,
+// and undefinitions into the fixed states of symbols for SimplifyText. A
+// defined symbol is true or false as given by Value.Truth.
+func KnownSymbols(defines []string, undefs []string) map[string]KnownSymbol {
+	known := make(map[string]KnownSymbol)
+	for _, define := range defines {
+		name, text, ok := splitDefine(define)
+		value, err := ParseValue(text)
+		if err != nil {
+			value = StringValue(text)
+		}
+		known[name] = KnownSymbol{true, !ok || value.Truth()}
+	}
+	for _, undef := range undefs {
+		known[undef] = KnownSymbol{false, false}
+	}
+	return known
+}
+
+// simplifyNode is a text line, a directive other than a conditional, or a
+// conditional block. A directive followed by a multiline comment spans
+// several lines.
+type simplifyNode struct {
+	lines []string
+	block *simplifyBlock
+}
+
+type simplifyArm struct {
+	item  outlineItem
+	lines []string
+	body  []simplifyNode
+}
+
+type simplifyBlock struct {
+	arms  []simplifyArm
+	endif []string
+}
+
+// SimplifyText resolves the conditional blocks of a template whose
+// conditions are fixed by the known symbols. Arms that can't be taken are
+// removed, an arm that's always taken replaces its block or becomes its
+// !else, and conditions are simplified. !ifdef, !ifndef and defined()
+// depend only on whether a known symbol is defined. Conditions that don't refer to a
+// known symbol are left as written. A symbol that's defined or undefined
+// within the template isn't treated as known.
+func SimplifyText(text string, known map[string]KnownSymbol) (string, error) {
+	p := Parser{}
+	p.SetText(text)
+	items, err := p.outline()
+	if err != nil {
+		return "", err
+	}
+
+	known = copyKnown(known)
+
+	// Each item spans the lines following the previous item.
+	lines := splitLinesKeepEnds(text)
+	spans := make([][]string, len(items))
+	start := 0
+	for i, item := range items {
+		end := item.line
+		if end > len(lines) {
+			end = len(lines)
+		}
+		if end < start {
+			end = start
+		}
+		spans[i] = lines[start:end]
+		start = end
+
+		if item.directive == DirectiveDefine || item.directive == DirectiveUndef {
+			delete(known, item.symbol)
+		}
+	}
+
+	index := 0
+	nodes, err := simplifyNodes(items, spans, &index)
+	if err != nil {
+		return "", err
+	}
+
+	if index < len(items) {
+		return "", SyntaxError{"!" + items[index].directive + " without !if", items[index].line, 0, SyntaxErrorInvalidDirective}
+	}
+
+	var result bytes.Buffer
+	writeSimplified(&result, nodes, known)
+	return result.String(), nil
+}
+
+func copyKnown(known map[string]KnownSymbol) map[string]KnownSymbol {
+	result := make(map[string]KnownSymbol)
+	for name, value := range known {
+		result[name] = value
+	}
+	return result
+}
+
+// simplifyNodes builds the nodes up to the end of the items or the next
+// !elif, !else or !endif, which is left at index.
+func simplifyNodes(items []outlineItem, spans [][]string, index *int) ([]simplifyNode, error) {
+	var nodes []simplifyNode
+	for *index < len(items) {
+		item := items[*index]
+		switch item.directive {
+		case DirectiveElif, DirectiveElse, DirectiveEndif:
+			return nodes, nil
+		case DirectiveIf, DirectiveIfdef, DirectiveIfndef:
+			block, err := simplifyBlockNode(items, spans, index)
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, simplifyNode{block: block})
+		default:
+			nodes = append(nodes, simplifyNode{lines: spans[*index]})
+			*index++
+		}
+	}
+	return nodes, nil
+}
+
+func simplifyBlockNode(items []outlineItem, spans [][]string, index *int) (*simplifyBlock, error) {
+	start := items[*index]
+	block := &simplifyBlock{}
+	for *index < len(items) {
+		item := items[*index]
+		if item.directive == DirectiveEndif {
+			block.endif = spans[*index]
+			*index++
+			return block, nil
+		}
+
+		lines := spans[*index]
+		*index++
+		body, err := simplifyNodes(items, spans, index)
+		if err != nil {
+			return nil, err
+		}
+		block.arms = append(block.arms, simplifyArm{item, lines, body})
+	}
+
+	return nil, SyntaxError{"!if without !endif", start.line, 0, SyntaxErrorInvalidDirective}
+}
+
+func writeSimplified(result *bytes.Buffer, nodes []simplifyNode, known map[string]KnownSymbol) {
+	for _, node := range nodes {
+		if node.block == nil {
+			writeLines(result, node.lines)
+		} else {
+			writeSimplifiedBlock(result, node.block, known)
+		}
+	}
+}
+
+func writeSimplifiedBlock(result *bytes.Buffer, block *simplifyBlock, known map[string]KnownSymbol) {
+	first := true
+	for _, arm := range block.arms {
+		condition, value, changed := resolveArm(arm, known)
+		switch value {
+		case truthFalse:
+			continue
+		case truthTrue:
+			if first {
+				// The arm replaces the block.
+				writeSimplified(result, arm.body, known)
+				return
+			}
+			if arm.item.directive == DirectiveElse {
+				writeLines(result, arm.lines)
+			} else {
+				writeDirective(result, arm.lines, DirectiveElse, nil)
+			}
+			writeSimplified(result, arm.body, known)
+			writeLines(result, block.endif)
+			return
+		}
+
+		directive := arm.item.directive
+		if first && !isIfDirective(directive) {
+			directive = DirectiveIf
+		}
+		if changed || directive != arm.item.directive {
+			writeDirective(result, arm.lines, directive, condition)
+		} else {
+			writeLines(result, arm.lines)
+		}
+		writeSimplified(result, arm.body, known)
+		first = false
+	}
+
+	if !first {
+		writeLines(result, block.endif)
+	}
+}
+
+// resolveArm partially evaluates the condition of an arm. It returns the
+// simplified condition, whether it's fixed, and whether it changed. An
+// !else arm is always taken.
+func resolveArm(arm simplifyArm, known map[string]KnownSymbol) (*Expression, truth, bool) {
+	if arm.item.directive == DirectiveElse {
+		return nil, truthTrue, false
+	}
+
+	condition := arm.item.condition
+	for _, name := range expressionSymbols(condition) {
+		if _, ok := known[name]; ok {
+			simplified, value := partialEvaluate(condition, known)
+			changed := value != truthUnknown || formatCondition(simplified) != formatCondition(condition)
+			return simplified, value, changed
+		}
+	}
+
+	return condition, truthUnknown, false
+}
+
+// partialEvaluate evaluates the parts of an expression that depend only on
+// known symbols and literals. If the result isn't fixed, it returns the
+// remaining expression.
+func partialEvaluate(e *Expression, known map[string]KnownSymbol) (*Expression, truth) {
+	switch e.kind {
+	case ExpressionIdentifier:
+		switch e.identifier {
+		case "true":
+			return nil, truthTrue
+		case "false":
+			return nil, truthFalse
+		}
+		if symbol, ok := known[e.identifier]; ok {
+			return nil, truthOf(symbol.Truth)
+		}
+		return e, truthUnknown
+	case ExpressionCall:
+		// defined() is fixed by a known symbol, like !ifdef and !ifndef.
+		if e.identifier == FunctionDefined && len(e.arguments) == 1 && e.arguments[0].kind == ExpressionIdentifier {
+			if symbol, ok := known[e.arguments[0].identifier]; ok {
+				return nil, truthOf(symbol.Defined)
+			}
+		}
+	case ExpressionGroup:
+		inner, value := partialEvaluate(e.left, known)
+		if value != truthUnknown {
+			return nil, value
+		}
+		return &Expression{ExpressionGroup, TokenNone, "", inner, nil, nil, 0}, truthUnknown
+	case ExpressionUnary:
+		inner, value := partialEvaluate(e.left, known)
+		switch value {
+		case truthTrue:
+			return nil, truthFalse
+		case truthFalse:
+			return nil, truthTrue
+		}
+		return &Expression{ExpressionUnary, e.operator, "", inner, nil, nil, 0}, truthUnknown
+	case ExpressionBinary:
+		left, leftValue := partialEvaluate(e.left, known)
+		right, rightValue := partialEvaluate(e.right, known)
+
+		// The value that decides the result on its own, and the value
+		// that leaves the result to the other operand.
+		decisive, neutral := truthFalse, truthTrue
+		if e.operator == TokenOr {
+			decisive, neutral = truthTrue, truthFalse
+		}
+
+		switch {
+		case leftValue == decisive || rightValue == decisive:
+			return nil, decisive
+		case leftValue == neutral:
+			return right, rightValue
+		case rightValue == neutral:
+			return left, leftValue
+		}
+		return &Expression{ExpressionBinary, e.operator, "", left, right, nil, 0}, truthUnknown
+	}
+
+	// Other function calls depend on the environment.
+	return e, truthUnknown
+}
+
+// writeDirective writes a conditional directive in place of the lines of
+// another, keeping its indentation, trailing comment and line ending.
+func writeDirective(result *bytes.Buffer, lines []string, directive string, condition *Expression) {
+	content := strings.TrimRight(lines[0], "\r\n")
+	ending := lines[0][len(content):]
+	if len(lines) > 1 {
+		last := lines[len(lines)-1]
+		ending = last[len(strings.TrimRight(last, "\r\n")):]
+	}
+
+	trimmed := strings.TrimLeft(content, " \t")
+	result.WriteString(content[:len(content)-len(trimmed)])
+	result.WriteString(directivePrefixString + directive)
+	if condition != nil {
+		result.WriteString(" " + formatCondition(condition))
+	}
+
+	// A comment that spans lines is dropped with the directive.
+	if _, trailing, ok := splitDirectiveComment(trimmed); ok && trailing != "" {
+		result.WriteString(" " + trailing)
+	}
+
+	result.WriteString(ending)
+}
+
+func writeLines(result *bytes.Buffer, lines []string) {
+	for _, line := range lines {
+		result.WriteString(line)
+	}
+}
@@ -0,0 +1,78 @@
+package pre
+
+import "testing"
+
+func TestSimplifyBlocks(t *testing.T) {
+	known := KnownSymbols([]string{"NEW=true"}, []string{"OLD"})
+
+	// An arm that's always taken replaces the block.
+	simplifyExpect(t, known,
+		"a\n!if OLD\nold\n!else\nnew\n!endif\nb\n",
+		"a\nnew\nb\n")
+
+	// Arms that can't be taken are removed, and the first remaining !elif
+	// becomes the !if.
+	simplifyExpect(t, known,
+		"!if OLD\nold\n  !elif A # Comment\na\n!elif NEW\nnew\n!elif B\nb\n!endif\n",
+		"  !if A # Comment\na\n!else\nnew\n!endif\n")
+
+	// Conditions are simplified, and those on unknown symbols are kept.
+	simplifyExpect(t, known,
+		"!if (A || OLD) && NEW\na\n!elif !OLD && B\nb\n!elif  C\nc\n!endif\n",
+		"!if A\na\n!elif B\nb\n!elif  C\nc\n!endif\n")
+
+	// Nested blocks are simplified within the arms that remain.
+	simplifyExpect(t, known,
+		"!if A\n!if NEW\nx\n!endif\n!elif OLD\n!if NEW\ny\n!endif\n!endif\n",
+		"!if A\nx\n!endif\n")
+
+	// A block with no arms left is removed.
+	simplifyExpect(t, known, "a\n!if OLD\nx\n!endif\n", "a\n")
+}
+
+func TestSimplifyIfdef(t *testing.T) {
+	known := KnownSymbols([]string{"NEW=false"}, []string{"OLD"})
+
+	// !ifdef, !ifndef and defined() depend on whether a symbol is defined,
+	// not its value.
+	simplifyExpect(t, known,
+		"!ifdef NEW\nx\n!elif A\na\n!endif\n!ifndef OLD\ny\n!endif\n!ifdef OLD\nz\n!endif\n",
+		"x\ny\n")
+	simplifyExpect(t, known,
+		"!if defined(NEW) && !NEW\nx\n!elif defined(OLD) || A\na\n!endif\n",
+		"x\n")
+
+	// An !elif following an !ifdef is still simplified, and an !ifdef on
+	// another symbol is kept as written.
+	simplifyExpect(t, known,
+		"!ifdef A\na\n!elif !NEW && B\nb\n!endif\n",
+		"!ifdef A\na\n!elif B\nb\n!endif\n")
+}
+
+func TestSimplifyLocalDefinitions(t *testing.T) {
+	known := KnownSymbols(nil, []string{"OLD"})
+
+	// A symbol defined within the template isn't known.
+	text := "!define OLD\n!if OLD\nx\n!endif\n"
+	simplifyExpect(t, known, text, text)
+}
+
+func TestKnownSymbols(t *testing.T) {
+	known := KnownSymbols([]string{"A", "B=false", "C=0", "D=prod"}, []string{"E"})
+	expected := map[string]KnownSymbol{"A": {true, true}, "B": {true, false}, "C": {true, false}, "D": {true, true}, "E": {false, false}}
+	for name, symbol := range expected {
+		if known[name] != symbol {
+			t.Errorf("Expected %s to be %v but received %v", name, symbol, known[name])
+		}
+	}
+}
+
+func simplifyExpect(t *testing.T, known map[string]KnownSymbol, text string, expected string) {
+	result, err := SimplifyText(text, known)
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+	if result != expected {
+		t.Errorf("Expected:\n%q\nbut received:\n%q", expected, result)
+	}
+}
@@ -0,0 +1,237 @@
+package pre
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SourceMapExtension is appended to the name of a generated file to name its
+// source map.
+const SourceMapExtension = ".map"
+
+// sourceMapMarker begins a comment that gives the template line of the
+// generated line that follows it.
+const sourceMapMarker = "# terracotta:line "
+
+// generatedLocation matches a location in a generated file, as given by
+// Terraform ('main.tf line 12') or other tools ('main.tf:12').
+var generatedLocation = regexp.MustCompile(`([\w./\\-]+\.tf)(:| line )([0-9]+)`)
+
+// SourceMapMode determines how generated lines are mapped to their templates.
+type SourceMapMode int
+
+const (
+	// SourceMapNone writes no source map.
+	SourceMapNone SourceMapMode = iota
+	// SourceMapFile writes a JSON source map beside each generated file.
+	SourceMapFile
+	// SourceMapComments writes a comment into the generated file before the
+	// first line, and wherever the following lines don't continue from the
+	// previous template line.
+	SourceMapComments
+)
+
+// ParseSourceMapMode returns the mode named by 'none', 'file' or 'comments'.
+// An empty name is the same as 'none'.
+func ParseSourceMapMode(name string) (SourceMapMode, error) {
+	switch name {
+	case "", "none":
+		return SourceMapNone, nil
+	case "file":
+		return SourceMapFile, nil
+	case "comments":
+		return SourceMapComments, nil
+	}
+	return SourceMapNone, fmt.Errorf("Unknown source map mode '%s'", name)
+}
+
+// SourceMap maps each line of a generated file to a template line. Template
+// paths are relative to the directory of the generated file.
+type SourceMap struct {
+	File    string   `json:"file"`
+	Sources []string `json:"sources"`
+	Lines   [][2]int `json:"lines"` // The source index and line of each generated line.
+}
+
+// SourceLocation is a line in a template.
+type SourceLocation struct {
+	Filename string
+	Line     int
+}
+
+func (l SourceLocation) String() string {
+	return fmt.Sprintf("%s:%d", l.Filename, l.Line)
+}
+
+// SetSourceMap determines whether and how processed files are mapped back to
+// their templates.
+func (p *Preprocessor) SetSourceMap(mode SourceMapMode) {
+	p.sourceMap = mode
+}
+
+// sourceMapPath returns the path of a template relative to the directory of
+// the file generated from it. The template path is returned unchanged if
+// there's no generated file or no relative path.
+func sourceMapPath(input string, output string) string {
+	if output == "" {
+		return filepath.ToSlash(input)
+	}
+
+	from, err := filepath.Abs(filepath.Dir(output))
+	if err != nil {
+		return filepath.ToSlash(input)
+	}
+	to, err := filepath.Abs(input)
+	if err != nil {
+		return filepath.ToSlash(input)
+	}
+	rel, err := filepath.Rel(from, to)
+	if err != nil {
+		return filepath.ToSlash(input)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// sourceMapComment returns the comment that maps the line following it.
+func sourceMapComment(source string, line int) string {
+	return sourceMapMarker + strconv.Itoa(line) + " " + source
+}
+
+// isSourceMapComment returns true if the generated line is a source map
+// comment.
+func isSourceMapComment(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), sourceMapMarker)
+}
+
+// parseSourceMapComment returns the template and line given by a source map
+// comment.
+func parseSourceMapComment(line string) (string, int, bool) {
+	rest := strings.TrimPrefix(strings.TrimSpace(line), sourceMapMarker)
+	fields := strings.SplitN(rest, " ", 2)
+	if len(fields) != 2 {
+		return "", 0, false
+	}
+	number, err := strconv.Atoi(fields[0])
+	if err != nil || number < 1 {
+		return "", 0, false
+	}
+	return strings.TrimSpace(fields[1]), number, true
+}
+
+// writeSourceMap writes the source map for a generated file beside it.
+func writeSourceMap(output string, source string, sources []int) error {
+	m := SourceMap{File: filepath.Base(output), Sources: []string{source}, Lines: [][2]int{}}
+	for _, line := range sources {
+		// A line that isn't copied maps to the line that generated it.
+		m.Lines = append(m.Lines, [2]int{0, sourceLine(line)})
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(output+SourceMapExtension, append(data, '\n'), 0666)
+}
+
+// MapLocation returns the template line that produced a line of a generated
+// file. It uses the source map beside the file if there is one, and otherwise
+// the source map comments within it. The template path is relative to the
+// working directory.
+func MapLocation(generated string, line int) (SourceLocation, error) {
+	dir := filepath.Dir(generated)
+
+	data, err := ioutil.ReadFile(generated + SourceMapExtension)
+	if err == nil {
+		var m SourceMap
+		if err := json.Unmarshal(data, &m); err != nil {
+			return SourceLocation{}, fmt.Errorf("%s: %w", generated+SourceMapExtension, err)
+		}
+		if line < 1 || line > len(m.Lines) {
+			return SourceLocation{}, fmt.Errorf("%s has no line %d", generated, line)
+		}
+		entry := m.Lines[line-1]
+		if entry[0] < 0 || entry[0] >= len(m.Sources) {
+			return SourceLocation{}, fmt.Errorf("%s: Line %d has an invalid source", generated+SourceMapExtension, line)
+		}
+		return SourceLocation{joinSourcePath(dir, m.Sources[entry[0]]), entry[1]}, nil
+	}
+	if !os.IsNotExist(err) {
+		return SourceLocation{}, err
+	}
+
+	text, err := ioutil.ReadFile(generated)
+	if err != nil {
+		return SourceLocation{}, err
+	}
+
+	location, err := commentLocation(string(text), line)
+	if err != nil {
+		return SourceLocation{}, fmt.Errorf("%s: %w", generated, err)
+	}
+	location.Filename = joinSourcePath(dir, location.Filename)
+	return location, nil
+}
+
+// commentLocation finds the template line of a generated line from the
+// closest source map comment before it.
+func commentLocation(text string, line int) (SourceLocation, error) {
+	lines := generatedLines(text)
+	if line < 1 || line > len(lines) {
+		return SourceLocation{}, fmt.Errorf("There is no line %d", line)
+	}
+	if isSourceMapComment(lines[line-1]) {
+		return SourceLocation{}, fmt.Errorf("Line %d is a source map comment", line)
+	}
+
+	for i := line - 2; i >= 0; i-- {
+		if !isSourceMapComment(lines[i]) {
+			continue
+		}
+		source, number, ok := parseSourceMapComment(lines[i])
+		if !ok {
+			return SourceLocation{}, fmt.Errorf("Line %d is an invalid source map comment", i+1)
+		}
+		return SourceLocation{source, number + line - i - 2}, nil
+	}
+
+	return SourceLocation{}, fmt.Errorf("There is no source map")
+}
+
+// joinSourcePath resolves a template path from a source map against the
+// directory of the generated file.
+func joinSourcePath(dir string, source string) string {
+	if filepath.IsAbs(source) {
+		return source
+	}
+	return filepath.Join(dir, filepath.FromSlash(source))
+}
+
+// MapLocations replaces the locations in generated files found in text with
+// the template lines that produced them. Generated files are relative to
+// dir. Locations that can't be mapped are left unchanged.
+func MapLocations(text string, dir string) string {
+	return generatedLocation.ReplaceAllStringFunc(text, func(match string) string {
+		parts := generatedLocation.FindStringSubmatch(match)
+		line, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return match
+		}
+
+		generated := parts[1]
+		if !filepath.IsAbs(generated) {
+			generated = filepath.Join(dir, generated)
+		}
+
+		location, err := MapLocation(generated, line)
+		if err != nil {
+			return match
+		}
+		return location.Filename + parts[2] + strconv.Itoa(location.Line)
+	})
+}
@@ -0,0 +1,94 @@
+package pre
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSourceMaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terracotta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "src")
+	output := filepath.Join(dir, "out")
+	os.MkdirAll(source, 0777)
+	os.MkdirAll(output, 0777)
+
+	template := "a\n!if SSL\nssl\n!endif\nb\nc\n"
+	if err := ioutil.WriteFile(filepath.Join(source, "main.tft"), []byte(template), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	generated := filepath.Join(output, "main.tf")
+
+	// Generated lines map to template lines. Comments precede the first
+	// line and the line that follows the block.
+	modes := map[SourceMapMode]map[int]int{
+		SourceMapFile:     {1: 1, 2: 5, 3: 6},
+		SourceMapComments: {2: 1, 4: 5, 5: 6},
+	}
+
+	for mode, expected := range modes {
+		os.Remove(generated + SourceMapExtension)
+
+		p := Preprocessor{}
+		p.SetSourceMap(mode)
+		if err := p.processTree(source, output, nil, nil); err != nil {
+			t.Fatal("Unexpected error: " + err.Error())
+		}
+
+		for line, number := range expected {
+			location, err := MapLocation(generated, line)
+			if err != nil {
+				t.Fatal("Unexpected error: " + err.Error())
+			}
+			if location.Filename != filepath.Join(source, "main.tft") || location.Line != number {
+				t.Errorf("Expected line %d to map to main.tft:%d but received %s", line, number, location)
+			}
+		}
+	}
+}
+
+func TestCommentLocation(t *testing.T) {
+	text := "a\n# terracotta:line 5 main.tft\nb\nc\n"
+
+	location, err := commentLocation(text, 4)
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+	if location.Filename != "main.tft" || location.Line != 6 {
+		t.Errorf("Expected main.tft:6 but received %s", location)
+	}
+
+	if _, err := commentLocation(text, 1); err == nil {
+		t.Error("Expected an error for a line before any comment")
+	}
+	if _, err := commentLocation(text, 2); err == nil {
+		t.Error("Expected an error for the comment line")
+	}
+}
+
+func TestMapLocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terracotta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	text := "# terracotta:line 7 main.tft\na\nb\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.tf"), []byte(text), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	template := filepath.Join(dir, "main.tft")
+	message := "Error: on main.tf line 3, in x: see main.tf:2 and other.tf:1"
+	expected := "Error: on " + template + " line 8, in x: see " + template + ":7 and other.tf:1"
+	if result := MapLocations(message, dir); result != expected {
+		t.Errorf("Expected:\n%q\nbut received:\n%q", expected, result)
+	}
+}
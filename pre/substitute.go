@@ -0,0 +1,182 @@
+package pre
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// substitutionPrefix begins a substitution within a line of text, such as
+// !{REGION}, which is replaced by the value of its expression.
+const substitutionPrefix = "!{"
+
+// substitutionEscape is written in text as !{, rather than beginning a
+// substitution.
+const substitutionEscape = "!!{"
+
+// substitution is an expression within a line of text. The start is the
+// column, from one, of its !{, and the end is the column following its }.
+type substitution struct {
+	expression Expression
+	start      int
+	end        int
+}
+
+// hasSubstitutionPrefix returns true if text begins with a substitution or
+// its escape, so that a line beginning with it isn't a directive.
+func hasSubstitutionPrefix(text string) bool {
+	return strings.HasPrefix(text, substitutionPrefix) || strings.HasPrefix(text, substitutionEscape)
+}
+
+// parseSubstitutions returns the substitutions in a line of text. The
+// expression of each is a symbol, an element of a list or map, a function
+// call, or a literal.
+func parseSubstitutions(text string, line int) ([]substitution, error) {
+	if !strings.Contains(text, substitutionPrefix) {
+		return nil, nil
+	}
+
+	runes := []rune(text)
+	var substitutions []substitution
+	for i := 0; i < len(runes); i++ {
+		if strings.HasPrefix(string(runes[i:]), substitutionEscape) {
+			i += len(substitutionEscape) - 1
+			continue
+		}
+		if !strings.HasPrefix(string(runes[i:]), substitutionPrefix) {
+			continue
+		}
+
+		start := i + len(substitutionPrefix)
+		end := substitutionEnd(runes, start)
+		if end < 0 {
+			return nil, SyntaxError{"!{ requires a closing }", line, i + 1, SyntaxErrorInvalidSubstitution}
+		}
+
+		expression, err := parseSubstitution(string(runes[start:end]), line, start+1)
+		if err != nil {
+			return nil, err
+		}
+		substitutions = append(substitutions, substitution{expression, i + 1, end + 2})
+		i = end
+	}
+	return substitutions, nil
+}
+
+// substitutionEnd returns the index of the } that ends a substitution whose
+// expression begins at start, or -1 if there isn't one. A } within a quoted
+// string doesn't end it.
+func substitutionEnd(runes []rune, start int) int {
+	quoted := false
+	for i := start; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case quoted && r == '\\':
+			i++ // Skip the escaped rune
+		case r == '"':
+			quoted = !quoted
+		case r == '}' && !quoted:
+			return i
+		}
+	}
+	return -1
+}
+
+// parseSubstitution parses the expression of a substitution, which begins
+// at column of the line.
+func parseSubstitution(text string, line int, column int) (Expression, error) {
+	if strings.TrimSpace(text) == "" {
+		return Expression{}, SyntaxError{"!{} requires an expression", line, column, SyntaxErrorInvalidSubstitution}
+	}
+
+	prefix := directivePrefixString + DirectiveSwitch + " "
+	offset := column - 1 - len(prefix)
+
+	p := Parser{}
+	p.scanner.SetText(prefix + text)
+	p.scanner.Scan() // The directive
+
+	expression, err := p.parseArgument(substitutionPrefix+"}", TypeString)
+	if err == nil {
+		var token Token
+		token, _, err = p.scanner.Scan()
+		if err == nil && token != TokenLine && token != TokenEnd {
+			err = SyntaxError{"Unexpected text in !{}", 0, p.scanner.Column(), SyntaxErrorInvalidSubstitution}
+		}
+	}
+	if se, ok := err.(SyntaxError); ok {
+		// Report the error within the line.
+		se.line = line
+		if se.column > 0 {
+			se.column += offset
+		} else {
+			se.column = column
+		}
+		return Expression{}, se
+	}
+	if err != nil {
+		return Expression{}, err
+	}
+
+	offsetColumns(&expression, offset)
+	return expression, nil
+}
+
+// offsetColumns moves the columns of an expression and its operands.
+func offsetColumns(e *Expression, offset int) {
+	if e == nil {
+		return
+	}
+	if e.column > 0 {
+		e.column += offset
+	}
+	offsetColumns(e.left, offset)
+	offsetColumns(e.right, offset)
+	for _, argument := range e.arguments {
+		offsetColumns(argument, offset)
+	}
+}
+
+// substitute replaces the substitutions in an active line of text with the
+// values of their expressions, and any escaped !{ with !{. A list or map is
+// written as an HCL literal. It's an error to substitute a symbol or element
+// that isn't defined.
+func (p *Parser) substitute(text string) (string, error) {
+	substitutions, err := parseSubstitutions(text, p.scanner.Line())
+	if err != nil {
+		return "", err
+	}
+
+	var buffer bytes.Buffer
+	runes := []rune(text)
+	position := 0
+	for _, s := range substitutions {
+		buffer.WriteString(unescapeSubstitutions(string(runes[position : s.start-1])))
+
+		value, defined, err := p.context.evaluateSubject(&s.expression)
+		if pe, ok := err.(ProcessingError); ok {
+			pe.line = p.scanner.Line()
+			return "", pe
+		}
+		if err != nil {
+			return "", err
+		}
+		if !defined {
+			message := fmt.Sprintf("%s is not defined", formatCondition(&s.expression))
+			return "", ProcessingError{message, p.scanner.Line(), s.start + len(substitutionPrefix), ProcessingErrorSubstitution}
+		}
+
+		if p.context.verbose {
+			fmt.Printf("!{%s} = %q\n", formatCondition(&s.expression), value.String())
+		}
+		buffer.WriteString(value.String())
+		position = s.end - 1
+	}
+	buffer.WriteString(unescapeSubstitutions(string(runes[position:])))
+
+	return buffer.String(), nil
+}
+
+// unescapeSubstitutions replaces each escaped !{ in text with !{.
+func unescapeSubstitutions(text string) string {
+	return strings.Replace(text, substitutionEscape, substitutionPrefix, -1)
+}
@@ -0,0 +1,122 @@
+package pre
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSubstitution(t *testing.T) {
+	text := `!define SIZES {dev = "t3.small", prod = "m5.large"}
+!for REGION in "us-east-1", "us-west-2"
+provider "aws" {
+  alias  = "!{lower(REGION)}"
+  region = "!{REGION}"
+}
+!endfor
+instance_type = "!{SIZES[ENV]}"
+!{ENV} = true # !!{ENV}
+!if NOPE
+!{NOPE}
+!endif`
+
+	switchExpect(t, "prod", text, strings.Join([]string{
+		`provider "aws" {`,
+		`  alias  = "us-east-1"`,
+		`  region = "us-east-1"`,
+		`}`,
+		`provider "aws" {`,
+		`  alias  = "us-west-2"`,
+		`  region = "us-west-2"`,
+		`}`,
+		`instance_type = "m5.large"`,
+		`prod = true # !{ENV}`,
+	}, ","))
+}
+
+func TestSubstitutionLiterals(t *testing.T) {
+	p := Parser{}
+	p.SetText("!define AZS [\"a\", \"b\"]\n!define TAGS {Name = \"x\", \"a b\" = true}\n!define EMPTY\nazs = !{AZS}\ntags = !{TAGS}\nempty = \"!{EMPTY}\"\nn = !{AZS[1]}!{1}\n")
+	p.Enter()
+
+	var lines []string
+	err := p.ParseLines(func(line string, number int) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+
+	// Lists and maps are written as HCL literals.
+	expected := []string{`azs = ["a", "b"]`, `tags = {Name = "x", "a b" = true}`, `empty = ""`, `n = b1`}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected %q but received %q", expected, lines)
+	}
+}
+
+func TestSubstitutionRaw(t *testing.T) {
+	text := `!raw
+!{ENV}
+!endraw
+a = <<EOF
+!{ENV}
+EOF
+!heredoc
+b = <<EOF
+!{ENV}
+EOF`
+
+	switchExpect(t, "prod", text, "!{ENV},a = <<EOF,!{ENV},EOF,b = <<EOF,prod,EOF")
+}
+
+func TestSubstitutionErrors(t *testing.T) {
+	tests := []struct {
+		text   string
+		column int
+		syntax bool
+	}{
+		{"a = !{NOPE}\n", 7, false},
+		{"a = !{AZS[5]}\n", 7, false},
+		{"a = \"!{ENV\"\n", 6, true},
+		{"a = !{}\n", 7, true},
+		{"a = !{ENV ENV}\n", 11, true},
+		{"a = !{lower(ENV}\n", 7, true},
+		{"!{ENV}!{ENV[0]}\n", 9, false},
+	}
+
+	for _, test := range tests {
+		p := Parser{}
+		p.SetText(test.text)
+		p.Enter()
+		p.DefineValue("ENV", StringValue("prod"))
+		p.DefineValue("AZS", ListValue(StringValue("a")))
+
+		err := p.ParseLines(func(string, int) {})
+		if test.syntax {
+			if se, ok := err.(SyntaxError); !ok || se.Line() != 1 || se.Column() != test.column {
+				t.Errorf("Expected a syntax error at (1,%d) for %q but received %v", test.column, test.text, err)
+			}
+		} else if pe, ok := err.(ProcessingError); !ok || pe.Line() != 1 || pe.Column() != test.column {
+			t.Errorf("Expected a processing error at (1,%d) for %q but received %v", test.column, test.text, err)
+		}
+	}
+}
+
+func TestSubstitutionLint(t *testing.T) {
+	// Symbols in substitutions are referenced.
+	l := newLinter(DefaultMaxDepth)
+	p := Parser{}
+	p.SetText("!define NAME x\n!define UNUSED\nname = \"!{NAME}\"\nother = !{lower(OTHER)}\n")
+	items, err := p.outline()
+	l.lintOutline("main.tft", items, err, false)
+	l.checkSymbols()
+
+	lintExpect(t, l.finish(), []Diagnostic{
+		{"main.tft", 2, RuleUnusedSymbol, SeverityInfo, "UNUSED is never referenced"},
+		{"main.tft", 4, RuleUndefinedSymbol, SeverityWarning, "OTHER is never defined"},
+	})
+}
+
+func TestSubstitutionFormat(t *testing.T) {
+	// A line beginning with a substitution is text.
+	formatExpect(t, 0, "!{NAME} = 1\n  !!{x}\n! if  A\n!endif\n", "!{NAME} = 1\n  !!{x}\n!if A\n!endif\n")
+}
@@ -0,0 +1,270 @@
+package pre
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// switchSubject is the value of a !switch block, which each !case compares
+// with its values.
+type switchSubject struct {
+	expression *Expression
+	value      Value
+	defined    bool // An undefined symbol matches no case.
+}
+
+// matches returns true if the subject equals one of the values.
+func (s *switchSubject) matches(values []string) bool {
+	if !s.defined {
+		return false
+	}
+	for _, value := range values {
+		if s.value.String() == value {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSwitchSubject parses the value of a !switch, which is a symbol, an
+// element of a list or map, a quoted string, or a call to a function that
+// returns a string.
+func (p *Parser) parseSwitchSubject() (Expression, error) {
+	return p.parseArgument(directivePrefixString+DirectiveSwitch, TypeString)
+}
+
+// parseCaseValues parses the quoted strings of a !case, separated by commas.
+func (p *Parser) parseCaseValues() ([]string, error) {
+	var values []string
+	for {
+		token, text, err := p.scanner.Scan()
+		if err != nil {
+			return nil, err
+		}
+		if token != TokenString {
+			return nil, SyntaxError{"!case expects one or more quoted strings", p.scanner.Line(), p.scanner.Column(), SyntaxErrorInvalidArgument}
+		}
+		values = append(values, text)
+
+		token, _, err = p.scanner.Peek()
+		if err != nil {
+			return nil, err
+		}
+		if token != TokenComma {
+			return values, p.scanner.Push()
+		}
+		p.scanner.Scan() // Eat the ,
+	}
+}
+
+// formatCaseValues returns the values of a !case in canonical syntax.
+func formatCaseValues(values []string) string {
+	var buffer bytes.Buffer
+	for i, value := range values {
+		if i > 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString(quoteString(value))
+	}
+	return buffer.String()
+}
+
+// parseSwitch begins a block whose arms are selected by comparing a value
+// with the values of each !case. Lines before the first !case are never
+// included.
+func (p *Parser) parseSwitch() error {
+	if p.verbose {
+		fmt.Printf("parseSwitch\n")
+	}
+
+	expression, err := p.parseSwitchSubject()
+	if err != nil {
+		return err
+	}
+
+	err = p.expectDirectiveEnd(DirectiveSwitch)
+	if err != nil {
+		return err
+	}
+
+	p.context.enterBranch()
+
+	value, defined, err := p.context.evaluateSubject(&expression)
+	if pe, ok := err.(ProcessingError); ok {
+		pe.line = p.scanner.Line()
+		return pe
+	}
+	if err != nil {
+		return err
+	}
+	if p.context.verbose {
+		fmt.Printf("!switch %s = %q (%t)\n", formatCondition(&expression), value.String(), defined)
+	}
+
+	p.context.scope().subject = &switchSubject{&expression, value, defined}
+	p.context.takeBranch(false)
+	p.context.coverBlock(p.filename, p.scanner.Line())
+
+	return nil
+}
+
+func (p *Parser) parseCase() error {
+	if p.verbose {
+		fmt.Printf("parseCase\n")
+	}
+
+	values, err := p.parseCaseValues()
+	if err != nil {
+		return err
+	}
+
+	err = p.expectDirectiveEnd(DirectiveCase)
+	if err != nil {
+		return err
+	}
+
+	subject, err := p.expectSwitchBlock(DirectiveCase)
+	if err != nil {
+		return err
+	}
+
+	p.context.nextBranch()
+
+	evaluated := !p.context.previousBranchTaken()
+	result := false
+	if evaluated {
+		result = subject.matches(values)
+		if p.context.verbose {
+			fmt.Printf("!case %t\n", result)
+		}
+		p.context.takeBranch(result)
+	}
+
+	p.context.coverBranch(DirectiveCase, p.filename, p.scanner.Line())
+	p.context.explainCase(p.scanner.Line(), values, evaluated, result)
+
+	return nil
+}
+
+func (p *Parser) parseDefault() error {
+	if p.verbose {
+		fmt.Printf("parseDefault\n")
+	}
+
+	err := p.expectDirectiveEnd(DirectiveDefault)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.expectSwitchBlock(DirectiveDefault)
+	if err != nil {
+		return err
+	}
+
+	p.context.nextBranch()
+
+	evaluated := !p.context.previousBranchTaken()
+	if evaluated {
+		p.context.takeBranch(true)
+	}
+
+	p.context.coverBranch(DirectiveDefault, p.filename, p.scanner.Line())
+	p.context.explainBranch(DirectiveDefault, p.scanner.Line(), nil, evaluated, evaluated)
+
+	return nil
+}
+
+func (p *Parser) parseEndSwitch() error {
+	if p.verbose {
+		fmt.Printf("parseEndSwitch\n")
+	}
+
+	err := p.expectDirectiveEnd(DirectiveEndswitch)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.expectSwitchBlock(DirectiveEndswitch)
+	if err != nil {
+		return err
+	}
+
+	p.context.leaveBranch()
+
+	return nil
+}
+
+// expectSwitchBlock returns the subject of the enclosing !switch block, or
+// an error if the directive isn't within one.
+func (p *Parser) expectSwitchBlock(directive string) (*switchSubject, error) {
+	if len(p.context.scopeStack) < 2 || p.context.scope().subject == nil {
+		message := fmt.Sprintf("!%s without !switch", directive)
+		return nil, SyntaxError{message, p.scanner.Line(), 0, SyntaxErrorInvalidDirective}
+	}
+	return p.context.scope().subject, nil
+}
+
+// expectIfBlock returns an error if the directive, which continues or ends
+// a conditional block, is within a !switch or !for block instead.
+func (p *Parser) expectIfBlock(directive string) error {
+	s := p.context.scope()
+	if s.subject != nil || s.loop != nil {
+		opener := DirectiveSwitch
+		if s.loop != nil {
+			opener = DirectiveFor
+		}
+		message := fmt.Sprintf("!%s within !%s", directive, opener)
+		return SyntaxError{message, p.scanner.Line(), 0, SyntaxErrorInvalidDirective}
+	}
+	return nil
+}
+
+// evaluateSubject returns the value of a !switch or an element of a !for
+// list, and whether it's defined.
+func (c *parserContext) evaluateSubject(e *Expression) (Value, bool, error) {
+	switch e.kind {
+	case ExpressionIdentifier:
+		value, defined := c.lookup(e.identifier)
+		return value, defined, nil
+	case ExpressionString:
+		return StringValue(e.identifier), true, nil
+	case ExpressionNumber:
+		return StringValue(e.identifier), true, nil
+	case ExpressionIndex:
+		// An element that doesn't exist is undefined.
+		value, found, err := newExpr(e).(*Index).value(FuncResolver(c.lookup))
+		if err != nil {
+			column := e.column
+			if ce, ok := err.(callError); ok {
+				column = ce.column
+			}
+			return Value{}, false, ProcessingError{err.Error(), 0, column, ProcessingErrorIndex}
+		}
+		return value, found, nil
+	}
+
+	value, err := newExpr(e).(*Call).value(FuncResolver(c.lookup))
+	if err != nil {
+		column := e.column
+		if ce, ok := err.(callError); ok {
+			column = ce.column
+		}
+		return Value{}, false, ProcessingError{err.Error(), 0, column, ProcessingErrorFunction}
+	}
+	return value, true, nil
+}
+
+// explainCase records a !case arm of the current !switch block when
+// explaining. The symbols are those of the switch's value.
+func (c *parserContext) explainCase(line int, values []string, evaluated bool, result bool) {
+	if !c.explain || len(c.scopeStack) < 2 {
+		return
+	}
+
+	s := c.scope()
+	arm := ExplainArm{Directive: DirectiveCase, Line: line, Condition: formatCaseValues(values), Evaluated: evaluated, Result: result, Taken: evaluated && result}
+	if evaluated && s.subject != nil {
+		arm.Symbols = c.explainSymbols(s.subject.expression)
+	}
+	s.arms = append(s.arms, arm)
+}
@@ -0,0 +1,131 @@
+package pre
+
+import (
+	"strings"
+	"testing"
+)
+
+// switchExpect parses text with ENV defined as env, if it's not empty, and
+// compares the active lines.
+func switchExpect(t *testing.T, env string, text string, expected string) {
+	t.Helper()
+
+	p := Parser{}
+	p.SetText(text)
+	p.Enter()
+	if env != "" {
+		p.DefineValue("ENV", StringValue(env))
+	}
+
+	var lines []string
+	err := p.ParseLines(func(line string, number int) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error for ENV=%s: %v", env, err)
+	}
+
+	if actual := strings.Join(lines, ","); actual != expected {
+		t.Errorf("Expected '%s' for ENV=%s but received '%s'", expected, env, actual)
+	}
+}
+
+func TestSwitch(t *testing.T) {
+	text := `a
+!switch ENV
+never
+!case "prod", "staging"
+large
+!case "dev"
+small
+!default
+none
+!endswitch
+b`
+
+	switchExpect(t, "prod", text, "a,large,b")
+	switchExpect(t, "staging", text, "a,large,b")
+	switchExpect(t, "dev", text, "a,small,b")
+	switchExpect(t, "test", text, "a,none,b")
+
+	// An undefined symbol matches no case.
+	switchExpect(t, "", text, "a,none,b")
+
+	// Only the first matching case is taken, and the default is optional.
+	switchExpect(t, "dev", "!switch ENV\n!case \"dev\"\none\n!case \"dev\"\ntwo\n!endswitch\n", "one")
+	switchExpect(t, "test", "!switch ENV\n!case \"dev\"\ndev\n!endswitch\n", "")
+}
+
+func TestSwitchNesting(t *testing.T) {
+	text := `!if true
+!switch upper(ENV)
+!case "PROD"
+!if defined(ENV)
+prod
+!endif
+!switch ENV
+!case "prod"
+inner
+!endswitch
+!default
+other
+!endswitch
+!endif`
+
+	switchExpect(t, "prod", text, "prod,inner")
+	switchExpect(t, "dev", text, "other")
+
+	// A block within an arm that isn't taken is never taken.
+	switchExpect(t, "dev", "!if false\n!switch ENV\n!default\nx\n!endswitch\n!endif\n", "")
+}
+
+func TestSwitchErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		kind SyntaxErrorKind
+	}{
+		{"!case \"a\"\n", SyntaxErrorInvalidDirective},
+		{"!default\n", SyntaxErrorInvalidDirective},
+		{"!if A\n!endswitch\n", SyntaxErrorInvalidDirective},
+		{"!switch ENV\n!else\n", SyntaxErrorInvalidDirective},
+		{"!switch ENV\n!case \"a\"\n!endif\n", SyntaxErrorInvalidDirective},
+		{"!switch ENV\n!case a\n", SyntaxErrorInvalidArgument},
+		{"!switch ENV\n!case \"a\",\n", SyntaxErrorInvalidArgument},
+		{"!switch defined(ENV)\n", SyntaxErrorInvalidArgument},
+	}
+
+	for _, test := range tests {
+		p := Parser{}
+		p.SetText(test.text)
+		p.Enter()
+
+		err := p.ParseLines(func(string, int) {})
+		se, ok := err.(SyntaxError)
+		if !ok || se.Kind() != test.kind {
+			t.Errorf("Expected a syntax error of kind %d for %q but received %v", test.kind, test.text, err)
+		}
+	}
+}
+
+func TestSwitchCoverage(t *testing.T) {
+	coverage := NewCoverage()
+
+	p := Parser{}
+	p.SetCoverage(coverage)
+	p.SetText("!switch ENV\n!case \"prod\"\n!case \"dev\"\n!default\n!endswitch\n")
+	p.Enter()
+	p.DefineValue("ENV", StringValue("dev"))
+	if err := p.ParseLines(func(string, int) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := coverage.Blocks()
+	if len(blocks) != 1 || blocks[0].Line != 1 || blocks[0].Reached != 1 {
+		t.Fatalf("Unexpected blocks %+v", blocks)
+	}
+
+	arms := blocks[0].Arms
+	if len(arms) != 3 || arms[0].Directive != DirectiveCase || arms[0].Taken != 0 || arms[1].Taken != 1 || arms[2].Taken != 0 {
+		t.Errorf("Unexpected arms %+v", arms)
+	}
+}
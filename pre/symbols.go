@@ -0,0 +1,242 @@
+package pre
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// The places a symbol may be defined.
+const (
+	SymbolSourceConfig      = "config"
+	SymbolSourceTfdefs      = "tfdefs"
+	SymbolSourceTemplate    = "template"
+	SymbolSourceEnvironment = "environment"
+	SymbolSourceDefsFile    = "defs-file"
+	SymbolSourceCommandLine = "command line"
+)
+
+// SymbolSite is a place at which a symbol is defined, undefined or
+// referenced. The filename and line are empty where they don't apply, such
+// as for the command line.
+type SymbolSite struct {
+	Source    string `json:"source,omitempty"`
+	Filename  string `json:"filename,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	Undefined bool   `json:"undefined,omitempty"`
+	Value     string `json:"value,omitempty"`
+}
+
+// SymbolValue is the effective value of a symbol in a directory, before any
+// of the directory's templates are processed.
+type SymbolValue struct {
+	Directory string `json:"directory"`
+	Defined   bool   `json:"defined"`
+	Value     string `json:"value,omitempty"`
+}
+
+// Symbol describes where a symbol is defined and referenced, and its value
+// in each directory.
+type Symbol struct {
+	Name        string        `json:"name"`
+	Definitions []SymbolSite  `json:"definitions"`
+	References  []SymbolSite  `json:"references"`
+	Values      []SymbolValue `json:"values"`
+}
+
+// symbolTable accumulates symbols by name.
+type symbolTable map[string]*Symbol
+
+func (t symbolTable) symbol(name string) *Symbol {
+	s, ok := t[name]
+	if !ok {
+		s = &Symbol{Name: name, Definitions: []SymbolSite{}, References: []SymbolSite{}, Values: []SymbolValue{}}
+		t[name] = s
+	}
+	return s
+}
+
+func (t symbolTable) define(name string, site SymbolSite) {
+	s := t.symbol(name)
+	s.Definitions = append(s.Definitions, site)
+}
+
+// defineAll records the symbols defined and undefined by a list of NAME or
+// NAME=value definitions.
+func (t symbolTable) defineAll(source string, filename string, defines []string, undefs []string) {
+	for _, define := range defines {
+		name, value, _ := splitDefine(define)
+		t.define(name, SymbolSite{Source: source, Filename: filename, Value: value})
+	}
+	for _, undef := range undefs {
+		t.define(undef, SymbolSite{Source: source, Filename: filename, Undefined: true})
+	}
+}
+
+// outline records the symbols defined and referenced by the directives in
+// a template or definitions file.
+func (t symbolTable) outline(source string, filename string) error {
+	p := Parser{}
+	p.SetFile(filename)
+	items, err := p.outline()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		for _, name := range listSymbols(item.substitutions) {
+			s := t.symbol(name)
+			s.References = append(s.References, SymbolSite{Filename: filename, Line: item.line})
+		}
+
+		switch item.directive {
+		case DirectiveDefine, DirectiveUndef:
+			t.define(item.symbol, SymbolSite{Source: source, Filename: filename, Line: item.line, Undefined: item.directive == DirectiveUndef, Value: item.value.String()})
+		case DirectiveIf, DirectiveIfdef, DirectiveIfndef, DirectiveElif, DirectiveSwitch:
+			for _, name := range expressionSymbols(item.condition) {
+				s := t.symbol(name)
+				s.References = append(s.References, SymbolSite{Filename: filename, Line: item.line})
+			}
+		case DirectiveFor:
+			t.define(item.symbol, SymbolSite{Source: source, Filename: filename, Line: item.line})
+			for _, name := range listSymbols(item.list) {
+				s := t.symbol(name)
+				s.References = append(s.References, SymbolSite{Filename: filename, Line: item.line})
+			}
+		}
+	}
+
+	return nil
+}
+
+// Symbols lists every symbol defined or referenced in the source directory,
+// sorted by name. Definitions are listed with those in the project config
+// and the files in the tree first, followed by the overrides from the
+// environment, definitions files and command line.
+func (p *Preprocessor) Symbols(source string, defines []string, undefs []string) ([]Symbol, error) {
+	t := make(symbolTable)
+
+	root, ancestors, err := projectAncestors(source)
+	if err != nil {
+		return nil, err
+	}
+
+	config := filepath.Join(root, configFilename)
+	if _, err := os.Stat(config); err == nil {
+		c, err := ReadConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		t.defineAll(SymbolSourceConfig, config, c.Define, c.Undef)
+	}
+
+	for _, ancestor := range ancestors {
+		tfdefs := filepath.Join(ancestor, tfdefsFilename)
+		if _, err := os.Stat(tfdefs); err == nil {
+			if err := t.outline(SymbolSourceTfdefs, tfdefs); err != nil {
+				return nil, fmt.Errorf("%s%w", tfdefs, err)
+			}
+		}
+	}
+
+	templates, defs, err := p.Files(source)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, filename := range defs {
+		if err := t.outline(SymbolSourceTfdefs, filename); err != nil {
+			return nil, fmt.Errorf("%s%w", filename, err)
+		}
+	}
+
+	for _, filename := range templates {
+		if err := t.outline(SymbolSourceTemplate, filename); err != nil {
+			return nil, fmt.Errorf("%s%w", filename, err)
+		}
+	}
+
+	t.defineAll(SymbolSourceEnvironment, "", p.environ, nil)
+
+	for _, file := range p.defsFiles {
+		if file.directives {
+			if err := t.outline(SymbolSourceDefsFile, file.filename); err != nil {
+				return nil, fmt.Errorf("%s%w", file.filename, err)
+			}
+			continue
+		}
+		for _, d := range file.definitions {
+			t.define(d.name, SymbolSite{Source: SymbolSourceDefsFile, Filename: file.filename, Undefined: !d.defined, Value: d.value.String()})
+		}
+	}
+
+	t.defineAll(SymbolSourceCommandLine, "", defines, undefs)
+
+	var symbols []Symbol
+	for _, s := range t {
+		symbols = append(symbols, *s)
+	}
+	sort.Slice(symbols, func(i, j int) bool { return symbols[i].Name < symbols[j].Name })
+
+	err = p.symbolValues(source, defines, undefs, symbols)
+	return symbols, err
+}
+
+// symbolValues records the effective value of each symbol in each directory
+// of the source directory.
+func (p *Preprocessor) symbolValues(source string, defines []string, undefs []string, symbols []Symbol) error {
+	p.defines = defines
+	p.undefs = undefs
+
+	levels, err := p.enterAncestors(source)
+	if err != nil {
+		return err
+	}
+	defer p.leave(levels)
+
+	return p.symbolDirectory(source, ".", symbols)
+}
+
+func (p *Preprocessor) symbolDirectory(source string, rel string, symbols []Symbol) error {
+	excludes := len(p.exclude)
+	defer func() { p.exclude = p.exclude[:excludes] }()
+
+	patternRel := rel
+	if patternRel == "." {
+		patternRel = ""
+	}
+
+	err := p.loadIgnoreFile(source, patternRel)
+	if err != nil {
+		return err
+	}
+
+	dirs, _, tfdefs, err := p.getDirectoryContents(source, patternRel)
+	if err != nil {
+		return err
+	}
+
+	err = p.enterDefinitions(source, tfdefs)
+	if err != nil {
+		return err
+	}
+	defer p.parser.Leave()
+
+	for i := range symbols {
+		value, defined := p.parser.context.lookup(symbols[i].Name)
+		symbols[i].Values = append(symbols[i].Values, SymbolValue{rel, defined, value.String()})
+	}
+
+	if !p.noRecurse {
+		for _, dir := range dirs {
+			err = p.symbolDirectory(path.Join(source, dir), path.Join(patternRel, dir), symbols)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
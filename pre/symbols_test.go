@@ -0,0 +1,68 @@
+package pre
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSymbols(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terracotta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		configFilename:                       `{"define": ["SSL"]}`,
+		tfdefsFilename:                       "!define RDS\n",
+		"main.tft":                           "!if SSL && RDS\n!endif\n",
+		filepath.Join("vpc", tfdefsFilename): "!undef RDS\n",
+		filepath.Join("vpc", "vpc.tft"):      "x\n!if ENV\n!endif\n",
+	}
+	for name, text := range files {
+		filename := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(filename), 0777)
+		if err := ioutil.WriteFile(filename, []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := Preprocessor{}
+	symbols, err := p.Symbols(dir, []string{"ENV=prod"}, nil)
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+
+	if len(symbols) != 3 {
+		t.Fatalf("Expected 3 symbols but received %d", len(symbols))
+	}
+
+	env, rds, ssl := symbols[0], symbols[1], symbols[2]
+	if env.Name != "ENV" || rds.Name != "RDS" || ssl.Name != "SSL" {
+		t.Fatalf("Expected ENV, RDS and SSL but received %s, %s and %s", env.Name, rds.Name, ssl.Name)
+	}
+
+	if len(env.Definitions) != 1 || env.Definitions[0].Source != SymbolSourceCommandLine || env.Definitions[0].Value != "prod" {
+		t.Errorf("Expected ENV to be defined on the command line: %v", env.Definitions)
+	}
+	if len(env.References) != 1 || env.References[0].Line != 2 {
+		t.Errorf("Expected ENV to be referenced on line 2: %v", env.References)
+	}
+
+	if len(rds.Definitions) != 2 || rds.Definitions[0].Undefined || !rds.Definitions[1].Undefined {
+		t.Errorf("Expected RDS to be defined and then undefined: %v", rds.Definitions)
+	}
+	expectValues := []SymbolValue{{".", true, ""}, {"vpc", false, ""}}
+	for i := range expectValues {
+		if i >= len(rds.Values) || rds.Values[i] != expectValues[i] {
+			t.Errorf("Expected RDS values %v but received %v", expectValues, rds.Values)
+			break
+		}
+	}
+
+	if len(ssl.Definitions) != 1 || ssl.Definitions[0].Source != SymbolSourceConfig {
+		t.Errorf("Expected SSL to be defined in the config: %v", ssl.Definitions)
+	}
+}
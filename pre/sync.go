@@ -0,0 +1,326 @@
+package pre
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// maxDiffCells limits the size of the table used to compare the changed
+// middle of two files. Larger changes are treated as a single change.
+const maxDiffCells = 4000000
+
+// SyncConflict is a change to a generated file that can't be applied to its
+// template, because it doesn't fall within contiguous active text.
+type SyncConflict struct {
+	Line    int // The first changed line of the generated file.
+	Message string
+}
+
+// SyncResult describes the changes made to a generated file, and the
+// template with those that could be applied.
+type SyncResult struct {
+	Template  string
+	Generated string
+	Text      string // The updated template.
+	Applied   int
+	Conflicts []SyncConflict
+}
+
+// Sync compares the files generated from the source directory with those in
+// the output directory, and maps any changes back to the templates. The
+// updated templates are returned rather than written. Only generated files
+// that differ are included.
+func (p *Preprocessor) Sync(source string, output string, defines []string, undefs []string) ([]SyncResult, error) {
+	// Source map comments in the generated files are set aside, so the
+	// templates are rendered without them.
+	mode := p.sourceMap
+	p.sourceMap = SourceMapNone
+	p.sources = make(map[string][]int)
+	defer func() { p.sources, p.sourceMap = nil, mode }()
+
+	rendered, err := p.RenderDirectory(source, defines, undefs)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range rendered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var results []SyncResult
+	for _, name := range names {
+		generated := path.Join(output, name)
+		current, err := ioutil.ReadFile(generated)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		text, lines := removeSourceMapComments(string(current))
+		if text == rendered[name] {
+			continue
+		}
+
+		template := path.Join(source, removeFileExtension(name)+templateExtension)
+		original, err := ioutil.ReadFile(template)
+		if err != nil {
+			return nil, err
+		}
+
+		result := SyncResult{Template: template, Generated: generated}
+		result.Text, result.Applied, result.Conflicts = SyncText(string(original), rendered[name], p.sources[name], text)
+		for i := range result.Conflicts {
+			if line := result.Conflicts[i].Line; line <= len(lines) {
+				result.Conflicts[i].Line = lines[line-1]
+			}
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// SyncText applies the changes between the rendered and current text of a
+// generated file to the template text. The sources give the template line
+// of each rendered line, negated for a line that isn't copied as written,
+// since a custom directive emitted it or it has substitutions. A change is
+// applied if the lines it replaces, or the lines it's inserted between, are
+// adjacent in the template. Lines that aren't copied can't be changed. It
+// returns the updated template, the number of changes applied, and the
+// changes that conflict with directives or excluded text.
+func SyncText(template string, rendered string, sources []int, current string) (string, int, []SyncConflict) {
+	renderedLines := generatedLines(rendered)
+	currentLines := generatedLines(current)
+	templateLines := splitLinesKeepEnds(template)
+
+	ending := "\n"
+	if strings.Contains(template, "\r\n") {
+		ending = "\r\n"
+	}
+
+	type edit struct {
+		start int // The first template line replaced, from zero.
+		end   int
+		lines []string
+	}
+
+	// A line repeated by a !for loop can't be changed in one iteration.
+	repeated := make(map[int]bool)
+	seen := make(map[int]bool)
+	for i, line := range sources {
+		// The lines emitted by one directive share its line.
+		if line < 0 && i > 0 && sources[i-1] == line {
+			continue
+		}
+		repeated[line] = seen[line]
+		seen[line] = true
+	}
+	generatedBy := func(lines []int) int {
+		for _, line := range lines {
+			if line < 0 {
+				return -line
+			}
+		}
+		return 0
+	}
+	isRepeated := func(lines []int) bool {
+		for _, line := range lines {
+			if repeated[line] {
+				return true
+			}
+		}
+		return false
+	}
+
+	var edits []edit
+	var conflicts []SyncConflict
+	for _, h := range diffLines(renderedLines, currentLines) {
+		if h.a1 > h.a0 {
+			if line := generatedBy(sources[h.a0:h.a1]); line != 0 {
+				message := fmt.Sprintf("The change is to lines generated by template line %d, which aren't copied as written", line)
+				conflicts = append(conflicts, SyncConflict{h.b0 + 1, message})
+				continue
+			}
+			first, last := sources[h.a0], sources[h.a1-1]
+			if isRepeated(sources[h.a0:h.a1]) {
+				message := fmt.Sprintf("The change is within a loop, which repeats template lines %d-%d", first, last)
+				conflicts = append(conflicts, SyncConflict{h.b0 + 1, message})
+				continue
+			}
+			if last-first != h.a1-h.a0-1 {
+				message := fmt.Sprintf("The change spans directives or excluded text in template lines %d-%d", first, last)
+				conflicts = append(conflicts, SyncConflict{h.b0 + 1, message})
+				continue
+			}
+			edits = append(edits, edit{first - 1, last, currentLines[h.b0:h.b1]})
+			continue
+		}
+
+		// An insertion must fall between adjacent template lines.
+		previous, next := 0, len(templateLines)+1
+		if h.a0 > 0 {
+			previous = sources[h.a0-1]
+		}
+		if h.a0 < len(sources) {
+			next = sources[h.a0]
+		}
+		if previous < 0 && next == previous {
+			message := fmt.Sprintf("The insertion is within the lines generated by template line %d", -previous)
+			conflicts = append(conflicts, SyncConflict{h.b0 + 1, message})
+			continue
+		}
+		if isRepeated([]int{previous, next}) {
+			message := fmt.Sprintf("The insertion is within a loop, which repeats template lines %d and %d", sourceLine(previous), sourceLine(next))
+			conflicts = append(conflicts, SyncConflict{h.b0 + 1, message})
+			continue
+		}
+
+		// Text may be inserted before or after a directive's lines.
+		previous, next = sourceLine(previous), sourceLine(next)
+		if next != previous+1 {
+			message := fmt.Sprintf("The insertion falls between template lines %d and %d, which are separated by directives or excluded text", previous, next)
+			conflicts = append(conflicts, SyncConflict{h.b0 + 1, message})
+			continue
+		}
+		edits = append(edits, edit{previous, previous, currentLines[h.b0:h.b1]})
+	}
+
+	// Apply the edits from the end, so that earlier line numbers hold.
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+
+		var lines []string
+		for _, line := range e.lines {
+			lines = append(lines, line+ending)
+		}
+
+		// A line inserted after the last line needs it to end.
+		if e.start > 0 && e.start == len(templateLines) && !strings.HasSuffix(templateLines[e.start-1], "\n") {
+			templateLines[e.start-1] += ending
+		}
+
+		updated := append([]string{}, templateLines[:e.start]...)
+		updated = append(updated, lines...)
+		templateLines = append(updated, templateLines[e.end:]...)
+	}
+
+	return strings.Join(templateLines, ""), len(edits), conflicts
+}
+
+// sourceLine returns the template line of a source, which is negated if
+// the line isn't copied as written.
+func sourceLine(line int) int {
+	if line < 0 {
+		return -line
+	}
+	return line
+}
+
+// removeSourceMapComments returns a generated file without its source map
+// comments, and the original line number of each line that remains.
+func removeSourceMapComments(text string) (string, []int) {
+	var buffer bytes.Buffer
+	var lines []int
+	for i, line := range splitLinesKeepEnds(text) {
+		if isSourceMapComment(line) {
+			continue
+		}
+		buffer.WriteString(line)
+		lines = append(lines, i+1)
+	}
+	return buffer.String(), lines
+}
+
+// generatedLines splits a generated file into lines without their endings.
+func generatedLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return splitLines(strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r"))
+}
+
+// diffHunk replaces the lines [a0, a1) of one file with the lines [b0, b1)
+// of another.
+type diffHunk struct {
+	a0, a1 int
+	b0, b1 int
+}
+
+// diffLines returns the changes from a to b, based on their longest common
+// subsequence of lines.
+func diffLines(a []string, b []string) []diffHunk {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	a = a[prefix : len(a)-suffix]
+	b = b[prefix : len(b)-suffix]
+	n, m := len(a), len(b)
+	if n == 0 && m == 0 {
+		return nil
+	}
+
+	if (n+1)*(m+1) > maxDiffCells {
+		return []diffHunk{{prefix, prefix + n, prefix, prefix + m}}
+	}
+
+	// common[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:].
+	common := make([][]int, n+1)
+	for i := range common {
+		common[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	var hunks []diffHunk
+	var current *diffHunk
+	i, j := 0, 0
+	for i < n || j < m {
+		if i < n && j < m && a[i] == b[j] {
+			current = nil
+			i++
+			j++
+			continue
+		}
+
+		if current == nil {
+			hunks = append(hunks, diffHunk{prefix + i, prefix + i, prefix + j, prefix + j})
+			current = &hunks[len(hunks)-1]
+		}
+
+		if j >= m || (i < n && common[i+1][j] >= common[i][j+1]) {
+			i++
+			current.a1++
+		} else {
+			j++
+			current.b1++
+		}
+	}
+
+	return hunks
+}
@@ -0,0 +1,180 @@
+package pre
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncText(t *testing.T) {
+	template := "a\nb\n!if SSL\nc\n!else\nd\n!endif\ne\n"
+	rendered := "a\nb\nc\ne\n"
+	sources := []int{1, 2, 4, 8}
+
+	// Changes within contiguous active text are applied.
+	text, applied, conflicts := SyncText(template, rendered, sources, "a\nB\nx\nc\ne\nf\n")
+	if applied != 2 || len(conflicts) != 0 {
+		t.Errorf("Expected 2 changes and no conflicts but received %d and %v", applied, conflicts)
+	}
+	if expected := "a\nB\nx\n!if SSL\nc\n!else\nd\n!endif\ne\nf\n"; text != expected {
+		t.Errorf("Expected:\n%q\nbut received:\n%q", expected, text)
+	}
+
+	// Changes next to directives conflict.
+	text, applied, conflicts = SyncText(template, rendered, sources, "a\nb\nC\nE\n")
+	if applied != 0 || len(conflicts) != 1 || conflicts[0].Line != 3 {
+		t.Errorf("Expected a conflict on line 3 but received %v", conflicts)
+	}
+	if text != template {
+		t.Errorf("Expected the template to be unchanged but received %q", text)
+	}
+
+	text, applied, conflicts = SyncText(template, rendered, sources, "a\nx\nb\nc\ne\n")
+	if applied != 1 || len(conflicts) != 0 {
+		t.Errorf("Expected an insertion after line 1 to apply: %v", conflicts)
+	}
+	if expected := "a\nx\nb\n!if SSL\nc\n!else\nd\n!endif\ne\n"; text != expected {
+		t.Errorf("Expected:\n%q\nbut received:\n%q", expected, text)
+	}
+
+	// An insertion next to a directive is ambiguous.
+	_, _, conflicts = SyncText(template, rendered, sources, "a\nb\nx\nc\ne\n")
+	if len(conflicts) != 1 || conflicts[0].Line != 3 {
+		t.Errorf("Expected a conflict on line 3 but received %v", conflicts)
+	}
+
+	_, _, conflicts = SyncText(template, rendered, sources, "a\nb\nc\nx\ne\n")
+	if len(conflicts) != 1 || conflicts[0].Line != 4 {
+		t.Errorf("Expected a conflict on line 4 but received %v", conflicts)
+	}
+}
+
+func TestSyncTextLoop(t *testing.T) {
+	template := "a\n!for X in \"1\", \"2\"\nb\nc\n!endfor\nd\n"
+	rendered := "a\nb\nc\nb\nc\nd\n"
+	sources := []int{1, 3, 4, 3, 4, 6}
+
+	// Lines repeated by a loop can't be changed in one iteration.
+	text, applied, conflicts := SyncText(template, rendered, sources, "a\nb\nC\nb\nc\nD\n")
+	if applied != 1 || len(conflicts) != 1 || conflicts[0].Line != 3 {
+		t.Errorf("Expected a conflict on line 3 but received %v", conflicts)
+	}
+	if expected := "a\n!for X in \"1\", \"2\"\nb\nc\n!endfor\nD\n"; text != expected {
+		t.Errorf("Expected:\n%q\nbut received:\n%q", expected, text)
+	}
+
+	_, _, conflicts = SyncText(template, rendered, sources, "a\nb\nx\nc\nb\nc\nd\n")
+	if len(conflicts) != 1 || conflicts[0].Line != 3 {
+		t.Errorf("Expected a conflict on line 3 but received %v", conflicts)
+	}
+}
+
+func TestSyncTextDirective(t *testing.T) {
+	template := "a\n!owner \"infra\"\nb\n"
+	rendered := "a\n# Owner: infra\n# Team: infra\nb\n"
+	sources := []int{1, -2, -2, 3}
+
+	// Lines emitted by a directive can't be changed, since the template only
+	// holds the directive.
+	text, applied, conflicts := SyncText(template, rendered, sources, "a\n# Owner: other\n# Team: infra\nb\n")
+	if applied != 0 || len(conflicts) != 1 || conflicts[0].Line != 2 {
+		t.Errorf("Expected a conflict on line 2 but received %v", conflicts)
+	}
+	if text != template {
+		t.Errorf("Expected the template to be unchanged but received %q", text)
+	}
+
+	_, _, conflicts = SyncText(template, rendered, sources, "a\n# Owner: infra\nx\n# Team: infra\nb\n")
+	if len(conflicts) != 1 || conflicts[0].Line != 3 {
+		t.Errorf("Expected a conflict on line 3 but received %v", conflicts)
+	}
+
+	// Text may be inserted before or after them.
+	text, applied, conflicts = SyncText(template, rendered, sources, "a\nx\n# Owner: infra\n# Team: infra\ny\nb\n")
+	if applied != 2 || len(conflicts) != 0 {
+		t.Errorf("Expected 2 changes and no conflicts but received %d and %v", applied, conflicts)
+	}
+	if expected := "a\nx\n!owner \"infra\"\ny\nb\n"; text != expected {
+		t.Errorf("Expected:\n%q\nbut received:\n%q", expected, text)
+	}
+}
+
+func TestSyncDirective(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terracotta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "src")
+	output := filepath.Join(dir, "out")
+	os.MkdirAll(source, 0777)
+	os.MkdirAll(output, 0777)
+
+	template := "a\n!owner\nb\n"
+	if err := ioutil.WriteFile(filepath.Join(source, "main.tft"), []byte(template), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(output, "main.tf"), []byte("a\n# Owner: other\nb\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Preprocessor{}
+	p.RegisterDirective("owner", func(params []DirectiveToken, active bool, emit Emitter) error {
+		emit("# Owner: infra")
+		return nil
+	})
+	results, err := p.Sync(source, output, nil, nil)
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+	if len(results) != 1 || results[0].Applied != 0 || len(results[0].Conflicts) != 1 || results[0].Text != template {
+		t.Errorf("Expected the change to the emitted line to conflict but received %v", results)
+	}
+}
+
+func TestSyncSubstitution(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terracotta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "src")
+	output := filepath.Join(dir, "out")
+	os.MkdirAll(source, 0777)
+	os.MkdirAll(output, 0777)
+
+	template := "a\nb\nregion = \"!{REGION}\"\nc\n"
+	if err := ioutil.WriteFile(filepath.Join(source, "main.tft"), []byte(template), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(output, "main.tf"), []byte("A\nb\nregion = \"eu-west-1\"\nc\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// A substituted line can't be changed, but the lines around it can.
+	p := Preprocessor{}
+	results, err := p.Sync(source, output, []string{"REGION=us-east-1"}, nil)
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+	expected := "A\nb\nregion = \"!{REGION}\"\nc\n"
+	if len(results) != 1 || results[0].Applied != 1 || len(results[0].Conflicts) != 1 || results[0].Text != expected {
+		t.Errorf("Expected one change and a conflict for the substituted line but received %v", results)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	hunks := diffLines([]string{"a", "b", "c", "d"}, []string{"a", "x", "c", "d", "e"})
+	expected := []diffHunk{{1, 2, 1, 2}, {4, 4, 4, 5}}
+	if len(hunks) != len(expected) {
+		t.Fatalf("Expected %v but received %v", expected, hunks)
+	}
+	for i := range expected {
+		if hunks[i] != expected[i] {
+			t.Errorf("Expected %v but received %v", expected[i], hunks[i])
+		}
+	}
+}
@@ -14,6 +14,12 @@ const (
 	SyntaxErrorUnrecognizedDirective
 	SyntaxErrorExpectedIdentifier
 	SyntaxErrorPredefinedSymbol
+	SyntaxErrorUnterminatedString
+	SyntaxErrorUnknownFunction
+	SyntaxErrorInvalidArgument
+	SyntaxErrorValuedSymbol
+	SyntaxErrorInvalidValue
+	SyntaxErrorInvalidSubstitution
 )
 
 type SyntaxError struct {
@@ -24,6 +30,9 @@ type SyntaxError struct {
 }
 
 func (e SyntaxError) Error() string {
+	if e.column > 0 {
+		return fmt.Sprintf("(%d,%d): %s", e.line, e.column, e.message)
+	}
 	return fmt.Sprintf("(%d): %s", e.line, e.message)
 }
 
@@ -31,6 +40,17 @@ func (e SyntaxError) String() string {
 	return e.message
 }
 
+// Line returns the line on which the error occurred.
+func (e SyntaxError) Line() int {
+	return e.line
+}
+
+// Column returns the column at which the error occurred, or zero if it
+// applies to the whole line.
+func (e SyntaxError) Column() int {
+	return e.column
+}
+
 func (e *SyntaxError) Kind() SyntaxErrorKind {
 	return e.kind
 }
@@ -20,8 +20,17 @@ const (
 	TokenNot
 	TokenLParen
 	TokenRParen
+	TokenString
+	TokenComma
+	TokenLBracket
+	TokenRBracket
+	TokenNumber
 )
 
+func (t Token) String() string {
+	return tokenToString(t)
+}
+
 func tokenToString(token Token) string {
 	result := ""
 
@@ -50,6 +59,16 @@ func tokenToString(token Token) string {
 		result = "LeftParen"
 	case TokenRParen:
 		result = "RightParen"
+	case TokenString:
+		result = "String"
+	case TokenComma:
+		result = "Comma"
+	case TokenLBracket:
+		result = "LeftBracket"
+	case TokenRBracket:
+		result = "RightBracket"
+	case TokenNumber:
+		result = "Number"
 	}
 
 	return result
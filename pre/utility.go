@@ -1,9 +1,40 @@
 package pre
 
-import "path"
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
 
 func removeFileExtension(filename string) string {
 	var extension = path.Ext(filename)
 	var name = filename[0 : len(filename)-len(extension)]
 	return name
 }
+
+// relativePath returns the slash separated path of name relative to the
+// base directory. It is an error for name to be outside of base.
+func relativePath(base string, name string) (string, error) {
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return "", err
+	}
+
+	absName, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(absBase, absName)
+	if err != nil {
+		return "", err
+	}
+
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("'%s' is not within '%s'", name, base)
+	}
+
+	return rel, nil
+}
@@ -0,0 +1,259 @@
+package pre
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type ValueKind int
+
+const (
+	// ValueNone is the value of a symbol defined without a value.
+	ValueNone ValueKind = iota
+	ValueString
+	// ValueBool is the result of a condition, such as a function call.
+	ValueBool
+	// ValueList is an ordered list of values, such as ["a", "b"].
+	ValueList
+	// ValueMap maps strings to values, such as {a = "b"}.
+	ValueMap
+)
+
+// Value is the value of a preprocessor symbol.
+type Value struct {
+	kind     ValueKind
+	text     string
+	elements []Value  // The elements of a list, or the values of a map.
+	keys     []string // The keys of a map, in order.
+}
+
+// StringValue returns a string value.
+func StringValue(text string) Value {
+	return Value{kind: ValueString, text: text}
+}
+
+// BoolValue returns a Boolean value.
+func BoolValue(b bool) Value {
+	if b {
+		return Value{kind: ValueBool, text: "true"}
+	}
+	return Value{kind: ValueBool, text: "false"}
+}
+
+// ListValue returns a list of the elements.
+func ListValue(elements ...Value) Value {
+	return Value{kind: ValueList, elements: elements}
+}
+
+// MapValue returns a map of the entries, with its keys in sorted order.
+func MapValue(entries map[string]Value) Value {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	elements := make([]Value, len(keys))
+	for i, key := range keys {
+		elements[i] = entries[key]
+	}
+	return Value{kind: ValueMap, elements: elements, keys: keys}
+}
+
+// orderedMapValue returns a map whose keys are in the order given. A key
+// that's repeated replaces the earlier value.
+func orderedMapValue(keys []string, elements []Value) Value {
+	v := Value{kind: ValueMap}
+	for i, key := range keys {
+		if j := v.keyIndex(key); j >= 0 {
+			v.elements[j] = elements[i]
+			continue
+		}
+		v.keys = append(v.keys, key)
+		v.elements = append(v.elements, elements[i])
+	}
+	return v
+}
+
+func (v Value) keyIndex(key string) int {
+	for i, k := range v.keys {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// Len returns the number of elements of a list or entries of a map.
+func (v Value) Len() int {
+	return len(v.elements)
+}
+
+// Elements returns the elements of a list, or the values of a map in the
+// order of its keys.
+func (v Value) Elements() []Value {
+	return v.elements
+}
+
+// Keys returns the keys of a map.
+func (v Value) Keys() []string {
+	return v.keys
+}
+
+// Index returns the element of a list at the index, if there is one.
+func (v Value) Index(i int) (Value, bool) {
+	if v.kind != ValueList || i < 0 || i >= len(v.elements) {
+		return Value{}, false
+	}
+	return v.elements[i], true
+}
+
+// Lookup returns the value of a map for the key, if there is one.
+func (v Value) Lookup(key string) (Value, bool) {
+	if v.kind != ValueMap {
+		return Value{}, false
+	}
+	if i := v.keyIndex(key); i >= 0 {
+		return v.elements[i], true
+	}
+	return Value{}, false
+}
+
+// Contains returns true if a list has an element, or a map a key, equal to
+// the text.
+func (v Value) Contains(text string) bool {
+	switch v.kind {
+	case ValueList:
+		for _, element := range v.elements {
+			if element.String() == text {
+				return true
+			}
+		}
+	case ValueMap:
+		return v.keyIndex(text) >= 0
+	}
+	return false
+}
+
+// Bool returns true if the value is the Boolean true.
+func (v Value) Bool() bool {
+	return v.kind == ValueBool && v.text == "true"
+}
+
+// Truth returns whether a symbol with this value is true when it's used as a
+// condition. A symbol defined without a value is true. A value is false if
+// it's empty, "0" or "false" in any case, and true otherwise. A list or map
+// is true if it isn't empty.
+func (v Value) Truth() bool {
+	switch v.kind {
+	case ValueNone:
+		return true
+	case ValueBool:
+		return v.Bool()
+	case ValueList, ValueMap:
+		return v.Len() > 0
+	}
+	return v.text != "" && v.text != "0" && !strings.EqualFold(v.text, "false")
+}
+
+// isBoolean returns true if the value can only be read one way as a
+// condition: no value, or one of "true", "false", "1" and "0".
+func (v Value) isBoolean() bool {
+	switch v.kind {
+	case ValueNone, ValueBool:
+		return true
+	case ValueList, ValueMap:
+		return false
+	}
+	switch strings.ToLower(v.text) {
+	case "true", "false", "1", "0":
+		return true
+	}
+	return false
+}
+
+func (v Value) Kind() ValueKind {
+	return v.kind
+}
+
+// String returns the text of a string or Boolean value, or the literal of
+// a list or map.
+func (v Value) String() string {
+	switch v.kind {
+	case ValueList, ValueMap:
+		return v.Literal()
+	}
+	return v.text
+}
+
+// Literal returns the value as an HCL literal: a quoted string, true or
+// false, a tuple such as ["a", "b"] or an object such as {a = "b"}.
+func (v Value) Literal() string {
+	var buffer bytes.Buffer
+	v.writeLiteral(&buffer)
+	return buffer.String()
+}
+
+func (v Value) writeLiteral(buffer *bytes.Buffer) {
+	switch v.kind {
+	case ValueBool:
+		buffer.WriteString(v.text)
+	case ValueList:
+		buffer.WriteString("[")
+		for i, element := range v.elements {
+			if i > 0 {
+				buffer.WriteString(", ")
+			}
+			element.writeLiteral(buffer)
+		}
+		buffer.WriteString("]")
+	case ValueMap:
+		buffer.WriteString("{")
+		for i, key := range v.keys {
+			if i > 0 {
+				buffer.WriteString(", ")
+			}
+			if isIdentifier(key) {
+				buffer.WriteString(key)
+			} else {
+				buffer.WriteString(hclString(key))
+			}
+			buffer.WriteString(" = ")
+			v.elements[i].writeLiteral(buffer)
+		}
+		buffer.WriteString("}")
+	default:
+		buffer.WriteString(hclString(v.text))
+	}
+}
+
+// hclString quotes the text as an HCL string, escaping the sequences that
+// would otherwise begin an interpolation or a template directive.
+func hclString(text string) string {
+	var buffer bytes.Buffer
+	buffer.WriteString(`"`)
+	for i, r := range text {
+		switch {
+		case r == '"' || r == '\\':
+			buffer.WriteRune('\\')
+			buffer.WriteRune(r)
+		case r == '\n':
+			buffer.WriteString(`\n`)
+		case r == '\r':
+			buffer.WriteString(`\r`)
+		case r == '\t':
+			buffer.WriteString(`\t`)
+		case (r == '$' || r == '%') && strings.HasPrefix(text[i+1:], "{"):
+			buffer.WriteRune(r)
+			buffer.WriteRune(r)
+		case r < ' ':
+			fmt.Fprintf(&buffer, `\u%04x`, r)
+		default:
+			buffer.WriteRune(r)
+		}
+	}
+	buffer.WriteString(`"`)
+	return buffer.String()
+}
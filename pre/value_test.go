@@ -0,0 +1,209 @@
+package pre
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseValue(t *testing.T) {
+	tests := map[string]string{
+		`prod`:                           `"prod"`,
+		`  a "b" `:                       `"  a \"b\" "`,
+		`[]`:                             `[]`,
+		`["a", b, 3,]`:                   `["a", "b", "3"]`,
+		`[true, false]`:                  `[true, false]`,
+		`{}`:                             `{}`,
+		`{dev = "t3.small", prod: m5}`:   `{dev = "t3.small", prod = "m5"}`,
+		`{"us east" = [1], b = {c = d}}`: `{"us east" = ["1"], b = {c = "d"}}`,
+		"{\n  a = 1 # One\n  b = 2 // Two\n  /* Three */ c = 3\n}": `{a = "1", b = "2", c = "3"}`,
+		`{b = 1, a = 2, b = 3}`: `{b = "3", a = "2"}`,
+		`["$${x}", "é\t"]`:      `["$${x}", "é\t"]`,
+	}
+	for text, expected := range tests {
+		value, err := ParseValue(text)
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", text, err)
+			continue
+		}
+		if value.Literal() != expected {
+			t.Errorf("Expected %s to print as %s but received %s", text, expected, value.Literal())
+		}
+	}
+
+	for _, text := range []string{`[`, `["a" "b"]`, `[a,,]`, `{a}`, `{a = }`, `["a]`, `[] x`, `[/* a]`, `["\q"]`} {
+		if _, err := ParseValue(text); err == nil {
+			t.Errorf("Expected an error for '%s'", text)
+		}
+	}
+}
+
+func TestValueElements(t *testing.T) {
+	value, err := ParseValue(`{azs = ["a", "b"], size = "large"}`)
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+
+	if value.Kind() != ValueMap || value.Len() != 2 || strings.Join(value.Keys(), ",") != "azs,size" {
+		t.Fatalf("Expected a map with the keys azs and size but received %s", value.Literal())
+	}
+	azs, ok := value.Lookup("azs")
+	if !ok || azs.Kind() != ValueList || azs.Len() != 2 {
+		t.Fatalf("Expected azs to be a list of 2 elements but received %s", azs.Literal())
+	}
+	if b, ok := azs.Index(1); !ok || b.String() != "b" {
+		t.Errorf("Expected the second element to be b but received %s", b.Literal())
+	}
+	if _, ok := azs.Index(2); ok {
+		t.Error("Expected no third element")
+	}
+	if _, ok := value.Lookup("nope"); ok {
+		t.Error("Expected no value for the key nope")
+	}
+
+	// A map made from Go is sorted by key, and an empty list is false.
+	m := MapValue(map[string]Value{"b": BoolValue(true), "a": ListValue()})
+	if m.String() != "{a = [], b = true}" {
+		t.Errorf("Expected {a = [], b = true} but received %s", m.String())
+	}
+	if ListValue().Truth() || !ListValue(StringValue("")).Truth() || ListValue().isBoolean() {
+		t.Error("Expected a list to be true only if it isn't empty, and not Boolean")
+	}
+}
+
+func TestDefineValue(t *testing.T) {
+	text := `!define AZS ["us-west-2a", "us-west-2b"] # Zones
+!define SIZES {dev = "t3.small", prod = "m5.large"}
+!define FLAGS {dev = false, prod = true}
+!define NAME "a b"
+!if SIZES[ENV] && FLAGS[ENV]
+flag
+!endif
+!if AZS[1] && !AZS[2] && contains(AZS, "us-west-2b")
+second
+!endif
+!switch SIZES[ENV]
+!case "m5.large"
+large
+!default
+other
+!endswitch
+!for AZ in AZS, SIZES
+!switch AZ
+!case "a b"
+never
+!default
+!endswitch
+each
+!endfor
+!if matches(NAME, " ")
+name
+!endif`
+
+	expected := map[string]string{
+		"prod": "flag,second,large,each,each,each,each,name",
+		"dev":  "second,other,each,each,each,each,name",
+		"test": "second,other,each,each,each,each,name",
+	}
+	for env, lines := range expected {
+		switchExpect(t, env, text, lines)
+	}
+
+	p := Parser{}
+	p.SetText("!define A [\"a\", [b]]\n!define B true\n!define C\n")
+	p.Enter()
+	if err := p.ParseDefines(); err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+
+	values := map[string]string{"A": `["a", ["b"]]`, "B": "true", "C": ""}
+	for name, literal := range values {
+		value, defined := p.context.lookup(name)
+		if !defined || value.String() != literal {
+			t.Errorf("Expected %s to be %s but received %s", name, literal, value.String())
+		}
+	}
+	if value, _ := p.context.lookup("B"); value.Kind() != ValueBool {
+		t.Error("Expected B to be Boolean")
+	}
+}
+
+func TestDefineValueErrors(t *testing.T) {
+	tests := []struct {
+		text   string
+		column int
+		kind   SyntaxErrorKind
+	}{
+		{"!define A [\"a\" \"b\"]\n", 16, SyntaxErrorInvalidValue},
+		{"!define A  {a}\n", 14, SyntaxErrorInvalidValue},
+		{"!define A a b\n", 13, SyntaxErrorInvalidValue},
+		{"!define A [\n", 11, SyntaxErrorInvalidValue},
+		{"!if A[]\n", 5, SyntaxErrorInvalidExpression},
+		{"!if A[0\n", 5, SyntaxErrorInvalidExpression},
+	}
+
+	for _, test := range tests {
+		p := Parser{}
+		p.SetText(test.text)
+		p.Enter()
+
+		err := p.ParseLines(func(string, int) {})
+		se, ok := err.(SyntaxError)
+		if !ok || se.Kind() != test.kind || se.Column() != test.column {
+			t.Errorf("Expected a syntax error of kind %d at column %d for %q but received %v", test.kind, test.column, test.text, err)
+		}
+	}
+
+	// Indexing a value that isn't a list or map fails when it's evaluated.
+	p := Parser{}
+	p.SetText("!define A a\n!if true && A[0]\n!endif\n")
+	p.Enter()
+	err := p.ParseLines(func(string, int) {})
+	if pe, ok := err.(ProcessingError); !ok || pe.line != 2 || pe.column != 13 {
+		t.Errorf("Expected a processing error at (2,13) but received %v", err)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	resolver := MapResolver{
+		"ENV":   StringValue("prod"),
+		"AZS":   ListValue(StringValue("a"), StringValue("b")),
+		"SIZES": MapValue(map[string]Value{"prod": StringValue("large"), "dev": StringValue("")}),
+		"ZONES": MapValue(map[string]Value{"us": ListValue(StringValue("us-1"))}),
+	}
+	tests := map[string]bool{
+		"AZS[0] && AZS[1]":                   true,
+		"AZS[2]":                             false,
+		"SIZES[ENV] && !SIZES[\"dev\"]":      true,
+		"SIZES[NOPE] || NOPE[0]":             false,
+		`ZONES["us"][0] && !ZONES["eu"][0]`:  true,
+		`matches(SIZES[lower(ENV)], "^lar")`: true,
+		`contains(ZONES["us"], "us-1")`:      true,
+		`contains(SIZES, "dev")`:             true,
+	}
+	for text, expected := range tests {
+		e, err := ParseExpression(text)
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", text, err)
+			continue
+		}
+		if e.String() != text {
+			t.Errorf("Expected %s to print as itself but received %s", text, e.String())
+		}
+		result, err := e.Eval(resolver)
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", text, err)
+		} else if result != expected {
+			t.Errorf("Expected %s to be %t", text, expected)
+		}
+	}
+
+	for _, text := range []string{`AZS["a"]`, `ENV[0]`, `matches(SIZES["test"], "x")`} {
+		e, err := ParseExpression(text)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error: %s", text, err)
+		}
+		if _, err := e.Eval(resolver); err == nil {
+			t.Errorf("Expected an error evaluating %s", text)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package pre
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// valueError is an error in the text of a value. The offset is that of the
+// rune, from zero, at which the error was found.
+type valueError struct {
+	offset  int
+	message string
+}
+
+func (e valueError) Error() string {
+	return e.message
+}
+
+// valueScanner parses the text of a symbol's value. Composite values use
+// HCL syntax: a list is written ["a", "b"] and a map {a = "b", c = "d"}.
+// Within them, strings may be quoted or bare, and true and false are
+// Boolean values. Whitespace and comments may appear between elements.
+type valueScanner struct {
+	runes    []rune
+	position int
+}
+
+// ParseValue parses the value of a symbol defined outside of a template,
+// such as on the command line. A value that begins with [ or { is a list
+// or map. Any other text is a string value, as given.
+func ParseValue(text string) (Value, error) {
+	trimmed := strings.TrimSpace(text)
+	if !strings.HasPrefix(trimmed, "[") && !strings.HasPrefix(trimmed, "{") {
+		return StringValue(text), nil
+	}
+
+	s := &valueScanner{[]rune(trimmed), 0}
+	value, err := s.scanValue()
+	if err != nil {
+		return Value{}, err
+	}
+	return value, s.expectEnd()
+}
+
+// parseDefineValue parses the value of a !define directive, which is a
+// quoted string, a list, a map, or a word that ends at whitespace. The words
+// true and false are Boolean values. The value may be followed by a comment,
+// and a symbol without a value has the zero Value.
+func parseDefineValue(text string) (Value, error) {
+	s := &valueScanner{[]rune(text), 0}
+	if err := s.skipSpace(); err != nil || s.position == len(s.runes) {
+		return Value{}, err
+	}
+
+	var value Value
+	switch s.current() {
+	case '[', '{', '"':
+		var err error
+		value, err = s.scanValue()
+		if err != nil {
+			return Value{}, err
+		}
+	default:
+		start := s.position
+		for s.position < len(s.runes) && !unicode.IsSpace(s.current()) {
+			s.position++
+		}
+		value = bareValue(string(s.runes[start:s.position]))
+	}
+	return value, s.expectEnd()
+}
+
+// bareValue returns the value of a string that isn't quoted.
+func bareValue(text string) Value {
+	switch text {
+	case "true":
+		return BoolValue(true)
+	case "false":
+		return BoolValue(false)
+	}
+	return StringValue(text)
+}
+
+// expectEnd returns an error if anything other than whitespace and comments
+// follows the value.
+func (s *valueScanner) expectEnd() error {
+	if err := s.skipSpace(); err != nil {
+		return err
+	}
+	if s.position < len(s.runes) {
+		return valueError{s.position, "Unexpected text after value"}
+	}
+	return nil
+}
+
+func (s *valueScanner) current() rune {
+	if s.position < len(s.runes) {
+		return s.runes[s.position]
+	}
+	return unicode.MaxRune
+}
+
+func (s *valueScanner) next() rune {
+	if s.position+1 < len(s.runes) {
+		return s.runes[s.position+1]
+	}
+	return unicode.MaxRune
+}
+
+// skipSpace skips whitespace, including line breaks, and comments.
+func (s *valueScanner) skipSpace() error {
+	for s.position < len(s.runes) {
+		r := s.current()
+		switch {
+		case unicode.IsSpace(r):
+			s.position++
+		case r == '#' || (r == '/' && s.next() == '/'):
+			for s.position < len(s.runes) && s.current() != '\n' {
+				s.position++
+			}
+		case r == '/' && s.next() == '*':
+			start := s.position
+			s.position += 2
+			for !(s.current() == '*' && s.next() == '/') {
+				if s.position >= len(s.runes) {
+					return valueError{start, "Unterminated comment"}
+				}
+				s.position++
+			}
+			s.position += 2
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *valueScanner) scanValue() (Value, error) {
+	if err := s.skipSpace(); err != nil {
+		return Value{}, err
+	}
+
+	switch r := s.current(); {
+	case r == '[':
+		return s.scanList()
+	case r == '{':
+		return s.scanMap()
+	case r == '"':
+		text, err := s.scanString()
+		return StringValue(text), err
+	case isBareRune(r):
+		return bareValue(s.scanBare()), nil
+	case r == unicode.MaxRune:
+		return Value{}, valueError{s.position, "Expected a value"}
+	}
+	return Value{}, valueError{s.position, fmt.Sprintf("Unexpected %q in value", s.current())}
+}
+
+func (s *valueScanner) scanList() (Value, error) {
+	start := s.position
+	s.position++ // Skip [
+
+	var elements []Value
+	for {
+		if err := s.skipSpace(); err != nil {
+			return Value{}, err
+		}
+		switch s.current() {
+		case ']':
+			s.position++
+			return ListValue(elements...), nil
+		case unicode.MaxRune:
+			return Value{}, valueError{start, "List requires a closing ]"}
+		}
+
+		element, err := s.scanValue()
+		if err != nil {
+			return Value{}, err
+		}
+		elements = append(elements, element)
+
+		if err := s.skipSpace(); err != nil {
+			return Value{}, err
+		}
+		switch s.current() {
+		case ',':
+			s.position++
+		case ']':
+		case unicode.MaxRune:
+			return Value{}, valueError{start, "List requires a closing ]"}
+		default:
+			return Value{}, valueError{s.position, "List elements must be separated by commas"}
+		}
+	}
+}
+
+func (s *valueScanner) scanMap() (Value, error) {
+	start := s.position
+	s.position++ // Skip {
+
+	var keys []string
+	var elements []Value
+	for {
+		if err := s.skipSpace(); err != nil {
+			return Value{}, err
+		}
+
+		var key string
+		switch r := s.current(); {
+		case r == '}':
+			s.position++
+			return orderedMapValue(keys, elements), nil
+		case r == unicode.MaxRune:
+			return Value{}, valueError{start, "Map requires a closing }"}
+		case r == '"':
+			text, err := s.scanString()
+			if err != nil {
+				return Value{}, err
+			}
+			key = text
+		case isBareRune(r):
+			key = s.scanBare()
+		default:
+			return Value{}, valueError{s.position, "Expected a map key"}
+		}
+
+		if err := s.skipSpace(); err != nil {
+			return Value{}, err
+		}
+		if r := s.current(); r != '=' && r != ':' {
+			return Value{}, valueError{s.position, fmt.Sprintf("Expected = after the key %s", key)}
+		}
+		s.position++
+
+		element, err := s.scanValue()
+		if err != nil {
+			return Value{}, err
+		}
+		keys = append(keys, key)
+		elements = append(elements, element)
+
+		if err := s.skipSpace(); err != nil {
+			return Value{}, err
+		}
+		if s.current() == ',' {
+			s.position++
+		}
+	}
+}
+
+// scanString scans a quoted string with HCL escapes. The sequences $${ and
+// %%{, which HCL uses to escape a template, are read as ${ and %{.
+func (s *valueScanner) scanString() (string, error) {
+	start := s.position
+	s.position++ // Skip "
+
+	var text []rune
+	for {
+		r := s.current()
+		switch {
+		case r == '"':
+			s.position++
+			return string(text), nil
+		case r == '\n' || r == unicode.MaxRune:
+			return "", valueError{start, "Unterminated string"}
+		case r == '\\':
+			s.position++
+			switch e := s.current(); e {
+			case 'n':
+				text = append(text, '\n')
+			case 'r':
+				text = append(text, '\r')
+			case 't':
+				text = append(text, '\t')
+			case '"', '\\':
+				text = append(text, e)
+			case 'u', 'U':
+				size := 4
+				if e == 'U' {
+					size = 8
+				}
+				if s.position+size >= len(s.runes) {
+					return "", valueError{s.position - 1, "Invalid escape in string"}
+				}
+				code, err := strconv.ParseUint(string(s.runes[s.position+1:s.position+1+size]), 16, 32)
+				if err != nil {
+					return "", valueError{s.position - 1, "Invalid escape in string"}
+				}
+				text = append(text, rune(code))
+				s.position += size
+			default:
+				return "", valueError{s.position - 1, "Invalid escape in string"}
+			}
+			s.position++
+		case (r == '$' || r == '%') && s.next() == r && s.position+2 < len(s.runes) && s.runes[s.position+2] == '{':
+			text = append(text, r)
+			s.position += 2
+		default:
+			text = append(text, r)
+			s.position++
+		}
+	}
+}
+
+// scanBare scans a string that isn't quoted, such as a number or a word.
+func (s *valueScanner) scanBare() string {
+	start := s.position
+	for isBareRune(s.current()) {
+		if r := s.current(); r == '/' && (s.next() == '/' || s.next() == '*') {
+			break
+		}
+		s.position++
+	}
+	return string(s.runes[start:s.position])
+}
+
+// isBareRune returns true if the rune may appear in a bare string.
+func isBareRune(r rune) bool {
+	if r == unicode.MaxRune || unicode.IsSpace(r) {
+		return false
+	}
+	return !strings.ContainsRune(`[]{}(),=:"#`, r)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/toddlucas/terracotta/pre"
+)
+
+// runSimplify rewrites templates in place, resolving the conditional blocks
+// fixed by the symbols given with -define and -undef. Any arguments are the
+// templates to rewrite; otherwise the templates in the source directory are
+// rewritten.
+func runSimplify(args []string) {
+	flags := flag.NewFlagSet("simplify", flag.ExitOnError)
+
+	var o options
+	o.register(flags)
+
+	dryRun := flags.Bool("n", false, "List the templates that would change without writing them")
+
+	flags.Parse(args)
+
+	known := pre.KnownSymbols(o.defines, o.undefs)
+	if len(known) == 0 {
+		log.Fatal("Give the symbols to resolve with -define or -undef")
+	}
+
+	files := flags.Args()
+	if len(files) == 0 {
+		templates, _, err := o.preprocessor().Files(*o.source)
+		if err != nil {
+			log.Fatal(err)
+		}
+		files = templates
+	}
+
+	failed := false
+	for _, filename := range files {
+		changed, err := simplifyFile(filename, known, *dryRun)
+		if err != nil {
+			log.Print(err)
+			failed = true
+		} else if changed {
+			fmt.Println(filename)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// simplifyFile simplifies a single template. It returns true if the
+// template changed.
+func simplifyFile(filename string, known map[string]pre.KnownSymbol, dryRun bool) (bool, error) {
+	input, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+
+	output, err := pre.SimplifyText(string(input), known)
+	if err != nil {
+		return false, fmt.Errorf("%s%w", filename, err)
+	}
+
+	if output == string(input) || dryRun {
+		return output != string(input), nil
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return true, err
+	}
+
+	return true, ioutil.WriteFile(filename, []byte(output), info.Mode())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/toddlucas/terracotta/pre"
+)
+
+// runSymbols lists the symbols defined or referenced in the source
+// directory, with where they're defined and referenced and their value in
+// each directory.
+func runSymbols(args []string) {
+	flags := flag.NewFlagSet("symbols", flag.ExitOnError)
+
+	var o options
+	o.register(flags)
+
+	asJSON := flags.Bool("json", false, "Write the symbols as JSON")
+
+	flags.Parse(args)
+
+	p := o.preprocessor()
+	symbols, err := p.Symbols(*o.source, o.defines, o.undefs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if symbols == nil {
+			symbols = []pre.Symbol{}
+		}
+		if err := encoder.Encode(symbols); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	for i, symbol := range symbols {
+		if i > 0 {
+			fmt.Println()
+		}
+
+		fmt.Println(symbol.Name)
+		for _, site := range symbol.Definitions {
+			verb := "defined"
+			if site.Undefined {
+				verb = "undefined"
+			}
+			fmt.Printf("  %-10s %s%s\n", verb, siteLocation(site), siteValue(site.Value))
+		}
+
+		for _, site := range symbol.References {
+			fmt.Printf("  %-10s %s\n", "referenced", siteLocation(site))
+		}
+
+		for _, value := range symbol.Values {
+			state := "undefined"
+			if value.Defined {
+				state = "defined" + siteValue(value.Value)
+			}
+			fmt.Printf("  %-10s %s: %s\n", "value", value.Directory, state)
+		}
+	}
+}
+
+// siteLocation describes where a symbol is defined or referenced.
+func siteLocation(site pre.SymbolSite) string {
+	location := site.Filename
+	if site.Line > 0 {
+		location = fmt.Sprintf("%s:%d", location, site.Line)
+	}
+
+	switch {
+	case site.Source == "":
+		return location
+	case location == "":
+		return "(" + site.Source + ")"
+	}
+	return location + " (" + site.Source + ")"
+}
+
+func siteValue(value string) string {
+	if value == "" {
+		return ""
+	}
+	return fmt.Sprintf(" = %q", value)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// runSync propagates edits made to the generated files in the output
+// directory back to their templates.
+func runSync(args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+
+	var o options
+	o.register(flags)
+
+	output := flags.String("output", ".", "The output directory")
+	dryRun := flags.Bool("n", false, "Report the changes without writing the templates")
+
+	flags.Parse(args)
+
+	p := o.preprocessor()
+	results, err := p.Sync(*o.source, *output, o.defines, o.undefs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := false
+	for _, result := range results {
+		for _, conflict := range result.Conflicts {
+			fmt.Printf("%s:%d: conflict: %s\n", result.Generated, conflict.Line, conflict.Message)
+			failed = true
+		}
+
+		if result.Applied == 0 {
+			continue
+		}
+
+		fmt.Printf("%s: %d changes from %s\n", result.Template, result.Applied, result.Generated)
+		if *dryRun {
+			continue
+		}
+
+		info, err := os.Stat(result.Template)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = ioutil.WriteFile(result.Template, []byte(result.Text), info.Mode())
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}